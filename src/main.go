@@ -37,6 +37,7 @@ import (
 	"github.com/datastax/burnell/src/policy"
 	"github.com/datastax/burnell/src/route"
 	"github.com/datastax/burnell/src/util"
+	"github.com/datastax/burnell/src/webhook"
 	"github.com/datastax/burnell/src/workflow"
 	httptls "github.com/kafkaesque-io/pulsar-beam/src/util"
 )
@@ -54,8 +55,13 @@ func main() {
 		log.Fatalf("gops instrument error %v", err)
 	}
 
-	modePtr := flag.String("mode", util.Proxy, "process running mode: proxy(default), init, healer")
+	modePtr := flag.String("mode", util.Proxy, "process running mode: proxy(default), init, healer, export, import")
 	version := flag.Bool("version", false, "version (commit sha)")
+	bundleFile := flag.String("file", "", "tenant bundle file for export and import mode, default to stdout and stdin")
+	bundleFormat := flag.String("format", "json", "tenant bundle export format: json(default), yaml")
+	importMode := flag.String("import-mode", policy.MergeImport, "tenant bundle import mode: merge(default), replace")
+	dryRun := flag.Bool("dry-run", false, "report the tenant bundle import changes without applying them")
+	includeSecrets := flag.Bool("include-secrets", false, "export the webhook signing secrets in the tenant bundle")
 	flag.Parse()
 	if *version {
 		fmt.Printf("git commit: %s\n", gitCommit)
@@ -74,18 +80,27 @@ func main() {
 		// run once for initialization and exit
 		workflow.ConfigKeysJWTs(true)
 		return
+	} else if util.IsTenantBundleMode(&mode) {
+		// run once to export or import tenants and exit
+		if err := workflow.RunTenantBundle(mode, *bundleFile, *bundleFormat, *importMode, *dryRun, *includeSecrets); err != nil {
+			log.Fatal(err.Error())
+		}
+		return
 	} else if util.IsHealer(&mode) {
 		router = route.HealerRouter()
 		workflow.ConfigKeysJWTs(false)
 	} else { //default proxy mode
 		route.Init()
 		metrics.Init()
+		policy.Init()
+		webhook.Init()
 
 		router = route.NewRouter()
 		if !util.IsStatsMode() {
 			log.Infof("a full proxy mode")
 			logclient.FunctionTopicWatchDog()
 			policy.Initialize()
+			route.QuotaAlertWatchDog()
 		}
 	}
 
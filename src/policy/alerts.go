@@ -0,0 +1,413 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/datastax/burnell/src/util"
+	"github.com/datastax/burnell/src/webhook"
+)
+
+// alert rule targets
+const (
+	AlertTargetTopic        = "topic"
+	AlertTargetSubscription = "subscription"
+)
+
+// alert states
+const (
+	AlertPending  = "pending"
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+)
+
+// ErrAlertRuleNotFound is returned when the tenant does not have the alert rule
+var ErrAlertRuleNotFound = errors.New("alert rule does not exist")
+
+// AlertRule is a condition on a numeric field of the topics or the subscriptions in the scope,
+// which fires once the condition has held for the duration
+type AlertRule struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	Target       string    `json:"target"` // topic by default, or subscription
+	Metric       string    `json:"metric"` // a numeric field of the topic or subscription stats
+	Operator     string    `json:"operator"`
+	Threshold    float64   `json:"threshold"`
+	For          string    `json:"for,omitempty"`          // a duration, i.e. 5m, the condition must hold before firing
+	Namespace    string    `json:"namespace,omitempty"`    // either the namespace name or tenant/namespace
+	Topic        string    `json:"topic,omitempty"`        // a glob pattern of the topic name without the tenant and namespace
+	Subscription string    `json:"subscription,omitempty"` // a glob pattern of the subscription name
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+// Alert is the state of a rule on a single topic or subscription
+type Alert struct {
+	RuleID      string     `json:"ruleId"`
+	RuleName    string     `json:"ruleName"`
+	Tenant      string     `json:"tenant"`
+	Target      string     `json:"target"` // the topic fullname, or topic fullname/subscription
+	Metric      string     `json:"metric"`
+	Value       float64    `json:"value"`
+	Threshold   float64    `json:"threshold"`
+	Status      string     `json:"status"`
+	ActiveSince time.Time  `json:"activeSince"`
+	FiringSince *time.Time `json:"firingSince,omitempty"`
+	ResolvedAt  *time.Time `json:"resolvedAt,omitempty"`
+}
+
+var alertOperators = map[string]func(v, threshold float64) bool{
+	">":  func(v, threshold float64) bool { return v > threshold },
+	">=": func(v, threshold float64) bool { return v >= threshold },
+	"<":  func(v, threshold float64) bool { return v < threshold },
+	"<=": func(v, threshold float64) bool { return v <= threshold },
+	"==": func(v, threshold float64) bool { return v == threshold },
+	"!=": func(v, threshold float64) bool { return v != threshold },
+}
+
+// the alert states by tenant, and the key of an alert is rule id and target
+var (
+	alerts     = make(map[string]map[string]*Alert)
+	alertsLock = sync.RWMutex{}
+)
+
+// the period a resolved alert is kept for the state query
+var alertResolvedRetention = time.Duration(util.GetEnvInt("AlertResolvedRetentionSecond", 3600)) * time.Second
+
+// Validate verifies the target, metric, operator, duration and patterns of the rule
+func (r AlertRule) Validate() error {
+	switch r.Target {
+	case AlertTargetTopic:
+		if _, ok := topicStatsFieldIndex[r.Metric]; !ok {
+			return fmt.Errorf("unsupported topic metric %s", r.Metric)
+		}
+	case AlertTargetSubscription:
+		if _, ok := subscriptionFields[r.Metric]; !ok {
+			return fmt.Errorf("unsupported subscription metric %s", r.Metric)
+		}
+	default:
+		return fmt.Errorf("unsupported alert target %s", r.Target)
+	}
+	if _, ok := alertOperators[r.Operator]; !ok {
+		return fmt.Errorf("unsupported operator %s", r.Operator)
+	}
+	if _, err := r.duration(); err != nil {
+		return fmt.Errorf("invalid duration %s", r.For)
+	}
+	for _, pattern := range []string{r.Topic, r.Subscription} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid name pattern %s", pattern)
+		}
+	}
+	return nil
+}
+
+func (r AlertRule) duration() (time.Duration, error) {
+	if r.For == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(r.For)
+	if err == nil && d < 0 {
+		err = fmt.Errorf("negative duration")
+	}
+	return d, err
+}
+
+// matchTopic evaluates if the topic is in the scope of the rule
+func (r AlertRule) matchTopic(tenant string, ts *TopicStats) bool {
+	if r.Namespace != "" && r.Namespace != ts.Namespace && tenant+"/"+r.Namespace != ts.Namespace {
+		return false
+	}
+	if r.Topic != "" {
+		if ok, _ := path.Match(r.Topic, topicShortName(ts.ID)); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// values returns the metric value of every topic or subscription in the scope of the rule, keyed by the target
+func (r AlertRule) values(tenant string, topics []*TopicStats) map[string]float64 {
+	values := make(map[string]float64)
+	for _, ts := range topics {
+		if !r.matchTopic(tenant, ts) {
+			continue
+		}
+		if r.Target == AlertTargetTopic {
+			values[ts.ID], _ = ts.Fields.Value(r.Metric)
+			continue
+		}
+		for _, s := range ParseSubscriptionStats(ts) {
+			if r.Subscription != "" {
+				if ok, _ := path.Match(r.Subscription, s.Subscription); !ok {
+					continue
+				}
+			}
+			values[s.Topic+"/"+s.Subscription] = subscriptionFields[r.Metric](s.withTrend())
+		}
+	}
+	return values
+}
+
+// reconcileAlertRules validates the rules set with a tenant plan and defaults the target, id and creation time
+func reconcileAlertRules(rules []AlertRule) ([]AlertRule, error) {
+	reconciled := []AlertRule{}
+	for _, rule := range rules {
+		if rule.Target == "" {
+			rule.Target = AlertTargetTopic
+		}
+		if err := rule.Validate(); err != nil {
+			return nil, fmt.Errorf("alert rule %s: %v", rule.Name, err)
+		}
+		if rule.ID == "" {
+			rule.ID, _ = util.NewUUID()
+		}
+		if rule.CreatedAt.IsZero() {
+			rule.CreatedAt = time.Now()
+		}
+		reconciled = append(reconciled, rule)
+	}
+	return reconciled, nil
+}
+
+// AlertRuleLimit returns the maximum number of alert rules of the tenant plan, -1 is unlimited.
+// A plan stored without the limit takes the default of its plan type.
+func AlertRuleLimit(plan TenantPlan) int {
+	if plan.Policy.AlertRules != 0 {
+		return plan.Policy.AlertRules
+	}
+	if policy := getPlanPolicy(strings.ToLower(plan.PlanType)); policy != nil {
+		return policy.AlertRules
+	}
+	return 0
+}
+
+// AddAlertRule validates the rule against the plan limit and returns the plan with the rule added or replaced
+func AddAlertRule(plan TenantPlan, rule AlertRule) (TenantPlan, AlertRule, error) {
+	if rule.Target == "" {
+		rule.Target = AlertTargetTopic
+	}
+	if err := rule.Validate(); err != nil {
+		return plan, rule, err
+	}
+
+	rules := []AlertRule{}
+	replaced := false
+	for _, v := range plan.AlertRules {
+		if rule.ID != "" && v.ID == rule.ID {
+			rule.CreatedAt = v.CreatedAt
+			rules = append(rules, rule)
+			replaced = true
+			continue
+		}
+		rules = append(rules, v)
+	}
+	if !replaced {
+		if rule.ID != "" {
+			return plan, rule, ErrAlertRuleNotFound
+		}
+		if limit := AlertRuleLimit(plan); limit >= 0 && len(rules) >= limit {
+			return plan, rule, fmt.Errorf("the plan allows %d alert rules", limit)
+		}
+		rule.ID, _ = util.NewUUID()
+		rule.CreatedAt = time.Now()
+		rules = append(rules, rule)
+	}
+	plan.AlertRules = rules
+	return plan, rule, nil
+}
+
+// RemoveAlertRule returns the plan without the rule
+func RemoveAlertRule(plan TenantPlan, ruleID string) (TenantPlan, error) {
+	rules := []AlertRule{}
+	for _, v := range plan.AlertRules {
+		if v.ID != ruleID {
+			rules = append(rules, v)
+		}
+	}
+	if len(rules) == len(plan.AlertRules) {
+		return plan, ErrAlertRuleNotFound
+	}
+	plan.AlertRules = rules
+	return plan, nil
+}
+
+// EvaluateAlerts evaluates the alert rules of the tenants against the fresh topic stats.
+// An alert is pending while the condition holds shorter than the rule duration, then firing until the condition
+// no longer holds. The alerts on a stale topic whose broker is not in the polled brokers are unknown rather than
+// resolved, so that a failed broker poll does not resolve them. Every replica evaluates the alerts for the alerts
+// endpoint, while only the notification leader notifies the webhook subscriptions of the firing and resolved alerts.
+func EvaluateAlerts(plans []TenantPlan, now time.Time, polled map[string]bool) {
+	alertsLock.Lock()
+	defer alertsLock.Unlock()
+	evaluated := make(map[string]bool)
+	for _, plan := range plans {
+		if len(plan.AlertRules) > 0 {
+			evaluateTenantAlerts(plan, now, polled)
+			evaluated[plan.Name] = true
+		}
+	}
+	for tenant, states := range alerts {
+		if !evaluated[tenant] {
+			// the tenant has been deleted or has no rules
+			delete(alerts, tenant)
+			continue
+		}
+		for k, v := range states {
+			if v.Status == AlertResolved && now.Sub(*v.ResolvedAt) > alertResolvedRetention {
+				delete(states, k)
+			}
+		}
+		if len(states) == 0 {
+			delete(alerts, tenant)
+		}
+	}
+}
+
+// evaluateTenantAlerts evaluates the rules of a tenant, the caller must hold the lock
+func evaluateTenantAlerts(plan TenantPlan, now time.Time, polled map[string]bool) {
+	topics, err := freshTenantTopics(plan.Name, now)
+	if err != nil {
+		statsLog.Errorf("failed to read tenant %s topic stats %v", plan.Name, err)
+		return
+	}
+	unknown := unpolledTenantTopics(plan.Name, now, polled)
+	notify := util.IsNotificationLeader()
+	states, ok := alerts[plan.Name]
+	if !ok {
+		states = make(map[string]*Alert)
+		alerts[plan.Name] = states
+	}
+
+	active := make(map[string]bool)
+	for _, rule := range plan.AlertRules {
+		if rule.Target == "" {
+			rule.Target = AlertTargetTopic
+		}
+		// a rule stored without validation is skipped rather than resolving a missing metric or operator
+		if err := rule.Validate(); err != nil {
+			continue
+		}
+		duration, _ := rule.duration()
+		for target, value := range rule.values(plan.Name, topics) {
+			if !alertOperators[rule.Operator](value, rule.Threshold) {
+				continue
+			}
+			key := rule.ID + " " + target
+			active[key] = true
+			alert, ok := states[key]
+			if !ok || alert.Status == AlertResolved {
+				alert = &Alert{
+					RuleID:      rule.ID,
+					Tenant:      plan.Name,
+					Target:      target,
+					Status:      AlertPending,
+					ActiveSince: now,
+				}
+				states[key] = alert
+			}
+			alert.RuleName, alert.Metric, alert.Threshold, alert.Value = rule.Name, rule.Metric, rule.Threshold, value
+			if alert.Status == AlertPending && now.Sub(alert.ActiveSince) >= duration {
+				firingSince := now
+				alert.Status, alert.FiringSince = AlertFiring, &firingSince
+				if notify {
+					webhook.Manager.Publish(webhook.NewEvent(webhook.AlertFiring, plan.Name, *alert))
+				}
+			}
+		}
+	}
+
+	for k, v := range states {
+		if active[k] || isUnknownTarget(v.Target, unknown) {
+			continue
+		}
+		switch v.Status {
+		case AlertPending:
+			delete(states, k)
+		case AlertFiring:
+			resolvedAt := now
+			v.Status, v.ResolvedAt = AlertResolved, &resolvedAt
+			if notify {
+				webhook.Manager.Publish(webhook.NewEvent(webhook.AlertResolved, plan.Name, *v))
+			}
+		}
+	}
+}
+
+// isUnknownTarget evaluates if the alert target is either an unknown topic or a subscription of one
+func isUnknownTarget(target string, unknown map[string]bool) bool {
+	for topic := range unknown {
+		if target == topic || strings.HasPrefix(target, topic+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// unpolledTenantTopics returns the tenant's stale topics whose broker is not in the polled brokers,
+// these topics may still exist but their stats are unknown
+func unpolledTenantTopics(tenant string, now time.Time, polled map[string]bool) map[string]bool {
+	topics := make(map[string]bool)
+	txn := topicStatsDB.Txn(false)
+	defer txn.Abort()
+	result, err := txn.Get(topicStatsDBTable, "tenant", tenant)
+	if err != nil {
+		statsLog.Errorf("failed to read tenant %s topic stats %v", tenant, err)
+		return topics
+	}
+	for i := result.Next(); i != nil; i = result.Next() {
+		if p, ok := i.(*TopicStats); ok && now.Sub(p.UpdatedAt) >= topicStatsFreshness && !polled[p.Broker] {
+			topics[p.ID] = true
+		}
+	}
+	return topics
+}
+
+// TenantAlerts returns the pending, firing and recently resolved alerts of the tenant
+func TenantAlerts(tenant string) []Alert {
+	alertsLock.RLock()
+	defer alertsLock.RUnlock()
+	result := []Alert{}
+	for _, v := range alerts[tenant] {
+		result = append(result, *v)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].RuleID != result[j].RuleID {
+			return result[i].RuleID < result[j].RuleID
+		}
+		return result[i].Target < result[j].Target
+	})
+	return result
+}
+
+// evaluateAlertRules evaluates the alert rules of all the tenants once the tenant database is ready
+func evaluateAlertRules(now time.Time, polled map[string]bool) {
+	if TenantManager.IsReady() {
+		EvaluateAlerts(TenantManager.ListTenants(), now, polled)
+	}
+}
@@ -0,0 +1,140 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package policy
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/datastax/burnell/src/util"
+)
+
+// AuditEntry is a single change recorded in the tenant plan history
+type AuditEntry struct {
+	Version      int64        `json:"version"`
+	Timestamp    time.Time    `json:"timestamp"`
+	Actor        string       `json:"actor"`
+	PrevPlanType string       `json:"prevPlanType"`
+	PrevStatus   TenantStatus `json:"prevStatus"`
+	PrevPolicy   PlanPolicy   `json:"prevPolicy"`
+	NewPlanType  string       `json:"newPlanType"`
+	NewStatus    TenantStatus `json:"newStatus"`
+	NewPolicy    PlanPolicy   `json:"newPolicy"`
+	Reason       string       `json:"reason"`
+}
+
+// FieldDiff is a changed attribute between two versions of a tenant plan
+type FieldDiff struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
+
+// TenantPlanDiff is the difference between two versions of a tenant plan
+type TenantPlanDiff struct {
+	Tenant  string      `json:"tenant"`
+	From    int64       `json:"from"`
+	To      int64       `json:"to"`
+	Changes []FieldDiff `json:"changes"`
+}
+
+// the maximum number of history entries kept with each tenant record
+var auditHistorySize = util.GetEnvInt("TenantAuditHistorySize", 50)
+
+// AppendAuditEntry records the change from the existing plan to the new plan in the new plan's history.
+// The entry takes the new plan's version, or the next version in the history if the plan is not versioned.
+// Only the most recent entries are kept so the tenant record does not grow without bound.
+func AppendAuditEntry(newPlan, existingPlan TenantPlan, actor, reason string) TenantPlan {
+	version := newPlan.Version
+	if version == 0 {
+		version = 1
+		if size := len(existingPlan.History); size > 0 {
+			version = existingPlan.History[size-1].Version + 1
+		}
+	}
+
+	entry := AuditEntry{
+		Version:      version,
+		Timestamp:    time.Now(),
+		Actor:        actor,
+		PrevPlanType: existingPlan.PlanType,
+		PrevStatus:   existingPlan.TenantStatus,
+		PrevPolicy:   existingPlan.Policy,
+		NewPlanType:  newPlan.PlanType,
+		NewStatus:    newPlan.TenantStatus,
+		NewPolicy:    newPlan.Policy,
+		Reason:       reason,
+	}
+
+	// copy to avoid sharing the backing array with the cached existing plan
+	history := make([]AuditEntry, 0, len(existingPlan.History)+1)
+	history = append(history, existingPlan.History...)
+	history = append(history, entry)
+	if auditHistorySize > 0 && len(history) > auditHistorySize {
+		history = history[len(history)-auditHistorySize:]
+	}
+	newPlan.History = history
+	return newPlan
+}
+
+// DiffTenantHistory compares the plan type, status and policy between two versions in the history
+func DiffTenantHistory(history []AuditEntry, from, to int64) ([]FieldDiff, error) {
+	fromEntry, ok := findAuditEntry(history, from)
+	if !ok {
+		return nil, fmt.Errorf("version %d is not found in the tenant history", from)
+	}
+	toEntry, ok := findAuditEntry(history, to)
+	if !ok {
+		return nil, fmt.Errorf("version %d is not found in the tenant history", to)
+	}
+
+	changes := []FieldDiff{}
+	if fromEntry.NewPlanType != toEntry.NewPlanType {
+		changes = append(changes, FieldDiff{Field: "planType", From: fromEntry.NewPlanType, To: toEntry.NewPlanType})
+	}
+	if fromEntry.NewStatus != toEntry.NewStatus {
+		changes = append(changes, FieldDiff{Field: "tenantStatus", From: fromEntry.NewStatus, To: toEntry.NewStatus})
+	}
+
+	fromPolicy := reflect.ValueOf(fromEntry.NewPolicy)
+	toPolicy := reflect.ValueOf(toEntry.NewPolicy)
+	policyType := fromPolicy.Type()
+	for i := 0; i < policyType.NumField(); i++ {
+		a, b := fromPolicy.Field(i).Interface(), toPolicy.Field(i).Interface()
+		if a != b {
+			name := strings.Split(policyType.Field(i).Tag.Get("json"), ",")[0]
+			changes = append(changes, FieldDiff{Field: "policy." + name, From: a, To: b})
+		}
+	}
+	return changes, nil
+}
+
+func findAuditEntry(history []AuditEntry, version int64) (AuditEntry, bool) {
+	for _, v := range history {
+		if v.Version == version {
+			return v, true
+		}
+	}
+	return AuditEntry{}, false
+}
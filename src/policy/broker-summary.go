@@ -0,0 +1,339 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/datastax/burnell/src/util"
+)
+
+// brokerResourceUsage is the usage and the limit of a resource in the load report
+type brokerResourceUsage struct {
+	Usage float64 `json:"usage"`
+	Limit float64 `json:"limit"`
+}
+
+// percent returns the usage in percentage of the limit, or 0 without a limit
+func (r brokerResourceUsage) percent() float64 {
+	if r.Limit <= 0 {
+		return 0
+	}
+	return r.Usage / r.Limit * 100
+}
+
+// brokerLoadReport is the subset of the broker-stats/load-report used by the summary
+type brokerLoadReport struct {
+	CPU              brokerResourceUsage `json:"cpu"`
+	Memory           brokerResourceUsage `json:"memory"`
+	BandwidthIn      brokerResourceUsage `json:"bandwidthIn"`
+	BandwidthOut     brokerResourceUsage `json:"bandwidthOut"`
+	MsgRateIn        float64             `json:"msgRateIn"`
+	MsgRateOut       float64             `json:"msgRateOut"`
+	MsgThroughputIn  float64             `json:"msgThroughputIn"`
+	MsgThroughputOut float64             `json:"msgThroughputOut"`
+	NumProducers     int                 `json:"numProducers"`
+	NumConsumers     int                 `json:"numConsumers"`
+	Bundles          []string            `json:"bundles"` // namespace/bundle range
+}
+
+// BrokerSummary is the load and the bundle and topic distribution of a broker
+type BrokerSummary struct {
+	Broker           string  `json:"broker"`
+	Bundles          int     `json:"bundles"`
+	Topics           int     `json:"topics"`
+	Producers        int     `json:"producers"`
+	Consumers        int     `json:"consumers"`
+	MsgRateIn        float64 `json:"msgRateIn"`
+	MsgRateOut       float64 `json:"msgRateOut"`
+	MsgThroughputIn  float64 `json:"msgThroughputIn"`
+	MsgThroughputOut float64 `json:"msgThroughputOut"`
+	CPU              float64 `json:"cpuPercent"`
+	Memory           float64 `json:"memoryPercent"`
+	BandwidthIn      float64 `json:"bandwidthInPercent"`
+	BandwidthOut     float64 `json:"bandwidthOutPercent"`
+	Error            string  `json:"error,omitempty"`
+}
+
+// brokerMetrics is an entry of the broker-stats/metrics
+type brokerMetrics struct {
+	Dimensions map[string]string      `json:"dimensions"`
+	Metrics    map[string]interface{} `json:"metrics"`
+}
+
+// NamespaceBundles is the number of bundles of a namespace, the brokers owning them and the throughput
+// from the namespace metrics of the brokers
+type NamespaceBundles struct {
+	Namespace        string  `json:"namespace"`
+	Bundles          int     `json:"bundles"`
+	Brokers          int     `json:"brokers"`
+	MsgThroughputIn  float64 `json:"msgThroughputIn"`
+	MsgThroughputOut float64 `json:"msgThroughputOut"`
+}
+
+// BrokerImbalance is the coefficient of variation across the brokers, 0 is perfectly balanced
+type BrokerImbalance struct {
+	Bundles    float64 `json:"bundles"`
+	Topics     float64 `json:"topics"`
+	Throughput float64 `json:"throughput"`
+}
+
+// BrokersSummary is the cluster level summary of the broker stats
+type BrokersSummary struct {
+	Brokers          []BrokerSummary    `json:"brokers"` // in the broker name order
+	FailedBrokers    int                `json:"failedBrokers"`
+	Bundles          int                `json:"bundles"`
+	Topics           int                `json:"topics"`
+	MsgThroughputIn  float64            `json:"msgThroughputIn"`
+	MsgThroughputOut float64            `json:"msgThroughputOut"`
+	HotBrokers       []string           `json:"hotBrokers"` // by the throughput in and out in the descending order
+	Imbalance        BrokerImbalance    `json:"imbalance"`
+	TopNamespaces    []NamespaceBundles `json:"topNamespaces"` // by the number of bundles in the descending order
+}
+
+// ClusterBrokersSummary summarizes all the brokers of the cluster with the stats poll concurrency and deadline
+func ClusterBrokersSummary(top int) BrokersSummary {
+	return SummarizeBrokers(GetBrokers(), top, statsPollConcurrency, statsBrokerTimeout)
+}
+
+// SummarizeBrokers collects the load report, the topics and the metrics of every broker and summarizes the cluster.
+// top is the number of hot brokers and namespaces to list. A broker failing the load report or the topics query
+// is counted as failed and excluded from the imbalance scores. The metrics only add the namespace throughput.
+func SummarizeBrokers(brokers []string, top, concurrency int, timeout time.Duration) BrokersSummary {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	summaries := make([]BrokerSummary, len(brokers))
+	// namespace to bundle ranges to the owner broker
+	bundles := make(map[string]map[string]string)
+	throughputs := make(map[string][2]float64)
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	for i, broker := range brokers {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, broker string) {
+			defer func() { <-sem; wg.Done() }()
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			summary := BrokerSummary{Broker: broker}
+
+			report := brokerLoadReport{}
+			// tenant's namespace/bundle hash/persistent/topicFullName
+			var topics map[string]map[string]map[string]map[string]interface{}
+			err := brokerGetJSON(ctx, broker, "admin/v2/broker-stats/load-report", &report)
+			if err == nil {
+				err = brokerGetJSON(ctx, broker, "admin/v2/broker-stats/topics", &topics)
+			}
+			if err != nil {
+				summary.Error = err.Error()
+				summaries[i] = summary
+				return
+			}
+
+			var metrics []brokerMetrics
+			if err := brokerGetJSON(ctx, broker, "admin/v2/broker-stats/metrics", &metrics); err != nil {
+				statsLog.Errorf("broker %s metrics are not summarized %v", broker, err)
+			}
+
+			owned := make(map[string]map[string]bool)
+			own := func(ns, bundle string) {
+				if owned[ns] == nil {
+					owned[ns] = make(map[string]bool)
+				}
+				owned[ns][bundle] = true
+			}
+			for _, v := range report.Bundles {
+				if pos := strings.LastIndex(v, "/"); pos > 0 {
+					own(v[:pos], v[pos+1:])
+				}
+			}
+			for ns, v := range topics {
+				for bundle, v2 := range v {
+					own(ns, bundle)
+					for _, v3 := range v2 {
+						summary.Topics += len(v3)
+					}
+				}
+			}
+
+			summary.Producers, summary.Consumers = report.NumProducers, report.NumConsumers
+			summary.MsgRateIn, summary.MsgRateOut = report.MsgRateIn, report.MsgRateOut
+			summary.MsgThroughputIn, summary.MsgThroughputOut = report.MsgThroughputIn, report.MsgThroughputOut
+			summary.CPU, summary.Memory = report.CPU.percent(), report.Memory.percent()
+			summary.BandwidthIn, summary.BandwidthOut = report.BandwidthIn.percent(), report.BandwidthOut.percent()
+
+			lock.Lock()
+			defer lock.Unlock()
+			for ns, v := range owned {
+				summary.Bundles += len(v)
+				if bundles[ns] == nil {
+					bundles[ns] = make(map[string]string)
+				}
+				for bundle := range v {
+					bundles[ns][bundle] = broker
+				}
+			}
+			for _, m := range metrics {
+				if ns := m.Dimensions["namespace"]; ns != "" {
+					in, _ := m.Metrics["brk_in_tp_rate"].(float64)
+					out, _ := m.Metrics["brk_out_tp_rate"].(float64)
+					t := throughputs[ns]
+					throughputs[ns] = [2]float64{t[0] + in, t[1] + out}
+				}
+			}
+			summaries[i] = summary
+		}(i, broker)
+	}
+	wg.Wait()
+	return summarizeCluster(summaries, bundles, throughputs, top)
+}
+
+// summarizeCluster computes the totals, the hot brokers, the imbalance scores and the namespaces with the most bundles
+func summarizeCluster(summaries []BrokerSummary, bundles map[string]map[string]string, throughputs map[string][2]float64, top int) BrokersSummary {
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Broker < summaries[j].Broker })
+	result := BrokersSummary{Brokers: summaries, HotBrokers: []string{}, TopNamespaces: []NamespaceBundles{}}
+
+	healthy := []BrokerSummary{}
+	var bundleCounts, topicCounts, brokerThroughputs []float64
+	for _, v := range summaries {
+		if v.Error != "" {
+			result.FailedBrokers++
+			continue
+		}
+		healthy = append(healthy, v)
+		result.Bundles += v.Bundles
+		result.Topics += v.Topics
+		result.MsgThroughputIn += v.MsgThroughputIn
+		result.MsgThroughputOut += v.MsgThroughputOut
+		bundleCounts = append(bundleCounts, float64(v.Bundles))
+		topicCounts = append(topicCounts, float64(v.Topics))
+		brokerThroughputs = append(brokerThroughputs, v.MsgThroughputIn+v.MsgThroughputOut)
+	}
+	result.Imbalance = BrokerImbalance{
+		Bundles:    coefficientOfVariation(bundleCounts),
+		Topics:     coefficientOfVariation(topicCounts),
+		Throughput: coefficientOfVariation(brokerThroughputs),
+	}
+
+	sort.SliceStable(healthy, func(i, j int) bool {
+		return healthy[i].MsgThroughputIn+healthy[i].MsgThroughputOut > healthy[j].MsgThroughputIn+healthy[j].MsgThroughputOut
+	})
+	for i := 0; i < top && i < len(healthy); i++ {
+		result.HotBrokers = append(result.HotBrokers, healthy[i].Broker)
+	}
+
+	namespaces := []NamespaceBundles{}
+	for ns, v := range bundles {
+		owners := make(map[string]bool)
+		for _, broker := range v {
+			owners[broker] = true
+		}
+		namespaces = append(namespaces, NamespaceBundles{
+			Namespace:        ns,
+			Bundles:          len(v),
+			Brokers:          len(owners),
+			MsgThroughputIn:  throughputs[ns][0],
+			MsgThroughputOut: throughputs[ns][1],
+		})
+	}
+	sort.Slice(namespaces, func(i, j int) bool {
+		if namespaces[i].Bundles != namespaces[j].Bundles {
+			return namespaces[i].Bundles > namespaces[j].Bundles
+		}
+		return namespaces[i].Namespace < namespaces[j].Namespace
+	})
+	if top < len(namespaces) {
+		namespaces = namespaces[:top]
+	}
+	result.TopNamespaces = namespaces
+	return result
+}
+
+// coefficientOfVariation is the standard deviation over the mean, 0 if the mean is 0
+func coefficientOfVariation(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	mean := 0.0
+	for _, v := range values {
+		mean += v
+	}
+	mean /= float64(len(values))
+	if mean == 0 {
+		return 0
+	}
+	variance := 0.0
+	for _, v := range values {
+		variance += (v - mean) * (v - mean)
+	}
+	return math.Sqrt(variance/float64(len(values))) / mean
+}
+
+// brokerGetJSON gets the route from the broker and unmarshals the response body
+func brokerGetJSON(ctx context.Context, urlString, route string, v interface{}) error {
+	body, err := brokerGet(ctx, urlString, route)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
+
+// brokerGet gets the route from the broker and returns the response body
+func brokerGet(ctx context.Context, urlString, route string) ([]byte, error) {
+	if !strings.HasPrefix(urlString, "http") {
+		urlString = "http://" + urlString
+	}
+	requestURL := util.SingleJoinSlash(urlString, route)
+	newRequest, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	newRequest.Header.Add("user-agent", "burnell")
+	newRequest.Header.Add("Authorization", "Bearer "+util.Config.PulsarToken)
+	client := &http.Client{
+		CheckRedirect: util.PreserveHeaderForRedirect,
+	}
+	response, err := client.Do(newRequest)
+	if response != nil {
+		defer response.Body.Close()
+	}
+	if err != nil {
+		statsLog.Errorf("GET %s error %v", requestURL, err)
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		statsLog.Errorf("GET %s response status code %d", requestURL, response.StatusCode)
+		return nil, fmt.Errorf("GET %s response status code %d", route, response.StatusCode)
+	}
+	return ioutil.ReadAll(response.Body)
+}
@@ -0,0 +1,194 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package policy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// client connection types
+const (
+	ProducerConnection = "producer"
+	ConsumerConnection = "consumer"
+)
+
+// ClientConnection is a producer or a consumer connected to a topic
+type ClientConnection struct {
+	Type           string  `json:"type"` // producer or consumer
+	Topic          string  `json:"topic"`
+	Namespace      string  `json:"namespace"`
+	Subscription   string  `json:"subscription,omitempty"`
+	Name           string  `json:"name"` // the producer or consumer name
+	Address        string  `json:"address"`
+	ClientVersion  string  `json:"clientVersion"`
+	ConnectedSince string  `json:"connectedSince"`
+	Role           string  `json:"role,omitempty"` // the appId reported by the broker
+	MsgRate        float64 `json:"msgRate"`        // msgRateIn of a producer, msgRateOut of a consumer
+	MsgThroughput  float64 `json:"msgThroughput"`  // msgThroughputIn of a producer, msgThroughputOut of a consumer
+}
+
+// ConnectionQuery is the search and pagination criteria of client connections.
+// Address, client version and role match any connection containing the text case insensitively.
+type ConnectionQuery struct {
+	Namespace     string // either the namespace name or tenant/namespace
+	Topic         string // the topic fullname
+	Type          string // producer or consumer
+	Address       string
+	ClientVersion string
+	Role          string
+	Offset        int
+	Limit         int // 0 returns all the connections after the offset
+}
+
+// ConnectionList is the paginated list of client connections
+type ConnectionList struct {
+	Total  int                `json:"total"`
+	Offset int                `json:"offset"`
+	Data   []ClientConnection `json:"data"`
+}
+
+// ParseClientConnections flattens the publishers and the consumers of every subscription in a topic stats document
+func ParseClientConnections(ts *TopicStats) []ClientConnection {
+	data, ok := ts.Data.(map[string]interface{})
+	if !ok {
+		return []ClientConnection{}
+	}
+	connection := func(connType, subscription string, v interface{}) (ClientConnection, bool) {
+		client, ok := v.(map[string]interface{})
+		if !ok {
+			return ClientConnection{}, false
+		}
+		c := ClientConnection{Type: connType, Topic: ts.ID, Namespace: ts.Namespace, Subscription: subscription}
+		c.Address, _ = client["address"].(string)
+		c.ClientVersion, _ = client["clientVersion"].(string)
+		c.ConnectedSince, _ = client["connectedSince"].(string)
+		c.Role, _ = client["appId"].(string)
+		if connType == ProducerConnection {
+			c.Name, _ = client["producerName"].(string)
+			c.MsgRate, _ = client["msgRateIn"].(float64)
+			c.MsgThroughput, _ = client["msgThroughputIn"].(float64)
+		} else {
+			c.Name, _ = client["consumerName"].(string)
+			c.MsgRate, _ = client["msgRateOut"].(float64)
+			c.MsgThroughput, _ = client["msgThroughputOut"].(float64)
+		}
+		return c, true
+	}
+
+	result := []ClientConnection{}
+	publishers, _ := data["publishers"].([]interface{})
+	for _, v := range publishers {
+		if c, ok := connection(ProducerConnection, "", v); ok {
+			result = append(result, c)
+		}
+	}
+	subs, _ := data["subscriptions"].(map[string]interface{})
+	for name, v := range subs {
+		sub, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		consumers, _ := sub["consumers"].([]interface{})
+		for _, c := range consumers {
+			if c, ok := connection(ConsumerConnection, name, c); ok {
+				result = append(result, c)
+			}
+		}
+	}
+	return result
+}
+
+// Match evaluates if the connection meets the namespace, topic, type and the search texts
+func (q ConnectionQuery) Match(tenant string, c ClientConnection) bool {
+	if q.Namespace != "" && q.Namespace != c.Namespace && tenant+"/"+q.Namespace != c.Namespace {
+		return false
+	}
+	if q.Topic != "" && q.Topic != c.Topic {
+		return false
+	}
+	if q.Type != "" && !strings.EqualFold(q.Type, c.Type) {
+		return false
+	}
+	contains := func(s, substr string) bool {
+		return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+	}
+	return contains(c.Address, q.Address) && contains(c.ClientVersion, q.ClientVersion) && contains(c.Role, q.Role)
+}
+
+// QueryConnections lists the producers and consumers connected to the tenant's topics in the cache,
+// searched and paginated by the query
+func QueryConnections(tenant string, q ConnectionQuery, now time.Time) (ConnectionList, error) {
+	if q.Offset < 0 || q.Limit < 0 {
+		return ConnectionList{}, fmt.Errorf("offset or limit cannot be negative")
+	}
+	if q.Type != "" && !strings.EqualFold(q.Type, ProducerConnection) && !strings.EqualFold(q.Type, ConsumerConnection) {
+		return ConnectionList{}, fmt.Errorf("unsupported connection type %s", q.Type)
+	}
+
+	topics, err := freshTenantTopics(tenant, now)
+	if err != nil {
+		return ConnectionList{}, err
+	}
+	matched := []ClientConnection{}
+	for _, p := range topics {
+		for _, c := range ParseClientConnections(p) {
+			if q.Match(tenant, c) {
+				matched = append(matched, c)
+			}
+		}
+	}
+
+	sort.SliceStable(matched, func(i, j int) bool {
+		a, b := matched[i], matched[j]
+		if a.Topic != b.Topic {
+			return a.Topic < b.Topic
+		}
+		if a.Type != b.Type {
+			// producers first
+			return a.Type > b.Type
+		}
+		if a.Subscription != b.Subscription {
+			return a.Subscription < b.Subscription
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Address < b.Address
+	})
+
+	total := len(matched)
+	if q.Offset > total {
+		return ConnectionList{Total: total, Offset: total, Data: []ClientConnection{}}, nil
+	}
+	newOffset := q.Offset + q.Limit
+	if q.Limit == 0 || newOffset > total {
+		newOffset = total
+	}
+	return ConnectionList{
+		Total:  total,
+		Offset: newOffset,
+		Data:   matched[q.Offset:newOffset],
+	}, nil
+}
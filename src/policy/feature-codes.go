@@ -23,8 +23,11 @@ package policy
 
 import (
 	"fmt"
+	"io/ioutil"
 	"regexp"
 	"strings"
+
+	"github.com/ghodss/yaml"
 )
 
 // FeatureCode is a struct to define feature code and description
@@ -54,6 +57,42 @@ var KafkaesqueFeatureCodes = []FeatureCode{
 		Description: "tracks cluster usage by hours",
 		Alias:       "cut,clusterUsageTracking",
 	},
+	{
+		Name:        FunctionLogs,
+		Description: "retrieves function logs",
+		Alias:       "functionLogs",
+	},
+	{
+		Name:        PulsarBeam,
+		Description: "manages Pulsar Beam topics and webhooks",
+		Alias:       "pulsarBeam",
+	},
+}
+
+// FeatureCodes is the list of features in effect, it is loaded from the FeatureCodesFile or default to KafkaesqueFeatureCodes
+var FeatureCodes = KafkaesqueFeatureCodes
+
+// LoadFeatureCodes loads a list of feature codes in YAML or JSON from the file and rebuilds the feature code map
+func LoadFeatureCodes(filePath string) error {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	codes := []FeatureCode{}
+	if err = yaml.Unmarshal(data, &codes); err != nil {
+		return err
+	}
+	if len(codes) == 0 {
+		return fmt.Errorf("no feature code is defined in %s", filePath)
+	}
+
+	previous := FeatureCodes
+	FeatureCodes = codes
+	if err = BuildFeatureCodeMap(); err != nil {
+		FeatureCodes = previous
+		return err
+	}
+	return nil
 }
 
 ///// internal implementation
@@ -70,8 +109,8 @@ var FeatureCodeMap map[string]Feature
 
 // BuildFeatureCodeMap builds and verifies a map for feature code
 func BuildFeatureCodeMap() error {
-	FeatureCodeMap = make(map[string]Feature)
-	for _, v := range KafkaesqueFeatureCodes {
+	featureMap := make(map[string]Feature)
+	for _, v := range FeatureCodes {
 		codes := make(map[string]bool)
 		if name, ok := ValidateFeatureCode(v.Name); ok {
 			codes[name] = true
@@ -80,20 +119,36 @@ func BuildFeatureCodeMap() error {
 		}
 		aliases := strings.Split(v.Alias, ",")
 		for _, alias := range aliases {
+			if strings.TrimSpace(alias) == "" {
+				continue
+			}
 			if name, ok := ValidateFeatureCode(strings.TrimSpace(alias)); ok {
 				codes[name] = true
 			} else {
 				return fmt.Errorf("invalid feature code alias %s", name)
 			}
 		}
-		FeatureCodeMap[v.Name] = Feature{
+		featureMap[v.Name] = Feature{
 			PossibleCodes: codes,
 			FeatureCode:   v,
 		}
 	}
+	FeatureCodeMap = featureMap
 	return nil
 }
 
+// matchFeatureCode matches the code against the feature name or any alias of the feature
+func matchFeatureCode(feature, code string) bool {
+	if code == feature {
+		return true
+	}
+	if f, ok := FeatureCodeMap[feature]; ok {
+		name, _ := ValidateFeatureCode(code)
+		return f.PossibleCodes[name]
+	}
+	return false
+}
+
 // ValidateFeatureCode validate feature code conform the code regex naming convention.
 func ValidateFeatureCode(name string) (string, bool) {
 	p := strings.TrimSpace(strings.ToLower(name))
@@ -0,0 +1,89 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package policy
+
+import (
+	"sync"
+	"time"
+)
+
+// FeatureUsage is the number of requests allowed and denied on a feature gated route
+type FeatureUsage struct {
+	Allowed    int64     `json:"allowed"`
+	Denied     int64     `json:"denied"`
+	LastUsedAt time.Time `json:"lastUsedAt"`
+}
+
+// TenantFeature is a feature code with its enabled state and usage under a tenant
+type TenantFeature struct {
+	FeatureCode
+	Enabled bool         `json:"enabled"`
+	Usage   FeatureUsage `json:"usage"`
+}
+
+// feature usage counters by tenant and then by feature name, the counters are kept in memory per burnell instance
+var featureUsage = make(map[string]map[string]FeatureUsage)
+var featureUsageLock = sync.RWMutex{}
+
+// RecordFeatureUsage counts a request to a feature gated route
+func RecordFeatureUsage(tenant, feature string, allowed bool) {
+	featureUsageLock.Lock()
+	defer featureUsageLock.Unlock()
+	features, ok := featureUsage[tenant]
+	if !ok {
+		features = make(map[string]FeatureUsage)
+		featureUsage[tenant] = features
+	}
+	usage := features[feature]
+	if allowed {
+		usage.Allowed++
+	} else {
+		usage.Denied++
+	}
+	usage.LastUsedAt = time.Now()
+	features[feature] = usage
+}
+
+// GetFeatureUsage returns a copy of the feature usage counters of a tenant
+func GetFeatureUsage(tenant string) map[string]FeatureUsage {
+	featureUsageLock.RLock()
+	defer featureUsageLock.RUnlock()
+	usage := make(map[string]FeatureUsage)
+	for k, v := range featureUsage[tenant] {
+		usage[k] = v
+	}
+	return usage
+}
+
+// TenantFeatures lists all the feature codes with whether each is enabled by the tenant plan's feature codes
+func TenantFeatures(tenant, featureCodes string) []TenantFeature {
+	usage := GetFeatureUsage(tenant)
+	features := make([]TenantFeature, 0, len(FeatureCodes))
+	for _, v := range FeatureCodes {
+		features = append(features, TenantFeature{
+			FeatureCode: v,
+			Enabled:     IsFeatureSupported(v.Name, featureCodes),
+			Usage:       usage[v.Name],
+		})
+	}
+	return features
+}
@@ -0,0 +1,311 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/datastax/burnell/src/util"
+)
+
+// IdleTopic is a topic without producers, consumers and inbound messages over the report period.
+// A partitioned topic is reported as a whole when all of its partitions are idle.
+type IdleTopic struct {
+	Topic       string    `json:"topic"`
+	Namespace   string    `json:"namespace"`
+	Partitions  int       `json:"partitions"` // 0 for a non-partitioned topic
+	IdleSince   time.Time `json:"idleSince"`
+	StorageSize float64   `json:"storageSize"`
+	MsgBacklog  float64   `json:"msgBacklog"`
+}
+
+// IdleReport is the idle topics and the orphaned subscriptions of a tenant
+type IdleReport struct {
+	Tenant        string              `json:"tenant"`
+	Period        int                 `json:"periodSeconds"`
+	GeneratedAt   time.Time           `json:"generatedAt"`
+	Topics        []IdleTopic         `json:"topics"`
+	Subscriptions []SubscriptionStats `json:"subscriptions"` // growing backlog without consumers
+}
+
+// SubscriptionRef identifies a subscription of a topic
+type SubscriptionRef struct {
+	Topic        string `json:"topic"`
+	Subscription string `json:"subscription"`
+}
+
+// IdleCleanupRequest is the topics to delete and the subscriptions to unsubscribe,
+// an empty request applies to everything in the idle report
+type IdleCleanupRequest struct {
+	Topics        []string          `json:"topics"`
+	Subscriptions []SubscriptionRef `json:"subscriptions"`
+}
+
+// IdleCleanupAction is the outcome of deleting a topic or unsubscribing a subscription
+type IdleCleanupAction struct {
+	Action       string `json:"action"` // delete or unsubscribe
+	Topic        string `json:"topic"`
+	Subscription string `json:"subscription,omitempty"`
+	Status       string `json:"status"` // planned, done, skipped or failed
+	Reason       string `json:"reason,omitempty"`
+}
+
+// IdleCleanupResult is the list of cleanup actions
+type IdleCleanupResult struct {
+	Tenant  string              `json:"tenant"`
+	DryRun  bool                `json:"dryRun"`
+	Actions []IdleCleanupAction `json:"actions"`
+}
+
+// DefaultIdlePeriod is the default period without activity for a topic to be reported idle
+var DefaultIdlePeriod = time.Duration(util.GetEnvInt("IdleTopicPeriodHour", 6)) * time.Hour
+
+// idleSince returns the start of the trailing samples of the series without producers, consumers and inbound messages.
+// It returns false if the series does not exist or the latest sample is active.
+func (s *StatsHistoryStore) idleSince(tenant, key string) (time.Time, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	series, ok := s.series[key]
+	if !ok || series.tenant != tenant {
+		return time.Time{}, false
+	}
+	since := int64(-1)
+	for i := len(series.buckets) - 1; i >= 0; i-- {
+		b := series.buckets[i]
+		if b.sum.ProducerCount > 0 || b.sum.ConsumerCount > 0 || b.sum.MsgRateIn > 0 {
+			break
+		}
+		since = b.start
+	}
+	if since < 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(since, 0).UTC(), true
+}
+
+// IdleTopicsReport reports the tenant's topics that have had no producers, consumers and inbound messages
+// over the period according to the topic stats history, and the subscriptions with a growing backlog
+// but no consumers according to the subscription trends
+func IdleTopicsReport(tenant string, period time.Duration, now time.Time) (IdleReport, error) {
+	if period <= 0 {
+		return IdleReport{}, fmt.Errorf("period must be positive")
+	}
+	if TopicStatsHistory.maxSeries <= 0 {
+		return IdleReport{}, fmt.Errorf("topic stats history is disabled")
+	}
+	if period > TopicStatsHistory.retention {
+		return IdleReport{}, fmt.Errorf("period %s exceeds the topic stats history retention %s", period, TopicStatsHistory.retention)
+	}
+
+	fresh, err := freshTenantTopics(tenant, now)
+	if err != nil {
+		return IdleReport{}, err
+	}
+
+	// the partitions are grouped under their partitioned topic, a topic is idle only if every partition is idle
+	topics := make(map[string]*IdleTopic)
+	active := make(map[string]bool)
+	for _, p := range fresh {
+		name, isPartition := IsPartitionTopic(p.ID)
+		if !isPartition {
+			name = p.ID
+		}
+		if active[name] {
+			continue
+		}
+		since, idle := TopicStatsHistory.idleSince(tenant, p.ID)
+		if !idle || now.Sub(since) < period {
+			active[name] = true
+			delete(topics, name)
+			continue
+		}
+		topic, ok := topics[name]
+		if !ok {
+			topic = &IdleTopic{Topic: name, Namespace: p.Namespace, IdleSince: since}
+			topics[name] = topic
+		}
+		if isPartition {
+			topic.Partitions++
+		}
+		if since.After(topic.IdleSince) {
+			topic.IdleSince = since
+		}
+		topic.StorageSize += p.Fields.StorageSize
+		topic.MsgBacklog += p.Fields.MsgBacklog
+	}
+
+	report := IdleReport{
+		Tenant:        tenant,
+		Period:        int(period.Seconds()),
+		GeneratedAt:   now,
+		Topics:        []IdleTopic{},
+		Subscriptions: []SubscriptionStats{},
+	}
+	for _, v := range topics {
+		report.Topics = append(report.Topics, *v)
+	}
+	sort.Slice(report.Topics, func(i, j int) bool { return report.Topics[i].Topic < report.Topics[j].Topic })
+
+	subs, err := freshSubscriptions(tenant, now)
+	if err != nil {
+		return IdleReport{}, err
+	}
+	for _, s := range subs {
+		if s = s.withTrend(); s.ConsumerCount == 0 && s.Trend.Direction == "growing" {
+			report.Subscriptions = append(report.Subscriptions, s)
+		}
+	}
+	sort.SliceStable(report.Subscriptions, func(i, j int) bool {
+		a, b := report.Subscriptions[i], report.Subscriptions[j]
+		if a.Topic != b.Topic {
+			return a.Topic < b.Topic
+		}
+		return a.Subscription < b.Subscription
+	})
+	return report, nil
+}
+
+// CleanupIdleTopics deletes the requested topics and unsubscribes the requested subscriptions
+// that are still in the idle report. The dry run returns the planned actions without changing Pulsar.
+func CleanupIdleTopics(tenant string, req IdleCleanupRequest, period time.Duration, dryRun bool, now time.Time) (IdleCleanupResult, error) {
+	report, err := IdleTopicsReport(tenant, period, now)
+	if err != nil {
+		return IdleCleanupResult{}, err
+	}
+	idleTopics := make(map[string]IdleTopic)
+	for _, v := range report.Topics {
+		idleTopics[v.Topic] = v
+	}
+	orphans := make(map[SubscriptionRef]bool)
+	for _, v := range report.Subscriptions {
+		orphans[SubscriptionRef{Topic: v.Topic, Subscription: v.Subscription}] = true
+	}
+	if len(req.Topics) == 0 && len(req.Subscriptions) == 0 {
+		for _, v := range report.Topics {
+			req.Topics = append(req.Topics, v.Topic)
+		}
+		for _, v := range report.Subscriptions {
+			req.Subscriptions = append(req.Subscriptions, SubscriptionRef{Topic: v.Topic, Subscription: v.Subscription})
+		}
+	}
+
+	result := IdleCleanupResult{Tenant: tenant, DryRun: dryRun, Actions: []IdleCleanupAction{}}
+	apply := func(action IdleCleanupAction, skipReason string, path string) {
+		switch {
+		case skipReason != "":
+			action.Status, action.Reason = "skipped", skipReason
+		case dryRun:
+			action.Status = "planned"
+		default:
+			if err := pulsarAdminDelete(path); err != nil {
+				action.Status, action.Reason = "failed", err.Error()
+			} else {
+				action.Status = "done"
+			}
+		}
+		result.Actions = append(result.Actions, action)
+	}
+	for _, name := range req.Topics {
+		topic, ok := idleTopics[name]
+		path := adminTopicPath(name)
+		skipReason := ""
+		if !ok {
+			skipReason = "not in the idle report"
+		} else if topic.Partitions > 0 {
+			path += "/partitions"
+			skipReason = checkIdlePartitions(topic)
+		}
+		apply(IdleCleanupAction{Action: "delete", Topic: name}, skipReason, path)
+	}
+	for _, v := range req.Subscriptions {
+		path := adminTopicPath(v.Topic) + "/subscription/" + url.PathEscape(v.Subscription)
+		skipReason := util.ConditionAssign(orphans[v], "", "not in the idle report")
+		apply(IdleCleanupAction{Action: "unsubscribe", Topic: v.Topic, Subscription: v.Subscription}, skipReason, path)
+	}
+	return result, nil
+}
+
+// checkIdlePartitions returns the reason to skip deleting a partitioned topic unless every partition
+// in the partitioned metadata is cached and idle, since a partition missing in the cache may still be active
+func checkIdlePartitions(topic IdleTopic) string {
+	body, err := pulsarAdminRequest(http.MethodGet, adminTopicPath(topic.Topic)+"/partitions")
+	if err != nil {
+		return "partitioned metadata " + err.Error()
+	}
+	var metadata struct {
+		Partitions int `json:"partitions"`
+	}
+	if err = json.Unmarshal(body, &metadata); err != nil {
+		return "partitioned metadata " + err.Error()
+	}
+	if topic.Partitions != metadata.Partitions {
+		return fmt.Sprintf("%d of %d partitions are idle", topic.Partitions, metadata.Partitions)
+	}
+	return ""
+}
+
+// adminTopicPath returns the admin REST path of a topic full name
+func adminTopicPath(topicFn string) string {
+	topicType := util.ConditionAssign(util.IsPersistentTopic(topicFn), "persistent/", "non-persistent/")
+	tenant, ns, topic, _ := util.ExtractPartsFromTopicFn(topicFn)
+	return "admin/v2/" + topicType + tenant + "/" + ns + "/" + topic
+}
+
+// pulsarAdminDelete sends a DELETE request to the broker admin REST endpoint
+func pulsarAdminDelete(path string) error {
+	_, err := pulsarAdminRequest(http.MethodDelete, path)
+	return err
+}
+
+// pulsarAdminRequest sends a request without body to the broker admin REST endpoint and returns the response body
+func pulsarAdminRequest(method, path string) ([]byte, error) {
+	requestURL := util.SingleJoinSlash(util.Config.BrokerProxyURL, path)
+	client := *http.DefaultClient
+	// keep authorization header for the redirect
+	client.CheckRedirect = util.PreserveHeaderForRedirect
+
+	newRequest, err := http.NewRequest(method, requestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	newRequest.Header.Add("Authorization", "Bearer "+util.Config.PulsarToken)
+	response, err := client.Do(newRequest)
+	if response != nil {
+		defer response.Body.Close()
+	}
+	if err != nil {
+		statsLog.Errorf("%s %s error %v", method, requestURL, err)
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(response.Body)
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		statsLog.Errorf("%s %s response status code %d %s", method, requestURL, response.StatusCode, string(body))
+		return nil, fmt.Errorf("%s %s response status code %d", method, path, response.StatusCode)
+	}
+	return body, err
+}
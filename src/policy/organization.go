@@ -0,0 +1,434 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/apex/log"
+	"github.com/datastax/burnell/src/util"
+)
+
+// OrgRole is the role of a user in an organization
+type OrgRole string
+
+const (
+	// OwnerRole manages the organization membership and all the tenants owned by the organization
+	OwnerRole OrgRole = "owner"
+	// AdminRole manages all the tenants owned by the organization
+	AdminRole OrgRole = "admin"
+	// ViewerRole has read only access to all the tenants owned by the organization
+	ViewerRole OrgRole = "viewer"
+)
+
+var orgRoleRanks = map[OrgRole]int{
+	ViewerRole: 1,
+	AdminRole:  2,
+	OwnerRole:  3,
+}
+
+// ErrOrgNotFound is returned when the organization does not exist
+var ErrOrgNotFound = errors.New("organization not found")
+
+// Permits returns true if the role has at least the permission of the required role
+func (r OrgRole) Permits(required OrgRole) bool {
+	return orgRoleRanks[r] > 0 && orgRoleRanks[r] >= orgRoleRanks[required]
+}
+
+// ParseOrgRole parses the role name
+func ParseOrgRole(role string) (OrgRole, error) {
+	r := OrgRole(strings.TrimSpace(strings.ToLower(role)))
+	if _, ok := orgRoleRanks[r]; !ok {
+		return "", fmt.Errorf("invalid organization role %s, it must be one of owner, admin and viewer", role)
+	}
+	return r, nil
+}
+
+// OrgMember is a user in an organization, the user is identified by the token subject
+type OrgMember struct {
+	User    string    `json:"user"`
+	Role    OrgRole   `json:"role"`
+	AddedAt time.Time `json:"addedAt"`
+}
+
+// Organization owns the tenants whose plan has the organization name in the org attribute
+type Organization struct {
+	Name      string      `json:"name"`
+	Members   []OrgMember `json:"members"`
+	Tenants   []string    `json:"tenants,omitempty"` // derived from the tenant plans and not stored
+	UpdatedAt time.Time   `json:"updatedAt"`
+}
+
+// GetMember returns the member by the user
+func (o Organization) GetMember(user string) (OrgMember, bool) {
+	for _, v := range o.Members {
+		if v.User == user {
+			return v, true
+		}
+	}
+	return OrgMember{}, false
+}
+
+// SetMember adds the user to or changes the user's role in the organization.
+// The last owner cannot be demoted.
+func (o Organization) SetMember(user string, role OrgRole) (Organization, error) {
+	if user == "" {
+		return Organization{}, fmt.Errorf("user is required")
+	}
+	if _, ok := orgRoleRanks[role]; !ok {
+		return Organization{}, fmt.Errorf("invalid organization role %s", role)
+	}
+
+	members := make([]OrgMember, 0, len(o.Members)+1)
+	found := false
+	for _, v := range o.Members {
+		if v.User == user {
+			if v.Role == OwnerRole && role != OwnerRole && o.numOfOwners() == 1 {
+				return Organization{}, fmt.Errorf("user %s is the last owner of organization %s", user, o.Name)
+			}
+			v.Role = role
+			found = true
+		}
+		members = append(members, v)
+	}
+	if !found {
+		members = append(members, OrgMember{User: user, Role: role, AddedAt: time.Now()})
+	}
+	o.Members = members
+	return o, nil
+}
+
+// RemoveMember removes the user from the organization. The last owner cannot be removed.
+func (o Organization) RemoveMember(user string) (Organization, error) {
+	member, ok := o.GetMember(user)
+	if !ok {
+		return Organization{}, fmt.Errorf("user %s is not a member of organization %s", user, o.Name)
+	}
+	if member.Role == OwnerRole && o.numOfOwners() == 1 {
+		return Organization{}, fmt.Errorf("user %s is the last owner of organization %s", user, o.Name)
+	}
+
+	members := make([]OrgMember, 0, len(o.Members))
+	for _, v := range o.Members {
+		if v.User != user {
+			members = append(members, v)
+		}
+	}
+	o.Members = members
+	return o, nil
+}
+
+func (o Organization) numOfOwners() int {
+	owners := 0
+	for _, v := range o.Members {
+		if v.Role == OwnerRole {
+			owners++
+		}
+	}
+	return owners
+}
+
+// ValidateOrganization validates the organization has a name, valid roles and at least one owner
+func ValidateOrganization(o Organization) error {
+	if o.Name == "" {
+		return fmt.Errorf("organization name is required")
+	}
+	users := make(map[string]bool)
+	for _, v := range o.Members {
+		if v.User == "" {
+			return fmt.Errorf("user is required for every member")
+		}
+		if users[v.User] {
+			return fmt.Errorf("user %s is listed more than once", v.User)
+		}
+		users[v.User] = true
+		if _, err := ParseOrgRole(string(v.Role)); err != nil {
+			return err
+		}
+	}
+	if o.numOfOwners() == 0 {
+		return fmt.Errorf("organization %s requires at least one owner", o.Name)
+	}
+	return nil
+}
+
+// OrganizationHandler manages organizations stored in a Pulsar topic, a record per change keyed by the organization name.
+// A deleted organization is a record with an empty payload so that it is removed by topic compaction.
+type OrganizationHandler struct {
+	client     pulsar.Client
+	topicName  string
+	orgs       map[string]Organization
+	orgsLock   sync.RWMutex
+	updateLock sync.Mutex
+	logger     *log.Entry
+}
+
+// OrgManager is the global object to manage organizations
+var OrgManager OrganizationHandler
+
+// Setup sets up the organization database
+func (o *OrganizationHandler) Setup() error {
+	o.logger = log.WithFields(log.Fields{"app": "orgdb"})
+	o.orgs = make(map[string]Organization)
+	o.topicName = util.AssignString(util.GetConfig().OrgManagementTopic, "persistent://public/default/orgs-management")
+
+	var err error
+	o.client, err = NewPulsarClient(util.GetConfig().PulsarURL, util.GetConfig().PulsarToken, util.GetConfig().TrustStore)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		sig := make(chan *liveSignal)
+		go o.dbListener(sig)
+		for {
+			select {
+			case <-sig:
+				time.Sleep(time.Second)
+				go o.dbListener(sig)
+			}
+		}
+	}()
+	return nil
+}
+
+// dbListener listens organization updates
+func (o *OrganizationHandler) dbListener(sig chan *liveSignal) error {
+	defer func(termination chan *liveSignal) {
+		o.logger.Errorf("organization db listener terminated")
+		termination <- &liveSignal{}
+	}(sig)
+	reader, err := o.client.CreateReader(pulsar.ReaderOptions{
+		Topic:          o.topicName,
+		StartMessageID: pulsar.EarliestMessageID(),
+		ReadCompacted:  util.IsPersistentTopic(o.topicName),
+	})
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	ctx := context.Background()
+	for {
+		data, err := reader.Next(ctx)
+		if err != nil {
+			o.logger.Errorf("organization db listener reader error %v", err)
+			return err
+		}
+		if len(data.Payload()) == 0 {
+			o.orgsLock.Lock()
+			delete(o.orgs, data.Key())
+			o.orgsLock.Unlock()
+			continue
+		}
+		org := Organization{}
+		if err = json.Unmarshal(data.Payload(), &org); err != nil {
+			o.logger.Errorf("organization unmarshal error %v", err)
+			continue
+		}
+		o.orgsLock.Lock()
+		o.orgs[org.Name] = org
+		o.orgsLock.Unlock()
+	}
+}
+
+// send writes the organization record, a nil payload deletes the organization
+func (o *OrganizationHandler) send(orgName string, payload []byte) error {
+	producer, err := o.client.CreateProducer(pulsar.ProducerOptions{
+		Topic:           o.topicName,
+		DisableBatching: true,
+	})
+	if err != nil {
+		return err
+	}
+	defer producer.Close()
+
+	if _, err = producer.Send(context.Background(), &pulsar.ProducerMessage{
+		Payload: payload,
+		Key:     orgName,
+	}); err != nil {
+		return err
+	}
+	producer.Flush()
+	return nil
+}
+
+func (o *OrganizationHandler) updateDb(org Organization) (Organization, error) {
+	org.Tenants = nil
+	org.UpdatedAt = time.Now()
+	data, err := json.Marshal(org)
+	if err != nil {
+		return Organization{}, err
+	}
+	if err = o.send(org.Name, data); err != nil {
+		return Organization{}, err
+	}
+
+	o.orgsLock.Lock()
+	o.orgs[org.Name] = org
+	o.orgsLock.Unlock()
+	return org, nil
+}
+
+// GetOrg gets an organization by the name
+func (o *OrganizationHandler) GetOrg(orgName string) (Organization, error) {
+	o.orgsLock.RLock()
+	defer o.orgsLock.RUnlock()
+	if org, ok := o.orgs[orgName]; ok {
+		return org, nil
+	}
+	return Organization{}, ErrOrgNotFound
+}
+
+// ListOrgs returns all the organizations
+func (o *OrganizationHandler) ListOrgs() []Organization {
+	o.orgsLock.RLock()
+	defer o.orgsLock.RUnlock()
+	orgs := make([]Organization, 0, len(o.orgs))
+	for _, v := range o.orgs {
+		orgs = append(orgs, v)
+	}
+	return orgs
+}
+
+// CreateOrg creates an organization, it is rejected with a conflict if the organization exists
+func (o *OrganizationHandler) CreateOrg(org Organization) (Organization, int, error) {
+	o.updateLock.Lock()
+	defer o.updateLock.Unlock()
+	if _, err := o.GetOrg(org.Name); err == nil {
+		return Organization{}, http.StatusConflict, fmt.Errorf("organization %s already exists", org.Name)
+	}
+	now := time.Now()
+	for i := range org.Members {
+		org.Members[i].Role = OrgRole(strings.ToLower(string(org.Members[i].Role)))
+		if org.Members[i].AddedAt.IsZero() {
+			org.Members[i].AddedAt = now
+		}
+	}
+	if err := ValidateOrganization(org); err != nil {
+		return Organization{}, http.StatusUnprocessableEntity, err
+	}
+	created, err := o.updateDb(org)
+	if err != nil {
+		return Organization{}, http.StatusInternalServerError, err
+	}
+	return created, http.StatusOK, nil
+}
+
+// DeleteOrg deletes an organization, the tenants owned by the organization are not changed
+func (o *OrganizationHandler) DeleteOrg(orgName string) (Organization, error) {
+	o.updateLock.Lock()
+	defer o.updateLock.Unlock()
+	org, err := o.GetOrg(orgName)
+	if err != nil {
+		return Organization{}, err
+	}
+	if err = o.send(orgName, nil); err != nil {
+		return Organization{}, err
+	}
+
+	o.orgsLock.Lock()
+	delete(o.orgs, orgName)
+	o.orgsLock.Unlock()
+	return org, nil
+}
+
+// SetMember adds a user to or changes the user's role in an organization
+func (o *OrganizationHandler) SetMember(orgName, user string, role OrgRole) (Organization, int, error) {
+	return o.updateMembers(orgName, func(org Organization) (Organization, error) {
+		return org.SetMember(user, role)
+	})
+}
+
+// RemoveMember removes a user from an organization
+func (o *OrganizationHandler) RemoveMember(orgName, user string) (Organization, int, error) {
+	return o.updateMembers(orgName, func(org Organization) (Organization, error) {
+		return org.RemoveMember(user)
+	})
+}
+
+func (o *OrganizationHandler) updateMembers(orgName string, update func(Organization) (Organization, error)) (Organization, int, error) {
+	o.updateLock.Lock()
+	defer o.updateLock.Unlock()
+	org, err := o.GetOrg(orgName)
+	if err != nil {
+		return Organization{}, http.StatusNotFound, err
+	}
+	if org, err = update(org); err != nil {
+		return Organization{}, http.StatusUnprocessableEntity, err
+	}
+	if org, err = o.updateDb(org); err != nil {
+		return Organization{}, http.StatusInternalServerError, err
+	}
+	return org, http.StatusOK, nil
+}
+
+// HasOrgRole returns true if the user has at least the required role in the organization
+func (o *OrganizationHandler) HasOrgRole(orgName, user string, role OrgRole) bool {
+	org, err := o.GetOrg(orgName)
+	if err != nil {
+		return false
+	}
+	member, ok := org.GetMember(user)
+	return ok && member.Role.Permits(role)
+}
+
+// HasTenantRole returns true if the user has at least the required role in the organization owning the tenant
+func (o *OrganizationHandler) HasTenantRole(tenant, user string, role OrgRole) bool {
+	plan, err := TenantManager.GetTenant(tenant)
+	if err != nil || plan.Org == "" {
+		return false
+	}
+	return o.HasOrgRole(plan.Org, user, role)
+}
+
+// OrgTenants returns the names of the tenants owned by the organization
+func OrgTenants(orgName string, tenants []TenantPlan) []string {
+	names := []string{}
+	for _, v := range tenants {
+		if v.Org == orgName {
+			names = append(names, v.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// MemberTenants returns the names of the tenants owned by the organizations where the user has at least the required role
+func MemberTenants(user string, role OrgRole, orgs []Organization, tenants []TenantPlan) []string {
+	names := []string{}
+	for _, org := range orgs {
+		if member, ok := org.GetMember(user); ok && member.Role.Permits(role) {
+			names = append(names, OrgTenants(org.Name, tenants)...)
+		}
+	}
+	return names
+}
@@ -0,0 +1,199 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package policy
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/datastax/burnell/src/util"
+)
+
+// PartitionedTopicStats is the partitioned topic with the stats of its partitions rolled up
+type PartitionedTopicStats struct {
+	ID         string           `json:"id"` // the partitioned topic fullname
+	Tenant     string           `json:"tenant"`
+	Namespace  string           `json:"namespace"`
+	Topic      string           `json:"topic"`
+	Partitions []string         `json:"partitions"` // the cached partition topic fullnames
+	Fields     TopicStatsFields `json:"fields"`     // the sum of the partitions' numeric fields
+	Aggregated interface{}      `json:"aggregated"` // the partitioned-stats from Pulsar if it has been refreshed
+	UpdatedAt  time.Time        `json:"updatedAt"`
+}
+
+// the partitioned topics seen by the broker polls, key is the partitioned topic fullname, value is the last seen time
+var (
+	partitionedTopics     = make(map[string]time.Time)
+	partitionedTopicsLock = sync.RWMutex{}
+)
+
+// the interval to refresh the aggregated partitioned-stats of the tracked partitioned topics
+var partitionedStatsInterval = time.Duration(util.GetEnvInt("PartitionedStatsPullIntervalSecond", 30)) * time.Second
+
+// TrackPartitionedTopics records the partitioned topics seen by a poll and forgets the ones not seen within 90 seconds
+func TrackPartitionedTopics(names map[string]bool, now time.Time) {
+	partitionedTopicsLock.Lock()
+	defer partitionedTopicsLock.Unlock()
+	for k := range names {
+		partitionedTopics[k] = now
+	}
+	for k, v := range partitionedTopics {
+		if now.Sub(v) > 90*time.Second {
+			delete(partitionedTopics, k)
+		}
+	}
+}
+
+// PartitionedTopics returns the tracked partitioned topic fullnames in sorted order
+func PartitionedTopics() []string {
+	partitionedTopicsLock.RLock()
+	defer partitionedTopicsLock.RUnlock()
+	names := make([]string, 0, len(partitionedTopics))
+	for k := range partitionedTopics {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// partitionedTopicStats builds the cache entry of the aggregated partitioned-stats filed under the real namespace
+func partitionedTopicStats(name string, data interface{}, now time.Time) (TopicStats, error) {
+	tenant, ns, topic, err := util.ExtractPartsFromTopicFn(name)
+	if err != nil {
+		return TopicStats{}, err
+	}
+	return TopicStats{
+		ID:        util.PartitionPrefix + name,
+		Tenant:    tenant,
+		Namespace: tenant + "/" + ns,
+		Topic:     topic,
+		UpdatedAt: now,
+		Data:      data,
+	}, nil
+}
+
+// refreshPartitionedStats refreshes the aggregated partitioned-stats of all the tracked partitioned topics
+func refreshPartitionedStats() {
+	names := PartitionedTopics()
+	topics := []TopicStats{}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	concurrency := statsPollConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+	for _, name := range names {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(name string) {
+			defer func() { <-sem; wg.Done() }()
+			data, err := getSingleTopicStats(name, true)
+			if err != nil {
+				return
+			}
+			topicInfo, err := partitionedTopicStats(name, data, time.Now())
+			if err != nil {
+				statsLog.Errorf("invalid partitioned topic name %s %v", name, err)
+				return
+			}
+			lock.Lock()
+			topics = append(topics, topicInfo)
+			lock.Unlock()
+		}(name)
+	}
+	wg.Wait()
+
+	if err := UpsertTopicStatsBatch(topics); err != nil {
+		statsLog.Errorf("failed to cache partitioned topic stats %v", err)
+	}
+}
+
+// partitionedStatsWorker refreshes the aggregated partitioned-stats on its own schedule
+func partitionedStatsWorker() {
+	ticker := time.NewTicker(partitionedStatsInterval)
+	for {
+		select {
+		case <-ticker.C:
+			refreshPartitionedStats()
+		}
+	}
+}
+
+// RollupPartitionedTopics rolls the fresh partition stats of the tenant up into their partitioned topics
+func RollupPartitionedTopics(tenant string) []PartitionedTopicStats {
+	now := time.Now()
+	rollups := make(map[string]*PartitionedTopicStats)
+	aggregates := make(map[string]*TopicStats)
+
+	txn := topicStatsDB.Txn(false)
+	defer txn.Abort()
+	result, err := txn.Get(topicStatsDBTable, "tenant", tenant)
+	if err != nil {
+		statsLog.Errorf("failed to read tenant %s topic stats %v", tenant, err)
+		return []PartitionedTopicStats{}
+	}
+	for i := result.Next(); i != nil; i = result.Next() {
+		p, ok := i.(*TopicStats)
+		if !ok || now.Sub(p.UpdatedAt) >= 90*time.Second {
+			continue
+		}
+		if strings.HasPrefix(p.ID, util.PartitionPrefix) {
+			aggregates[strings.TrimPrefix(p.ID, util.PartitionPrefix)] = p
+			continue
+		}
+		name, isPartition := IsPartitionTopic(p.ID)
+		if !isPartition {
+			continue
+		}
+		rollup, ok := rollups[name]
+		if !ok {
+			rollup = &PartitionedTopicStats{
+				ID:         name,
+				Tenant:     tenant,
+				Namespace:  p.Namespace,
+				Topic:      topicShortName(name),
+				Partitions: []string{},
+			}
+			rollups[name] = rollup
+		}
+		rollup.Partitions = append(rollup.Partitions, p.ID)
+		rollup.Fields = rollup.Fields.add(p.Fields)
+		if p.UpdatedAt.After(rollup.UpdatedAt) {
+			rollup.UpdatedAt = p.UpdatedAt
+		}
+	}
+
+	topics := make([]PartitionedTopicStats, 0, len(rollups))
+	for name, v := range rollups {
+		v.Fields = v.Fields.weightedMsgSize()
+		if aggregate, ok := aggregates[name]; ok {
+			v.Aggregated = aggregate.Data
+		}
+		sort.Strings(v.Partitions)
+		topics = append(topics, *v)
+	}
+	sort.Slice(topics, func(i, j int) bool { return topics[i].ID < topics[j].ID })
+	return topics
+}
@@ -0,0 +1,201 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package policy
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/datastax/burnell/src/util"
+)
+
+// ScheduledPlan is a plan change to take effect at a later time
+type ScheduledPlan struct {
+	PlanType string `json:"planType"`
+	// the policy defaults to the plan type's policy if not specified
+	Policy PlanPolicy `json:"policy"`
+	// zero effective time means the change takes effect when the current plan expires
+	EffectiveAt time.Time `json:"effectiveAt"`
+}
+
+// PlanSchedulerActor is the actor recorded in the history for the plan changes applied by the scheduler
+const PlanSchedulerActor = "plan-scheduler"
+
+// the interval to apply the scheduled plan changes
+var planSchedulerInterval = time.Duration(util.GetEnvInt("PlanSchedulerIntervalSecond", 60)) * time.Second
+
+// reconcilePlanSchedule keeps the existing expiry and the next plan unless they are specified in the request.
+// A zero expiry or a next plan without plan type cancels the existing schedule.
+func reconcilePlanSchedule(reqPlan, existingPlan TenantPlan) (TenantPlan, error) {
+	if reqPlan.ExpiresAt == nil {
+		reqPlan.ExpiresAt = existingPlan.ExpiresAt
+	} else if reqPlan.ExpiresAt.IsZero() {
+		reqPlan.ExpiresAt = nil
+	}
+
+	if reqPlan.NextPlan == nil {
+		reqPlan.NextPlan = existingPlan.NextPlan
+	} else if reqPlan.NextPlan.PlanType == "" {
+		reqPlan.NextPlan = nil
+	} else if getPlanPolicy(strings.ToLower(reqPlan.NextPlan.PlanType)) == nil {
+		return TenantPlan{}, fmt.Errorf("invalid scheduled plan type %s", reqPlan.NextPlan.PlanType)
+	}
+
+	if reqPlan.NextPlan != nil && reqPlan.NextPlan.EffectiveAt.IsZero() && reqPlan.ExpiresAt == nil {
+		return TenantPlan{}, fmt.Errorf("the scheduled plan requires either an effective time or the plan expiry")
+	}
+	return reqPlan, nil
+}
+
+// DueScheduledChange returns the plan change request if the plan has expired or the next plan is in effect.
+// An expired plan without a due next plan is downgraded to the free plan.
+func DueScheduledChange(plan TenantPlan, now time.Time) (TenantPlan, bool) {
+	expired := plan.ExpiresAt != nil && !plan.ExpiresAt.After(now)
+	nextPlanDue := plan.NextPlan != nil && !plan.NextPlan.EffectiveAt.After(now) &&
+		(expired || !plan.NextPlan.EffectiveAt.IsZero())
+	if !expired && !nextPlanDue {
+		return TenantPlan{}, false
+	}
+
+	next := ScheduledPlan{PlanType: FreeTier}
+	reason := fmt.Sprintf("%s plan expired, downgrade to %s plan", plan.PlanType, FreeTier)
+	if nextPlanDue {
+		next = *plan.NextPlan
+		reason = fmt.Sprintf("scheduled change from %s plan to %s plan", plan.PlanType, next.PlanType)
+	}
+	next.PlanType = strings.ToLower(next.PlanType)
+	if next.Policy == (PlanPolicy{}) {
+		next.Policy = *getPlanPolicy(next.PlanType)
+	}
+
+	reqPlan := TenantPlan{
+		Name:         plan.Name,
+		TenantStatus: plan.TenantStatus,
+		PlanType:     next.PlanType,
+		Policy:       next.Policy,
+		Audit:        reason,
+		// clear the expiry since the plan is changed
+		ExpiresAt: &time.Time{},
+	}
+	if nextPlanDue {
+		reqPlan.NextPlan = &ScheduledPlan{}
+	}
+	return reqPlan, true
+}
+
+// IsDowngrade evaluates if any limit of the new policy is lower than the current policy, -1 is unlimited
+func IsDowngrade(current, next PlanPolicy) bool {
+	lower := func(a, b int) bool {
+		return a >= 0 && (b < 0 || a < b)
+	}
+	return lower(next.NumOfTopics, current.NumOfTopics) ||
+		lower(next.NumOfNamespaces, current.NumOfNamespaces) ||
+		lower(next.NumOfProducers, current.NumOfProducers) ||
+		lower(next.NumOfConsumers, current.NumOfConsumers) ||
+		lower(next.Functions, current.Functions) ||
+		lower(next.MessageHourRetention, current.MessageHourRetention) ||
+		(IsFeatureSupported(InfiniteMessageRetention, current.FeatureCodes) && !IsFeatureSupported(InfiniteMessageRetention, next.FeatureCodes))
+}
+
+// OverLimitNamespaces returns the namespaces violating the plan policy, either over the number of namespaces
+// in the alphabetical order or with a longer retention than the plan allows.
+func OverLimitNamespaces(retentions map[string]NamespaceRetention, policy PlanPolicy) []string {
+	namespaces := make([]string, 0, len(retentions))
+	for k := range retentions {
+		namespaces = append(namespaces, k)
+	}
+	sort.Strings(namespaces)
+
+	overLimit := []string{}
+	for i, ns := range namespaces {
+		if (policy.NumOfNamespaces >= 0 && i >= policy.NumOfNamespaces) || !retentions[ns].WithinPlan(policy) {
+			overLimit = append(overLimit, ns)
+		}
+	}
+	return overLimit
+}
+
+// getNamespaceRetentions gets the retention policy of every namespace under the tenant
+func getNamespaceRetentions(tenant string) (map[string]NamespaceRetention, error) {
+	namespaces, err := AdminAPIGETRespStringArray("namespaces/" + tenant)
+	if err != nil {
+		return nil, err
+	}
+	retentions := make(map[string]NamespaceRetention)
+	for _, ns := range namespaces {
+		retention := NamespaceRetention{}
+		if err := AdminAPIGETRespJSON("namespaces/"+ns+"/retention", &retention); err != nil {
+			return nil, err
+		}
+		retentions[ns] = retention
+	}
+	return retentions, nil
+}
+
+// ApplyScheduledChanges applies all the due plan changes through UpdateTenant with the plan scheduler as the actor.
+// Every change is conditional on the plan version the change is derived from, and every tenant store rejects
+// a stale version with ErrVersionConflict, so that when multiple burnell instances run the scheduler only one
+// of the identical changes is applied.
+func (s *TenantPolicyHandler) ApplyScheduledChanges(now time.Time) int {
+	applied := 0
+	for _, plan := range s.ListTenants() {
+		reqPlan, ok := DueScheduledChange(plan, now)
+		if !ok {
+			continue
+		}
+
+		// flag the namespaces over the limits of the downgraded plan
+		if IsDowngrade(plan.Policy, reqPlan.Policy) {
+			if retentions, err := getNamespaceRetentions(plan.Name); err != nil {
+				s.logger.Errorf("failed to evaluate tenant %s namespaces for the downgrade %v", plan.Name, err)
+			} else {
+				reqPlan.OverLimitNamespaces = OverLimitNamespaces(retentions, reqPlan.Policy)
+			}
+			if len(reqPlan.OverLimitNamespaces) > 0 {
+				s.logger.Warnf("tenant %s namespaces %v are over the %s plan limit", plan.Name, reqPlan.OverLimitNamespaces, reqPlan.PlanType)
+			}
+		}
+
+		if _, _, err := s.UpdateTenant(plan.Name, reqPlan, PlanSchedulerActor, plan.Version); err != nil {
+			s.logger.Errorf("failed to apply tenant %s scheduled plan change %v", plan.Name, err)
+			continue
+		}
+		s.logger.Infof("tenant %s %s", plan.Name, reqPlan.Audit)
+		applied++
+	}
+	return applied
+}
+
+// planScheduler applies the due plan changes periodically once the tenant database is ready
+func (s *TenantPolicyHandler) planScheduler(interval time.Duration) {
+	// spread out the schedulers of multiple instances
+	time.Sleep(time.Duration(rand.Int63n(int64(interval))))
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		if s.IsReady() {
+			s.ApplyScheduledChanges(time.Now())
+		}
+	}
+}
@@ -69,6 +69,10 @@ const (
 	BrokerMetrics = "broker-metrics"
 	// InfiniteMessageRetention is the feature for infinite message retention
 	InfiniteMessageRetention = "infinite-message-retention"
+	// FunctionLogs is the feature to retrieve function logs
+	FunctionLogs = "function-logs"
+	// PulsarBeam is the feature to manage Pulsar Beam topics and webhooks
+	PulsarBeam = "pulsar-beam"
 )
 
 // PlanPolicy is the tenant policy
@@ -83,6 +87,7 @@ type PlanPolicy struct {
 	NumOfConsumers       int           `json:"numOfConsumers"`
 	Functions            int           `json:"functions"`
 	FeatureCodes         string        `json:"featureCodes"`
+	AlertRules           int           `json:"alertRules"`
 	Reserved0            string        `json:"reserved0"`
 	Reserved1            string        `json:"reserved1"`
 }
@@ -96,7 +101,14 @@ type TenantPlan struct {
 	PlanType     string       `json:"planType"`
 	UpdatedAt    time.Time    `json:"updatedAt"`
 	Policy       PlanPolicy   `json:"policy"`
-	Audit        string       `json:"audit"`
+	Audit        string       `json:"audit"` // the reason of the latest change
+	History      []AuditEntry `json:"history,omitempty"`
+	Version      int64        `json:"version"`
+	// the plan is changed to the next plan, or downgraded to the free plan, once it expires
+	ExpiresAt           *time.Time     `json:"expiresAt,omitempty"`
+	NextPlan            *ScheduledPlan `json:"nextPlan,omitempty"`
+	OverLimitNamespaces []string       `json:"overLimitNamespaces,omitempty"`
+	AlertRules          []AlertRule    `json:"alertRules,omitempty"`
 }
 
 // PlanPolicies struct
@@ -126,6 +138,7 @@ var TenantPlanPolicies = PlanPolicies{
 		NumOfProducers:       3,
 		NumOfConsumers:       5,
 		Functions:            1,
+		AlertRules:           2,
 		FeatureCodes:         FeatureAllDisabled,
 	},
 	StarterPlan: PlanPolicy{
@@ -137,6 +150,7 @@ var TenantPlanPolicies = PlanPolicies{
 		NumOfProducers:       30,
 		NumOfConsumers:       50,
 		Functions:            10,
+		AlertRules:           10,
 		FeatureCodes:         FeatureAllDisabled,
 	},
 	ProductionPlan: PlanPolicy{
@@ -148,6 +162,7 @@ var TenantPlanPolicies = PlanPolicies{
 		NumOfProducers:       60,
 		NumOfConsumers:       100,
 		Functions:            20,
+		AlertRules:           50,
 		FeatureCodes:         FeatureAllDisabled,
 	},
 	DedicatedPlan: PlanPolicy{
@@ -159,6 +174,7 @@ var TenantPlanPolicies = PlanPolicies{
 		NumOfProducers:       300,
 		NumOfConsumers:       500,
 		Functions:            30,
+		AlertRules:           200,
 		FeatureCodes:         FeatureAllDisabled,
 	},
 	PrivatePlan: PlanPolicy{
@@ -170,6 +186,7 @@ var TenantPlanPolicies = PlanPolicies{
 		NumOfProducers:       -1,
 		NumOfConsumers:       -1,
 		Functions:            -1,
+		AlertRules:           -1,
 		FeatureCodes:         FeatureAllEnabled,
 	},
 }
@@ -202,6 +219,9 @@ func Initialize() {
 	if err := TenantManager.Setup(); err != nil {
 		log.Fatal(err)
 	}
+	if err := OrgManager.Setup(); err != nil {
+		log.Fatal(err)
+	}
 
 	if util.GetConfig().PulsarBeamTopic != "" {
 
@@ -214,6 +234,13 @@ func Initialize() {
 		}
 	}
 
+	// the topic events are published by the notification leader only, every replica keeps the event feed
+	if topicName := util.GetConfig().TopicEventsTopic; topicName != "" && util.IsNotificationLeader() {
+		if err := SetupTopicEventPublisher(topicName); err != nil {
+			statsLog.Errorf("failed to set up the topic events publisher to %s %v", topicName, err)
+		}
+	}
+
 	if err := InitTopicStatsDB(); err != nil {
 		panic(err)
 	}
@@ -222,12 +249,28 @@ func Initialize() {
 
 // Init is called at bootstrap to build feature codes
 func Init() {
-
+	if featureCodesFile := util.GetConfig().FeatureCodesFile; featureCodesFile != "" {
+		if err := LoadFeatureCodes(featureCodesFile); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if err := BuildFeatureCodeMap(); err != nil {
+		log.Fatal(err)
+	}
 }
 
-// IsFeatureSupported checks if the feature is supported
+// IsFeatureSupported checks if the feature is supported, the feature can be specified by its name or alias
 func IsFeatureSupported(feature, featureCodes string) bool {
-	return featureCodes == FeatureAllEnabled || util.StrContains(strings.Split(featureCodes, ","), feature)
+	if featureCodes == FeatureAllEnabled {
+		return true
+	}
+	for _, v := range strings.Split(featureCodes, ",") {
+		if matchFeatureCode(feature, strings.TrimSpace(v)) {
+			return true
+		}
+	}
+	return false
 }
 
 func newFreeTenantPlan(tenantName string) TenantPlan {
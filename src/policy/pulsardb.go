@@ -22,8 +22,8 @@
 package policy
 
 import (
-	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -31,172 +31,309 @@ import (
 	"sync"
 	"time"
 
-	"github.com/apache/pulsar-client-go/pulsar"
 	"github.com/datastax/burnell/src/util"
 
 	"github.com/apex/log"
 )
 
-// the signal to track if the liveness of the reader process
-type liveSignal struct{}
+// AnyVersion skips the version check when a tenant plan is updated
+const AnyVersion int64 = -1
 
-/**
- * Data design - we use a topic as a database table to store tenant document.
-**/
+// maxUpdateAttempts is the number of attempts of an update without the expected version on concurrent updates
+const maxUpdateAttempts = 3
 
-// TenantPolicyHandler is the Pulsar database driver
+// ErrVersionConflict is returned when the expected version does not match the tenant plan version in the database
+var ErrVersionConflict = errors.New("tenant plan version conflict")
+
+// TenantPolicyHandler manages tenant plans on top of the tenant store
 type TenantPolicyHandler struct {
-	client      pulsar.Client
-	topicName   string
+	store       TenantStore
 	tenants     map[string]TenantPlan
 	tenantsLock sync.RWMutex
-	logger      *log.Entry
+	// the latest version read from the database per tenant including the deleted tenants
+	versions map[string]int64
+	// the automatically created free plans that are only in the tenant map
+	cacheOnly  map[string]bool
+	updateLock sync.Mutex
+	// the tenant map has caught up with the database
+	ready        bool
+	snapshotPath string
+	logger       *log.Entry
 }
 
-//Setup sets up the database
-func (s *TenantPolicyHandler) Setup() error {
+// NewTenantPolicyHandler creates a tenant policy handler over a connected tenant store.
+// The tenant map is empty since the store is not watched.
+func NewTenantPolicyHandler(store TenantStore) *TenantPolicyHandler {
+	s := &TenantPolicyHandler{}
+	s.init(store)
+	return s
+}
+
+func (s *TenantPolicyHandler) init(store TenantStore) {
 	s.logger = log.WithFields(log.Fields{"app": "tenantdb"})
 	s.tenants = make(map[string]TenantPlan)
-	pulsarURL := util.GetConfig().PulsarURL
-	s.topicName = util.AssignString(util.GetConfig().TenantManagmentTopic, "persistent://public/default/tenants-management")
-	tokenStr := util.GetConfig().PulsarToken
-
-	clientOpt := pulsar.ClientOptions{
-		URL:               pulsarURL,
-		OperationTimeout:  30 * time.Second,
-		ConnectionTimeout: 30 * time.Second,
-	}
+	s.versions = make(map[string]int64)
+	s.cacheOnly = make(map[string]bool)
+	s.store = store
+}
 
-	if tokenStr != "" {
-		clientOpt.Authentication = pulsar.NewAuthenticationToken(tokenStr)
+//Setup sets up the database
+func (s *TenantPolicyHandler) Setup() error {
+	store, err := ConnectTenantStore()
+	if err != nil {
+		return err
 	}
+	s.init(store)
 
-	if strings.HasPrefix(pulsarURL, "pulsar+ssl://") {
-		trustStore := util.GetConfig().TrustStore //"/etc/ssl/certs/ca-bundle.crt"
-		if trustStore == "" {
-			return fmt.Errorf("this is fatal that we are missing trustStore while pulsar+ssl is required")
+	// only a resumable store can start from a snapshot
+	if store, ok := s.store.(ResumableTenantStore); ok {
+		s.snapshotPath = util.GetConfig().TenantSnapshotPath
+		if s.snapshotPath != "" {
+			s.loadSnapshot(store)
+			go s.snapshotWorker(store, time.Duration(util.GetEnvInt("TenantSnapshotIntervalSecond", 300))*time.Second)
 		}
-		clientOpt.TLSTrustCertsFilePath = trustStore
 	}
 
-	var err error
-	s.client, err = pulsar.NewClient(clientOpt)
+	go s.planScheduler(planSchedulerInterval)
+
+	return s.watch()
+}
+
+// Connect connects and watches the tenant store without the snapshot and the plan scheduler, for the commands running once
+func (s *TenantPolicyHandler) Connect() error {
+	store, err := ConnectTenantStore()
 	if err != nil {
 		return err
 	}
-
-	go func() {
-		sig := make(chan *liveSignal)
-		go s.dbListener(sig)
-		for {
-			select {
-			case <-sig:
-				go s.dbListener(sig)
-			}
-		}
-	}()
-
-	return nil
+	s.init(store)
+	return s.watch()
 }
 
-//DbListener listens db updates
-func (s *TenantPolicyHandler) dbListener(sig chan *liveSignal) error {
-	defer func(termination chan *liveSignal) {
-		s.logger.Errorf("tenant db listener terminated")
-		termination <- &liveSignal{}
-	}(sig)
-	s.logger.Infof("listens to tenant database changes")
-	reader, err := s.client.CreateReader(pulsar.ReaderOptions{
-		Topic:          s.topicName,
-		StartMessageID: pulsar.EarliestMessageID(),
-	})
+func (s *TenantPolicyHandler) watch() error {
+	return s.store.Watch(func(t TenantPlan) {
+		s.applyTenantRecord(t)
+	}, s.setReady)
+}
 
+// loadSnapshot restores the tenant map and the store position from the local snapshot
+func (s *TenantPolicyHandler) loadSnapshot(store ResumableTenantStore) {
+	snapshot, err := ReadTenantSnapshot(s.snapshotPath)
 	if err != nil {
-		return err
+		s.logger.Warnf("replay the tenant database from the beginning, unable to load snapshot %v", err)
+		return
+	}
+	if err = store.Resume(snapshot.MessageID); err != nil {
+		s.logger.Warnf("replay the tenant database from the beginning, invalid snapshot position %v", err)
+		return
 	}
-	defer reader.Close()
 
-	ctx := context.Background()
+	s.tenantsLock.Lock()
+	s.tenants = snapshot.Tenants
+	s.versions = snapshot.Versions
+	s.tenantsLock.Unlock()
+	s.logger.Infof("loaded %d tenants from snapshot created at %v", len(snapshot.Tenants), snapshot.CreatedAt)
+}
 
-	// infinite loop to receive messages
-	for {
-		data, err := reader.Next(ctx)
-		if err != nil {
-			log.Errorf("tenant db listener reader error %v", err)
-			return err
-		}
-		t := TenantPlan{}
-		if err = json.Unmarshal(data.Payload(), &t); err != nil {
-			s.logger.Errorf("tenant unmarshal error %v", err)
+// saveSnapshot writes the tenant map to the local snapshot with the position of the last applied change
+func (s *TenantPolicyHandler) saveSnapshot(store ResumableTenantStore) error {
+	// the position must be taken before the tenant map, replaying a change already in the map is a no-op
+	position := store.Position()
+	if position == nil {
+		return nil
+	}
+	snapshot := TenantSnapshot{
+		MessageID: position,
+		CreatedAt: time.Now(),
+	}
+	s.tenantsLock.RLock()
+	snapshot.Tenants = make(map[string]TenantPlan, len(s.tenants))
+	snapshot.Versions = make(map[string]int64, len(s.versions))
+	for k, v := range s.tenants {
+		// a plan not in the database is created again on demand
+		if !s.cacheOnly[k] {
+			snapshot.Tenants[k] = v
 		}
-		s.logger.Infof("tenant %s plan %v", t.Name, t)
+	}
+	for k, v := range s.versions {
+		snapshot.Versions[k] = v
+	}
+	s.tenantsLock.RUnlock()
 
-		s.tenantsLock.Lock()
-		if t.TenantStatus != Deleted {
-			s.tenants[t.Name] = t
-		} else {
-			delete(s.tenants, t.Name)
+	return WriteTenantSnapshot(s.snapshotPath, snapshot)
+}
+
+func (s *TenantPolicyHandler) snapshotWorker(store ResumableTenantStore, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.saveSnapshot(store); err != nil {
+				s.logger.Errorf("failed to save tenant snapshot %v", err)
+			}
 		}
-		s.tenantsLock.Unlock()
 	}
 }
 
-// UpdateTenant creates or updates a tenant plan
-func (s *TenantPolicyHandler) UpdateTenant(tenantName string, tenantPlan TenantPlan) (TenantPlan, int, error) {
-	existingTenant, _ := s.GetTenant(tenantName)
-	tenantPlan.Name = tenantName //enforce tenant in the database record
-	newPlan, err := ReconcileTenantPlan(tenantPlan, existingTenant)
-	if err != nil {
-		return TenantPlan{}, http.StatusUnprocessableEntity, err
+// IsReady returns true once the tenant map has caught up with the database
+func (s *TenantPolicyHandler) IsReady() bool {
+	s.tenantsLock.RLock()
+	defer s.tenantsLock.RUnlock()
+	return s.ready
+}
+
+func (s *TenantPolicyHandler) setReady() {
+	s.tenantsLock.Lock()
+	if !s.ready {
+		s.logger.Infof("tenant database has caught up with %d tenants", len(s.tenants))
 	}
+	s.ready = true
+	s.tenantsLock.Unlock()
+}
 
-	updatedPlan, err := s.updateDb(newPlan)
-	if err != nil {
-		return TenantPlan{}, http.StatusInternalServerError, err
+// applyTenantRecord applies a tenant record read from the database to the tenant map.
+// The topic order decides the winner of concurrent updates, so any record that is not newer
+// than the last one read for the tenant is ignored.
+func (s *TenantPolicyHandler) applyTenantRecord(t TenantPlan) bool {
+	s.tenantsLock.Lock()
+	defer s.tenantsLock.Unlock()
+	if IsStaleTenantVersion(s.versions[t.Name], t.Version) {
+		// the same version is the record written by this instance, which has been applied already
+		if t.Version == s.versions[t.Name] {
+			return false
+		}
+		s.logger.Warnf("ignore tenant %s stale version %d, the current version is %d", t.Name, t.Version, s.versions[t.Name])
+		return false
 	}
-	return updatedPlan, http.StatusOK, nil
+	if t.Version > s.versions[t.Name] {
+		s.versions[t.Name] = t.Version
+	}
+	delete(s.cacheOnly, t.Name)
+
+	if t.TenantStatus != Deleted {
+		s.tenants[t.Name] = t
+	} else {
+		delete(s.tenants, t.Name)
+	}
+	return true
 }
 
-// updateDb updates records directly on DB with no validation
-func (s *TenantPolicyHandler) updateDb(tenantPlan TenantPlan) (TenantPlan, error) {
+// IsStaleTenantVersion evaluates if the incoming version is stale against the current version.
+// Version 0 is from records created before versioning therefore always applied.
+func IsStaleTenantVersion(current, incoming int64) bool {
+	return incoming != 0 && incoming <= current
+}
 
-	producer, err := s.client.CreateProducer(pulsar.ProducerOptions{
-		Topic:           s.topicName,
-		DisableBatching: true,
-	})
-	if err != nil {
-		return TenantPlan{}, err
+// CheckTenantVersion verifies the expected version matches the tenant plan, AnyVersion always matches.
+// The version of a tenant that does not exist is 0.
+func CheckTenantVersion(existingPlan TenantPlan, expectedVersion int64) error {
+	if expectedVersion != AnyVersion && expectedVersion != existingPlan.Version {
+		return fmt.Errorf("%w: expected version %d but the current version is %d", ErrVersionConflict, expectedVersion, existingPlan.Version)
 	}
-	defer producer.Close()
+	return nil
+}
 
-	tenantPlan.UpdatedAt = time.Now()
-	ctx := context.Background()
-	data, err := json.Marshal(tenantPlan)
-	if err != nil {
-		return TenantPlan{}, err
+// nextVersion returns the next version of a tenant plan
+func (s *TenantPolicyHandler) nextVersion(existingPlan TenantPlan) int64 {
+	s.tenantsLock.RLock()
+	version := s.versions[existingPlan.Name]
+	s.tenantsLock.RUnlock()
+	if existingPlan.Version > version {
+		version = existingPlan.Version
 	}
-	msg := pulsar.ProducerMessage{
-		Payload: data,
-		Key:     tenantPlan.Name,
+	if size := len(existingPlan.History); size > 0 && existingPlan.History[size-1].Version > version {
+		version = existingPlan.History[size-1].Version
 	}
+	return version + 1
+}
 
-	if _, err = producer.Send(ctx, &msg); err != nil {
-		return TenantPlan{}, err
+// UpdateTenant creates or updates a tenant plan, the change is recorded in the plan history under the actor.
+// The update is rejected with a conflict if the expected version does not match the current plan's version.
+// A store that supports conditional updates is checked for the version, so that the update is not lost to a concurrent
+// update from another instance. Otherwise the version is only checked against this instance's tenant map.
+// The Pulsar, zookeeper and REST stores all support conditional updates.
+func (s *TenantPolicyHandler) UpdateTenant(tenantName string, tenantPlan TenantPlan, actor string, expectedVersion int64) (TenantPlan, int, error) {
+	s.updateLock.Lock()
+	defer s.updateLock.Unlock()
+
+	tenantPlan.Name = tenantName //enforce tenant in the database record
+	for attempt := 1; ; attempt++ {
+		existingTenant, err := s.currentTenant(tenantName)
+		if err != nil {
+			return TenantPlan{}, http.StatusInternalServerError, err
+		}
+		if err := CheckTenantVersion(existingTenant, expectedVersion); err != nil {
+			return TenantPlan{}, http.StatusConflict, err
+		}
+		newPlan, err := ReconcileTenantPlan(tenantPlan, existingTenant)
+		if err != nil {
+			return TenantPlan{}, http.StatusUnprocessableEntity, err
+		}
+		newPlan.Name = tenantName
+		newPlan.Version = s.nextVersion(existingTenant)
+		newPlan = AppendAuditEntry(newPlan, existingTenant, actor, newPlan.Audit)
+
+		updatedPlan, err := s.updateDbIfVersion(newPlan, existingTenant.Version)
+		if errors.Is(err, ErrVersionConflict) {
+			// an update without the expected version is reconciled with the concurrent update and retried
+			if expectedVersion == AnyVersion && attempt < maxUpdateAttempts {
+				continue
+			}
+			return TenantPlan{}, http.StatusConflict, err
+		} else if err != nil {
+			return TenantPlan{}, http.StatusInternalServerError, err
+		}
+		publishTenantEvents(existingTenant, updatedPlan, actor)
+		return updatedPlan, http.StatusOK, nil
 	}
-	producer.Flush()
+}
 
-	s.logger.Infof("send to Pulsar %s", tenantPlan.Name)
+// currentTenant returns the tenant plan that an update is based on. A conditional store is read directly
+// since the tenant map may not have caught up with the updates from other instances yet.
+// A tenant that does not exist in the store is based on the automatically created free plan in the tenant map, if any.
+func (s *TenantPolicyHandler) currentTenant(tenantName string) (TenantPlan, error) {
+	cached, _ := s.GetTenant(tenantName)
+	store, ok := s.store.(ConditionalTenantStore)
+	if !ok {
+		return cached, nil
+	}
+	t, err := store.Get(tenantName)
+	if errors.Is(err, ErrTenantNotFound) {
+		s.tenantsLock.RLock()
+		defer s.tenantsLock.RUnlock()
+		if s.cacheOnly[tenantName] {
+			return cached, nil
+		}
+		return TenantPlan{}, nil
+	}
+	return t, err
+}
+
+// updateDbIfVersion updates records directly on DB with no validation. A conditional store only updates
+// the record if the stored plan is at the expected version, the expected version AnyVersion updates it unconditionally.
+func (s *TenantPolicyHandler) updateDbIfVersion(tenantPlan TenantPlan, expectedVersion int64) (TenantPlan, error) {
+	tenantPlan.UpdatedAt = time.Now()
+	store, ok := s.store.(ConditionalTenantStore)
+	if ok && expectedVersion != AnyVersion {
+		if err := store.UpdateIfVersion(tenantPlan, expectedVersion); err != nil {
+			return TenantPlan{}, err
+		}
+	} else if err := s.store.Update(tenantPlan); err != nil {
+		return TenantPlan{}, err
+	}
 
 	s.tenantsLock.Lock()
 	s.tenants[tenantPlan.Name] = tenantPlan
+	delete(s.cacheOnly, tenantPlan.Name)
+	if tenantPlan.Version > s.versions[tenantPlan.Name] {
+		s.versions[tenantPlan.Name] = tenantPlan.Version
+	}
 	s.tenantsLock.Unlock()
 	return tenantPlan, nil
 }
 
 // Close closes database
 func (s *TenantPolicyHandler) Close() error {
-	s.client.Close()
-	return nil
+	return s.store.Close()
 }
 
 // GetTenant gets a tenant by the name
@@ -206,7 +343,7 @@ func (s *TenantPolicyHandler) GetTenant(tenantName string) (TenantPlan, error) {
 	if t, ok := s.tenants[tenantName]; ok {
 		return t, nil
 	}
-	return TenantPlan{}, fmt.Errorf("tenant not found in database")
+	return TenantPlan{}, ErrTenantNotFound
 }
 
 // GetOrCreateTenant gets a tenant. It creates a tenant with free plan if it does not exist in cache only.
@@ -217,13 +354,17 @@ func (s *TenantPolicyHandler) GetOrCreateTenant(tenantName string) (TenantPlan,
 		t = newFreeTenantPlan(tenantName)
 		s.tenantsLock.Lock()
 		s.tenants[tenantName] = t
+		s.cacheOnly[tenantName] = true
 		s.tenantsLock.Unlock()
 	}
 	return t, nil
 }
 
-// DeleteTenant gets a tenant by the name
-func (s *TenantPolicyHandler) DeleteTenant(tenantName string) (TenantPlan, error) {
+// DeleteTenant deletes a tenant by the name, the deletion is recorded in the plan history under the actor
+func (s *TenantPolicyHandler) DeleteTenant(tenantName, actor string) (TenantPlan, error) {
+	s.updateLock.Lock()
+	defer s.updateLock.Unlock()
+
 	s.tenantsLock.RLock()
 	t, ok := s.tenants[tenantName]
 	s.tenantsLock.RUnlock()
@@ -231,14 +372,24 @@ func (s *TenantPolicyHandler) DeleteTenant(tenantName string) (TenantPlan, error
 		return TenantPlan{}, fmt.Errorf("not found")
 	}
 
+	existingTenant := t
+	t.Version = s.nextVersion(existingTenant)
 	t.TenantStatus = Deleted
-	if _, err := s.updateDb(t); err != nil {
+	t.Audit = "tenant deleted"
+	t = AppendAuditEntry(t, existingTenant, actor, t.Audit)
+	t.UpdatedAt = time.Now()
+	if err := s.store.Delete(t); err != nil {
 		return TenantPlan{}, err
 	}
 
 	s.tenantsLock.Lock()
 	delete(s.tenants, tenantName)
+	delete(s.cacheOnly, tenantName)
+	if t.Version > s.versions[tenantName] {
+		s.versions[tenantName] = t.Version
+	}
 	s.tenantsLock.Unlock()
+	publishTenantEvents(existingTenant, t, actor)
 	return t, nil
 }
 
@@ -253,23 +404,30 @@ func (s *TenantPolicyHandler) EvaluateFeatureCode(tenant, featureCode string) bo
 // ReconcileTenantPlan reconcile tenant plan with the requested and existing plan in the database
 func ReconcileTenantPlan(reqPlan, existingPlan TenantPlan) (TenantPlan, error) {
 	reqPlan.UpdatedAt = time.Now()
-	emptyPlan := TenantPlan{}
 	emptyPolicy := PlanPolicy{}
 	reqPlanPolicy := getPlanPolicy(strings.ToLower(reqPlan.PlanType))
 	if reqPlanPolicy == nil {
 		return TenantPlan{}, fmt.Errorf("a valid plan type is missing")
 	}
+	if reqPlan.AlertRules != nil {
+		rules, err := reconcileAlertRules(reqPlan.AlertRules)
+		if err != nil {
+			return TenantPlan{}, err
+		}
+		reqPlan.AlertRules = rules
+	}
 
-	if emptyPlan == existingPlan {
-		// this is new creation
+	if existingPlan.Name == "" {
+		// this is new creation, history can only be recorded by the server
+		reqPlan.History = nil
 		if reqPlan.Audit == "" {
-			reqPlan.Audit = "initial creation,"
+			reqPlan.Audit = "initial creation"
 		}
 		if reqPlan.Policy == emptyPolicy {
 			reqPlan.Policy = *reqPlanPolicy
 		}
 		reqPlan.TenantStatus = takeTenantStatus(reqPlan.TenantStatus, Activated)
-		return reqPlan, nil
+		return reconcilePlanSchedule(reqPlan, existingPlan)
 	}
 
 	reqPlan.Policy.NumOfTopics = takeNonZero(reqPlan.Policy.NumOfTopics, existingPlan.Policy.NumOfTopics)
@@ -277,6 +435,7 @@ func ReconcileTenantPlan(reqPlan, existingPlan TenantPlan) (TenantPlan, error) {
 	reqPlan.Policy.NumOfProducers = takeNonZero(reqPlan.Policy.NumOfProducers, existingPlan.Policy.NumOfProducers)
 	reqPlan.Policy.NumOfConsumers = takeNonZero(reqPlan.Policy.NumOfConsumers, existingPlan.Policy.NumOfConsumers)
 	reqPlan.Policy.Functions = takeNonZero(reqPlan.Policy.Functions, existingPlan.Policy.Functions)
+	reqPlan.Policy.AlertRules = takeNonZero(reqPlan.Policy.AlertRules, existingPlan.Policy.AlertRules)
 	reqPlan.Policy.Name = util.AssignString(reqPlan.Policy.Name, existingPlan.Policy.Name)
 	reqPlan.Policy.FeatureCodes = util.AssignString(reqPlan.Policy.FeatureCodes, existingPlan.Policy.FeatureCodes)
 
@@ -289,8 +448,16 @@ func ReconcileTenantPlan(reqPlan, existingPlan TenantPlan) (TenantPlan, error) {
 	reqPlan.Org = util.AssignString(reqPlan.Org, existingPlan.Org)
 	reqPlan.Users = util.AssignString(reqPlan.Users, existingPlan.Users)
 
-	reqPlan.Audit = existingPlan.Audit + "," + reqPlan.Audit
-	return reqPlan, nil
+	reqPlan.History = existingPlan.History
+	// the alert rules are managed by the alerts endpoint unless specified
+	if reqPlan.AlertRules == nil {
+		reqPlan.AlertRules = existingPlan.AlertRules
+	}
+	// the over limit namespaces are flagged by the plan scheduler unless specified
+	if reqPlan.OverLimitNamespaces == nil {
+		reqPlan.OverLimitNamespaces = existingPlan.OverLimitNamespaces
+	}
+	return reconcilePlanSchedule(reqPlan, existingPlan)
 
 }
 
@@ -333,6 +500,14 @@ func (s *TenantPolicyHandler) EvaluateTopicLimit(tenant string) (bool, error) {
 	return t.Policy.NumOfTopics > counts, nil
 }
 
+// EvaluateRetention evaluates the requested namespace retention time is within the plan's message retention,
+// infinite retention is gated by the infinite message retention feature code in the route
+func (s *TenantPolicyHandler) EvaluateRetention(tenant string, retention NamespaceRetention) bool {
+	t, _ := s.GetOrCreateTenant(tenant)
+	hours := retention.Hours()
+	return hours == InfiniteRetention || t.Policy.MessageHourRetention >= hours
+}
+
 // EvaluateAlwaysSuccessful evaluates the requested topic addition would over the limit
 func (s *TenantPolicyHandler) EvaluateAlwaysSuccessful(tenant string) (bool, error) {
 	return true, nil
@@ -360,6 +535,37 @@ func (s *TenantPolicyHandler) GetFunctionsLimit(tenant string) int {
 	return getPlanPolicy(FreeTier).Functions
 }
 
+// AdminAPIGETRespJSON sends GET request to the Pulsar admin REST API and unmarshals the JSON response
+func AdminAPIGETRespJSON(subroute string, v interface{}) error {
+	requestURL := util.SingleJoinSlash(util.SingleJoinSlash(util.Config.BrokerProxyURL, "/admin/v2"), subroute)
+	newRequest, err := http.NewRequest(http.MethodGet, requestURL, nil)
+	if err != nil {
+		return err
+	}
+	newRequest.Header.Add("X-Proxy", "burnell")
+	newRequest.Header.Add("Authorization", "Bearer "+util.Config.PulsarToken)
+	client := &http.Client{
+		CheckRedirect: util.PreserveHeaderForRedirect,
+	}
+	response, err := client.Do(newRequest)
+	if response != nil {
+		defer response.Body.Close()
+	}
+	if err != nil {
+		log.Errorf("GET request url %s error %v", requestURL, err)
+		return err
+	}
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET request url %s response status code %d", requestURL, response.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
+
 // AdminAPIGETRespStringArray is a template tenant call that returns an array of string
 func AdminAPIGETRespStringArray(subroute string) ([]string, error) {
 	requestURL := util.SingleJoinSlash(util.SingleJoinSlash(util.Config.BrokerProxyURL, "/admin/v2"), subroute)
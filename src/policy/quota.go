@@ -0,0 +1,282 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package policy
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/datastax/burnell/src/util"
+)
+
+// plan dimensions reported in the quota usage
+const (
+	QuotaTopics     = "topics"
+	QuotaNamespaces = "namespaces"
+	QuotaProducers  = "producers"
+	QuotaConsumers  = "consumers"
+	QuotaFunctions  = "functions"
+	QuotaRetention  = "retentionHours"
+)
+
+// InfiniteRetention is the retention configured on a namespace without time limit
+const InfiniteRetention = -1
+
+// QuotaUsage is the current usage of a plan dimension against its limit
+type QuotaUsage struct {
+	Dimension string  `json:"dimension"`
+	Limit     int     `json:"limit"`
+	Usage     int     `json:"usage"`
+	Percent   float64 `json:"percent"`
+}
+
+// TenantQuota is the quota usage report of a tenant
+type TenantQuota struct {
+	Tenant     string       `json:"tenant"`
+	PlanType   string       `json:"planType"`
+	Quotas     []QuotaUsage `json:"quotas"`
+	MaxPercent float64      `json:"maxPercent"`
+	ReportedAt time.Time    `json:"reportedAt"`
+}
+
+// TenantResourceUsage is the live resource counts of a tenant
+type TenantResourceUsage struct {
+	Topics         int
+	Namespaces     int
+	Producers      int
+	Consumers      int
+	Functions      int
+	RetentionHours int // the longest retention of all namespaces, InfiniteRetention for no time limit
+}
+
+// BuildTenantQuota compares the resource usage with the tenant plan's limits
+func BuildTenantQuota(plan TenantPlan, usage TenantResourceUsage) TenantQuota {
+	quota := TenantQuota{
+		Tenant:   plan.Name,
+		PlanType: plan.PlanType,
+		Quotas: []QuotaUsage{
+			newQuotaUsage(QuotaTopics, plan.Policy.NumOfTopics, usage.Topics),
+			newQuotaUsage(QuotaNamespaces, plan.Policy.NumOfNamespaces, usage.Namespaces),
+			newQuotaUsage(QuotaProducers, plan.Policy.NumOfProducers, usage.Producers),
+			newQuotaUsage(QuotaConsumers, plan.Policy.NumOfConsumers, usage.Consumers),
+			newQuotaUsage(QuotaFunctions, plan.Policy.Functions, usage.Functions),
+		},
+		ReportedAt: time.Now(),
+	}
+
+	retention := newQuotaUsage(QuotaRetention, plan.Policy.MessageHourRetention, usage.RetentionHours)
+	if usage.RetentionHours == InfiniteRetention && plan.Policy.MessageHourRetention >= 0 {
+		retention.Percent = 100
+		if IsFeatureSupported(InfiniteMessageRetention, plan.Policy.FeatureCodes) {
+			retention.Percent = 0
+		}
+	}
+	quota.Quotas = append(quota.Quotas, retention)
+
+	for _, v := range quota.Quotas {
+		if v.Percent > quota.MaxPercent {
+			quota.MaxPercent = v.Percent
+		}
+	}
+	return quota
+}
+
+// PlanLimit returns the limit of the plan dimension
+func PlanLimit(policy PlanPolicy, dimension string) int {
+	switch dimension {
+	case QuotaTopics:
+		return policy.NumOfTopics
+	case QuotaNamespaces:
+		return policy.NumOfNamespaces
+	case QuotaProducers:
+		return policy.NumOfProducers
+	case QuotaConsumers:
+		return policy.NumOfConsumers
+	case QuotaFunctions:
+		return policy.Functions
+	case QuotaRetention:
+		return policy.MessageHourRetention
+	default:
+		return 0
+	}
+}
+
+// newQuotaUsage computes the usage percent of the limit, a negative limit is unlimited and always at 0%
+func newQuotaUsage(dimension string, limit, usage int) QuotaUsage {
+	q := QuotaUsage{
+		Dimension: dimension,
+		Limit:     limit,
+		Usage:     usage,
+	}
+	if limit > 0 {
+		q.Percent = float64(usage) * 100 / float64(limit)
+	} else if limit == 0 && usage > 0 {
+		q.Percent = 100
+	}
+	return q
+}
+
+// OverQuota returns the quota usages at or over the percent threshold
+func (q TenantQuota) OverQuota(threshold float64) []QuotaUsage {
+	over := []QuotaUsage{}
+	for _, v := range q.Quotas {
+		if v.Percent >= threshold {
+			over = append(over, v)
+		}
+	}
+	return over
+}
+
+// FilterOverQuota returns the tenants with any quota usage at or over the percent threshold, the highest usage first
+func FilterOverQuota(quotas []TenantQuota, threshold float64) []TenantQuota {
+	over := []TenantQuota{}
+	for _, v := range quotas {
+		if v.MaxPercent >= threshold {
+			over = append(over, v)
+		}
+	}
+	sort.SliceStable(over, func(i, j int) bool { return over[i].MaxPercent > over[j].MaxPercent })
+	return over
+}
+
+// CountTenantClients counts the producers and consumers of the tenant's topics from the topic stats cache
+func CountTenantClients(tenant string) (int, int) {
+	producers, consumers := 0, 0
+	topics, err := freshTenantTopics(tenant, time.Now())
+	if err != nil {
+		return producers, consumers
+	}
+	for _, v := range topics {
+		p, c := CountTopicClients(v.Data)
+		producers += p
+		consumers += c
+	}
+	return producers, consumers
+}
+
+// CountTopicClients counts the publishers and the consumers of all subscriptions in a topic stats document
+func CountTopicClients(stats interface{}) (int, int) {
+	data, ok := stats.(map[string]interface{})
+	if !ok {
+		return 0, 0
+	}
+	producers, consumers := 0, 0
+	if publishers, ok := data["publishers"].([]interface{}); ok {
+		producers = len(publishers)
+	}
+	if subs, ok := data["subscriptions"].(map[string]interface{}); ok {
+		for _, v := range subs {
+			if sub, ok := v.(map[string]interface{}); ok {
+				if c, ok := sub["consumers"].([]interface{}); ok {
+					consumers += len(c)
+				}
+			}
+		}
+	}
+	return producers, consumers
+}
+
+// NamespaceRetention is the retention policy of a namespace
+type NamespaceRetention struct {
+	RetentionTimeInMinutes int `json:"retentionTimeInMinutes"`
+	RetentionSizeInMB      int `json:"retentionSizeInMB"`
+}
+
+// Hours returns the retention time rounded up to hours, or InfiniteRetention
+func (nr NamespaceRetention) Hours() int {
+	if nr.RetentionTimeInMinutes < 0 {
+		return InfiniteRetention
+	}
+	return (nr.RetentionTimeInMinutes + 59) / 60
+}
+
+// IsInfinite returns true if either the retention time or size has no limit
+func (nr NamespaceRetention) IsInfinite() bool {
+	return nr.RetentionTimeInMinutes < 0 || nr.RetentionSizeInMB < 0
+}
+
+// WithinPlan evaluates the retention time is within the plan policy,
+// infinite retention time or size requires the infinite message retention feature code
+func (nr NamespaceRetention) WithinPlan(policy PlanPolicy) bool {
+	if nr.IsInfinite() && !IsFeatureSupported(InfiniteMessageRetention, policy.FeatureCodes) {
+		return false
+	}
+	hours := nr.Hours()
+	return hours == InfiniteRetention || hours <= policy.MessageHourRetention
+}
+
+// NamespaceRetentionHours returns the longest retention in hours of the namespaces, or InfiniteRetention
+func NamespaceRetentionHours(namespaces []string) (int, error) {
+	hours := 0
+	for _, ns := range namespaces {
+		retention := NamespaceRetention{}
+		if err := AdminAPIGETRespJSON("namespaces/"+ns+"/retention", &retention); err != nil {
+			return 0, err
+		}
+		h := retention.Hours()
+		if h == InfiniteRetention {
+			return InfiniteRetention, nil
+		}
+		if h > hours {
+			hours = h
+		}
+	}
+	return hours, nil
+}
+
+// the dimensions over the threshold reported last time, and the last time a limit denial was reported, by tenant and dimension
+var quotaCrossed = make(map[string]bool)
+var quotaLimitReported = make(map[string]time.Time)
+var quotaEventLock = sync.Mutex{}
+
+// the minimum interval to report the denial on the same tenant and dimension again
+var quotaLimitReportInterval = time.Duration(util.GetEnvInt("QuotaLimitEventIntervalSecond", 3600)) * time.Second
+
+// QuotaThresholdCrossings returns the dimensions that have crossed the threshold since the last report of the tenant.
+// A dimension dropping below the threshold will be reported again once it crosses the threshold.
+func QuotaThresholdCrossings(quota TenantQuota, threshold float64) []QuotaUsage {
+	quotaEventLock.Lock()
+	defer quotaEventLock.Unlock()
+	crossings := []QuotaUsage{}
+	for _, v := range quota.Quotas {
+		key := quota.Tenant + "/" + v.Dimension
+		over := v.Percent >= threshold
+		if over && !quotaCrossed[key] {
+			crossings = append(crossings, v)
+		}
+		quotaCrossed[key] = over
+	}
+	return crossings
+}
+
+// IsQuotaLimitReportDue evaluates if a limit denial should be reported, at most once per interval per tenant and dimension
+func IsQuotaLimitReportDue(tenant, dimension string, now time.Time) bool {
+	quotaEventLock.Lock()
+	defer quotaEventLock.Unlock()
+	key := tenant + "/" + dimension
+	if last, ok := quotaLimitReported[key]; ok && now.Sub(last) < quotaLimitReportInterval {
+		return false
+	}
+	quotaLimitReported[key] = now
+	return true
+}
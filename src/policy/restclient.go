@@ -21,27 +21,200 @@
 
 package policy
 
-import "net/url"
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/datastax/burnell/src/util"
+)
+
+/**
+ * RestClient stores tenant plans in a remote tenant service with the following REST API
+ *   GET    {url}/tenants          returns all the tenant plans in a JSON array
+ *   GET    {url}/tenants/{tenant} returns a tenant plan or 404 if it does not exist
+ *   PUT    {url}/tenants/{tenant} creates or updates a tenant plan. With the If-Match header of the
+ *          expected version, it returns 412 if the stored plan is at another version, 0 for no plan.
+ *   DELETE {url}/tenants/{tenant} deletes a tenant plan
+ * The service has no change notification so Watch polls the tenant list.
+**/
 
 // RestClient is the client object for RestAPI
 type RestClient struct {
-	URL *url.URL
+	URL          *url.URL
+	Token        string
+	PollInterval time.Duration
+	client       *http.Client
+	done         chan struct{}
+	logger       *log.Entry
 }
 
 // Conn sets up the server string
 func (r *RestClient) Conn(hosts string) error {
 	var err error
 	r.URL, err = url.ParseRequestURI(hosts)
+	if err != nil {
+		return err
+	}
+	if r.PollInterval == 0 {
+		r.PollInterval = time.Duration(util.GetEnvInt("TenantStorePollIntervalSecond", 10)) * time.Second
+	}
+	r.client = &http.Client{
+		Timeout:       30 * time.Second,
+		CheckRedirect: util.PreserveHeaderForRedirect,
+	}
+	r.done = make(chan struct{})
+	r.logger = log.WithFields(log.Fields{"app": "tenantdb", "store": RestStore})
+	return nil
+}
+
+func (r *RestClient) do(method, subPath string, body interface{}, result interface{}) (int, error) {
+	return r.doWithHeader(method, subPath, nil, body, result)
+}
+
+func (r *RestClient) doWithHeader(method, subPath string, header http.Header, body interface{}, result interface{}) (int, error) {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, util.SingleJoinSlash(r.URL.String(), subPath), reqBody)
+	if err != nil {
+		return 0, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if r.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.Token)
+	}
 
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return resp.StatusCode, ErrTenantNotFound
+	}
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return resp.StatusCode, fmt.Errorf("%w: tenant service %s %s precondition failed", ErrVersionConflict, method, subPath)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("tenant service %s %s returns status code %d", method, subPath, resp.StatusCode)
+	}
+	if result != nil {
+		return resp.StatusCode, json.Unmarshal(data, result)
+	}
+	return resp.StatusCode, nil
+}
+
+// Get gets the tenant plan
+func (r *RestClient) Get(tenantName string) (TenantPlan, error) {
+	t := TenantPlan{}
+	_, err := r.do(http.MethodGet, "tenants/"+url.PathEscape(tenantName), nil, &t)
+	return t, err
+}
+
+// List lists all the tenant plans
+func (r *RestClient) List() ([]TenantPlan, error) {
+	plans := []TenantPlan{}
+	_, err := r.do(http.MethodGet, "tenants", nil, &plans)
+	return plans, err
+}
+
+// Update creates or updates the tenant plan
+func (r *RestClient) Update(tenantPlan TenantPlan) error {
+	_, err := r.do(http.MethodPut, "tenants/"+url.PathEscape(tenantPlan.Name), tenantPlan, nil)
 	return err
 }
 
+// UpdateIfVersion updates the tenant plan only if the stored plan is at the expected version
+func (r *RestClient) UpdateIfVersion(tenantPlan TenantPlan, expectedVersion int64) error {
+	header := http.Header{}
+	header.Set("If-Match", strconv.Quote(strconv.FormatInt(expectedVersion, 10)))
+	_, err := r.doWithHeader(http.MethodPut, "tenants/"+url.PathEscape(tenantPlan.Name), header, tenantPlan, nil)
+	return err
+}
+
+// Delete deletes the tenant plan
+func (r *RestClient) Delete(tenantPlan TenantPlan) error {
+	_, err := r.do(http.MethodDelete, "tenants/"+url.PathEscape(tenantPlan.Name), nil, nil)
+	return err
+}
+
+// Watch polls the tenant list and delivers the tenants that are new, changed or deleted since the last poll
+func (r *RestClient) Watch(onChange func(TenantPlan), onReady func()) error {
+	go func() {
+		var once sync.Once
+		known := make(map[string]TenantPlan)
+		ticker := time.NewTicker(r.PollInterval)
+		defer ticker.Stop()
+		for {
+			if plans, err := r.List(); err != nil {
+				r.logger.Errorf("failed to poll tenant service error %v", err)
+			} else {
+				known = diffTenantPlans(known, plans, onChange)
+				once.Do(onReady)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-r.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// diffTenantPlans delivers the differences from the known tenants to the latest plans and returns the latest as known tenants
+func diffTenantPlans(known map[string]TenantPlan, plans []TenantPlan, onChange func(TenantPlan)) map[string]TenantPlan {
+	latest := make(map[string]TenantPlan, len(plans))
+	for _, v := range plans {
+		latest[v.Name] = v
+		if t, ok := known[v.Name]; !ok || t.Version != v.Version || !t.UpdatedAt.Equal(v.UpdatedAt) {
+			onChange(v)
+		}
+	}
+	for k := range known {
+		if _, ok := latest[k]; !ok {
+			onChange(TenantPlan{Name: k, TenantStatus: Deleted})
+		}
+	}
+	return latest
+}
+
+// Close stops watching
+func (r *RestClient) Close() error {
+	close(r.done)
+	return nil
+}
+
 // GetPlanPolicy gets the policy
 func (r *RestClient) GetPlanPolicy(tenantName string) PlanPolicy {
-	return PlanPolicy{}
+	return getStorePlanPolicy(r, tenantName)
 }
 
-// Evaluate gets the policy
+// Evaluate evaluates the tenant exists and is activated
 func (r *RestClient) Evaluate(tenantName string) error {
-	return nil
+	return evaluateStoreTenant(r, tenantName)
 }
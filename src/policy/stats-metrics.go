@@ -0,0 +1,127 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package policy
+
+import (
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// the metrics of the topic stats polling exposed on /metrics
+var (
+	statsPollDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "burnell_stats_poll_duration_seconds",
+		Help:    "The duration of a topic stats poll cycle over all the brokers",
+		Buckets: prometheus.ExponentialBuckets(0.5, 2, 10),
+	})
+	brokerPollDuration = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "burnell_stats_broker_poll_duration_seconds",
+		Help: "The duration of the last topic stats poll of a broker",
+	}, []string{"broker"})
+	brokerPollErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "burnell_stats_broker_poll_errors_total",
+		Help: "The number of failed topic stats polls of a broker",
+	}, []string{"broker"})
+	brokerTopics = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "burnell_stats_broker_topics",
+		Help: "The number of topics returned by the last topic stats poll of a broker",
+	}, []string{"broker"})
+	statsHistoryDroppedSeries = promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "burnell_stats_history_dropped_series_total",
+		Help: "The number of series dropped by the topic stats history over the maximum number of series",
+	}, func() float64 { return float64(TopicStatsHistory.DroppedSeries()) })
+)
+
+// TopicStatsCollector exports the fresh topic and subscription stats in the cache as Prometheus gauges,
+// either of a tenant or all the tenants if the tenant is empty
+type TopicStatsCollector struct {
+	Tenant string
+}
+
+var (
+	topicMetricLabels        = []string{"tenant", "namespace", "topic"}
+	subscriptionMetricLabels = []string{"tenant", "namespace", "topic", "subscription"}
+	topicMetricDescs         = make(map[string]*prometheus.Desc)
+	subscriptionMetricDescs  = make(map[string]*prometheus.Desc)
+)
+
+func init() {
+	for name := range topicStatsFieldIndex {
+		topicMetricDescs[name] = prometheus.NewDesc("burnell_topic_"+promMetricName(name),
+			"The cached topic stats "+name, topicMetricLabels, nil)
+	}
+	for name := range subscriptionFields {
+		subscriptionMetricDescs[name] = prometheus.NewDesc("burnell_subscription_"+promMetricName(name),
+			"The cached subscription stats "+name, subscriptionMetricLabels, nil)
+	}
+}
+
+// promMetricName converts a camel case field name to snake case
+func promMetricName(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Describe sends the descriptors of all the topic and subscription gauges
+func (c TopicStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, v := range topicMetricDescs {
+		ch <- v
+	}
+	for _, v := range subscriptionMetricDescs {
+		ch <- v
+	}
+}
+
+// Collect sends the gauges of the fresh topic stats
+func (c TopicStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	topics, err := freshTenantTopics(c.Tenant, time.Now())
+	if err != nil {
+		statsLog.Errorf("failed to read topic stats for metrics %v", err)
+		return
+	}
+	for _, ts := range topics {
+		for name, desc := range topicMetricDescs {
+			v, _ := ts.Fields.Value(name)
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, v, ts.Tenant, ts.Namespace, ts.ID)
+		}
+		for _, s := range ParseSubscriptionStats(ts) {
+			s = s.withTrend()
+			for name, desc := range subscriptionMetricDescs {
+				ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, subscriptionFields[name](s),
+					ts.Tenant, ts.Namespace, ts.ID, s.Subscription)
+			}
+		}
+	}
+}
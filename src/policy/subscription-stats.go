@@ -0,0 +1,316 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package policy
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/datastax/burnell/src/util"
+)
+
+// SubscriptionTrend is the backlog trend of a subscription derived from the successive polls
+type SubscriptionTrend struct {
+	Samples       int     `json:"samples"`
+	BacklogChange float64 `json:"backlogChange"` // the backlog change from the oldest to the newest sample
+	BacklogRate   float64 `json:"backlogRate"`   // the backlog change per second
+	Direction     string  `json:"direction"`     // growing, draining or steady
+}
+
+// SubscriptionStats is a subscription of a topic with its lag and consumers
+type SubscriptionStats struct {
+	Topic            string            `json:"topic"`
+	Namespace        string            `json:"namespace"`
+	Subscription     string            `json:"subscription"`
+	Type             string            `json:"type"`
+	MsgBacklog       float64           `json:"msgBacklog"`
+	UnackedMessages  float64           `json:"unackedMessages"`
+	MsgRateOut       float64           `json:"msgRateOut"`
+	MsgRateRedeliver float64           `json:"msgRateRedeliver"`
+	ConsumerCount    int               `json:"consumerCount"`
+	ClientAddresses  []string          `json:"clientAddresses"`
+	Trend            SubscriptionTrend `json:"trend"`
+}
+
+// SubscriptionQuery is the filter, sort and pagination criteria of subscriptions
+type SubscriptionQuery struct {
+	Namespace  string // either the namespace name or tenant/namespace
+	Topic      string // the topic fullname
+	NameGlob   string // matches the subscription name
+	Type       string
+	SortBy     string // subscription name by default, or any numeric field
+	Descending bool
+	Min        map[string]float64 // inclusive lower thresholds by field
+	Max        map[string]float64 // inclusive upper thresholds by field
+	Offset     int
+	Limit      int // 0 returns all the subscriptions after the offset
+}
+
+// SubscriptionList is the paginated list of subscriptions
+type SubscriptionList struct {
+	Total  int                 `json:"total"`
+	Offset int                 `json:"offset"`
+	Data   []SubscriptionStats `json:"data"`
+}
+
+var subscriptionFields = map[string]func(s SubscriptionStats) float64{
+	"msgBacklog":       func(s SubscriptionStats) float64 { return s.MsgBacklog },
+	"unackedMessages":  func(s SubscriptionStats) float64 { return s.UnackedMessages },
+	"msgRateOut":       func(s SubscriptionStats) float64 { return s.MsgRateOut },
+	"msgRateRedeliver": func(s SubscriptionStats) float64 { return s.MsgRateRedeliver },
+	"consumerCount":    func(s SubscriptionStats) float64 { return float64(s.ConsumerCount) },
+	"backlogRate":      func(s SubscriptionStats) float64 { return s.Trend.BacklogRate },
+}
+
+type subscriptionKey struct {
+	topic        string
+	subscription string
+}
+
+type backlogSample struct {
+	at      time.Time
+	backlog float64
+}
+
+// the recent backlog samples of every subscription to derive the trend
+var (
+	subscriptionSamples     = make(map[subscriptionKey][]backlogSample)
+	subscriptionSamplesLock = sync.RWMutex{}
+)
+
+// the number of successive polls the trend is derived from
+var subscriptionTrendSamples = util.GetEnvInt("SubscriptionTrendSamples", 10)
+
+// ParseSubscriptionStats parses the subscriptions from a topic stats document
+func ParseSubscriptionStats(ts *TopicStats) []SubscriptionStats {
+	data, ok := ts.Data.(map[string]interface{})
+	if !ok {
+		return []SubscriptionStats{}
+	}
+	subs, _ := data["subscriptions"].(map[string]interface{})
+	result := make([]SubscriptionStats, 0, len(subs))
+	for name, v := range subs {
+		sub, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		stats := SubscriptionStats{
+			Topic:           ts.ID,
+			Namespace:       ts.Namespace,
+			Subscription:    name,
+			ClientAddresses: []string{},
+		}
+		stats.Type, _ = sub["type"].(string)
+		stats.MsgBacklog, _ = sub["msgBacklog"].(float64)
+		stats.UnackedMessages, _ = sub["unackedMessages"].(float64)
+		stats.MsgRateOut, _ = sub["msgRateOut"].(float64)
+		stats.MsgRateRedeliver, _ = sub["msgRateRedeliver"].(float64)
+		consumers, _ := sub["consumers"].([]interface{})
+		stats.ConsumerCount = len(consumers)
+		for _, c := range consumers {
+			if consumer, ok := c.(map[string]interface{}); ok {
+				if address, ok := consumer["address"].(string); ok && address != "" {
+					stats.ClientAddresses = append(stats.ClientAddresses, address)
+				}
+			}
+		}
+		sort.Strings(stats.ClientAddresses)
+		result = append(result, stats)
+	}
+	return result
+}
+
+// freshSubscriptions returns the subscriptions of the fresh topic stats in the cache, of all the tenants if the tenant is empty
+func freshSubscriptions(tenant string, now time.Time) ([]SubscriptionStats, error) {
+	topics, err := freshTenantTopics(tenant, now)
+	if err != nil {
+		return nil, err
+	}
+	subs := []SubscriptionStats{}
+	for _, p := range topics {
+		subs = append(subs, ParseSubscriptionStats(p)...)
+	}
+	return subs, nil
+}
+
+// RecordSubscriptionTrends samples the backlog of every subscription in the cache,
+// the samples of the subscriptions no longer in the cache are dropped
+func RecordSubscriptionTrends(now time.Time) {
+	subs, err := freshSubscriptions("", now)
+	if err != nil {
+		statsLog.Errorf("failed to read topic stats for subscription trends %v", err)
+		return
+	}
+	subscriptionSamplesLock.Lock()
+	defer subscriptionSamplesLock.Unlock()
+	seen := make(map[subscriptionKey]bool)
+	for _, s := range subs {
+		key := subscriptionKey{topic: s.Topic, subscription: s.Subscription}
+		seen[key] = true
+		samples := append(subscriptionSamples[key], backlogSample{at: now, backlog: s.MsgBacklog})
+		if len(samples) > subscriptionTrendSamples {
+			samples = append([]backlogSample{}, samples[len(samples)-subscriptionTrendSamples:]...)
+		}
+		subscriptionSamples[key] = samples
+	}
+	for k := range subscriptionSamples {
+		if !seen[k] {
+			delete(subscriptionSamples, k)
+		}
+	}
+}
+
+// subscriptionTrend derives the trend from the samples, the caller must hold the lock
+func subscriptionTrend(key subscriptionKey) SubscriptionTrend {
+	samples := subscriptionSamples[key]
+	trend := SubscriptionTrend{Samples: len(samples), Direction: "steady"}
+	if len(samples) < 2 {
+		return trend
+	}
+	first, last := samples[0], samples[len(samples)-1]
+	trend.BacklogChange = last.backlog - first.backlog
+	if seconds := last.at.Sub(first.at).Seconds(); seconds > 0 {
+		trend.BacklogRate = trend.BacklogChange / seconds
+	}
+	if trend.BacklogChange > 0 {
+		trend.Direction = "growing"
+	} else if trend.BacklogChange < 0 {
+		trend.Direction = "draining"
+	}
+	return trend
+}
+
+// withTrend returns the subscription with the trend derived from the recent samples
+func (s SubscriptionStats) withTrend() SubscriptionStats {
+	subscriptionSamplesLock.RLock()
+	defer subscriptionSamplesLock.RUnlock()
+	s.Trend = subscriptionTrend(subscriptionKey{topic: s.Topic, subscription: s.Subscription})
+	return s
+}
+
+// Validate verifies the sort, threshold and glob attributes of the query
+func (q SubscriptionQuery) Validate() error {
+	if q.Offset < 0 || q.Limit < 0 {
+		return fmt.Errorf("offset or limit cannot be negative")
+	}
+	if q.SortBy != "" && q.SortBy != "name" {
+		if _, ok := subscriptionFields[q.SortBy]; !ok {
+			return fmt.Errorf("unsupported sort field %s", q.SortBy)
+		}
+	}
+	for _, thresholds := range []map[string]float64{q.Min, q.Max} {
+		for k := range thresholds {
+			if _, ok := subscriptionFields[k]; !ok {
+				return fmt.Errorf("unsupported threshold field %s", k)
+			}
+		}
+	}
+	if _, err := path.Match(q.NameGlob, ""); err != nil {
+		return fmt.Errorf("invalid subscription name pattern %s", q.NameGlob)
+	}
+	return nil
+}
+
+// Match evaluates if the subscription meets the namespace, topic, name pattern, type and thresholds
+func (q SubscriptionQuery) Match(tenant string, s SubscriptionStats) bool {
+	if q.Namespace != "" && q.Namespace != s.Namespace && tenant+"/"+q.Namespace != s.Namespace {
+		return false
+	}
+	if q.Topic != "" && q.Topic != s.Topic {
+		return false
+	}
+	if q.NameGlob != "" {
+		if ok, _ := path.Match(q.NameGlob, s.Subscription); !ok {
+			return false
+		}
+	}
+	if q.Type != "" && !strings.EqualFold(q.Type, s.Type) {
+		return false
+	}
+	for k, min := range q.Min {
+		if subscriptionFields[k](s) < min {
+			return false
+		}
+	}
+	for k, max := range q.Max {
+		if subscriptionFields[k](s) > max {
+			return false
+		}
+	}
+	return true
+}
+
+// QuerySubscriptions lists the tenant's subscriptions from the topic stats cache with the trends,
+// filtered, sorted and paginated by the query
+func QuerySubscriptions(tenant string, q SubscriptionQuery, now time.Time) (SubscriptionList, error) {
+	if err := q.Validate(); err != nil {
+		return SubscriptionList{}, err
+	}
+	subs, err := freshSubscriptions(tenant, now)
+	if err != nil {
+		return SubscriptionList{}, err
+	}
+
+	matched := []SubscriptionStats{}
+	subscriptionSamplesLock.RLock()
+	for _, s := range subs {
+		s.Trend = subscriptionTrend(subscriptionKey{topic: s.Topic, subscription: s.Subscription})
+		if q.Match(tenant, s) {
+			matched = append(matched, s)
+		}
+	}
+	subscriptionSamplesLock.RUnlock()
+
+	sort.SliceStable(matched, func(i, j int) bool {
+		a, b := matched[i], matched[j]
+		if q.Descending {
+			a, b = b, a
+		}
+		if q.SortBy != "" && q.SortBy != "name" {
+			if va, vb := subscriptionFields[q.SortBy](a), subscriptionFields[q.SortBy](b); va != vb {
+				return va < vb
+			}
+		}
+		if a.Topic != b.Topic {
+			return a.Topic < b.Topic
+		}
+		return a.Subscription < b.Subscription
+	})
+
+	total := len(matched)
+	if q.Offset > total {
+		return SubscriptionList{Total: total, Offset: total, Data: []SubscriptionStats{}}, nil
+	}
+	newOffset := q.Offset + q.Limit
+	if q.Limit == 0 || newOffset > total {
+		newOffset = total
+	}
+	return SubscriptionList{
+		Total:  total,
+		Offset: newOffset,
+		Data:   matched[q.Offset:newOffset],
+	}, nil
+}
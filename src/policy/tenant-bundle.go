@@ -0,0 +1,213 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/datastax/burnell/src/webhook"
+	"github.com/ghodss/yaml"
+)
+
+// TenantBundleVersion is the format version of the tenant bundle
+const TenantBundleVersion = 1
+
+// tenant bundle import modes
+const (
+	// MergeImport creates or updates the tenants in the bundle and leaves other tenants untouched
+	MergeImport = "merge"
+	// ReplaceImport also deletes the tenants not in the bundle
+	ReplaceImport = "replace"
+)
+
+// TenantBundle is the export of the tenant database for backup and migration between clusters
+type TenantBundle struct {
+	Version    int                    `json:"version"`
+	ExportedAt time.Time              `json:"exportedAt"`
+	Tenants    []TenantPlan           `json:"tenants"`
+	Webhooks   []webhook.Subscription `json:"webhooks,omitempty"`
+}
+
+// ImportError is the validation or update error of a tenant in the bundle
+type ImportError struct {
+	Tenant string `json:"tenant"`
+	Error  string `json:"error"`
+}
+
+// ImportResult is the outcome of a tenant bundle import
+type ImportResult struct {
+	Mode    string        `json:"mode"`
+	DryRun  bool          `json:"dryRun"`
+	Created []string      `json:"created"`
+	Updated []string      `json:"updated"`
+	Deleted []string      `json:"deleted"`
+	Errors  []ImportError `json:"errors"`
+	// the webhook subscriptions in the bundle, they are managed by WebhookConfigFile and not imported
+	SkippedWebhooks []string `json:"skippedWebhooks"`
+}
+
+// RedactedSecret replaces the webhook signing secrets in an export without the secrets
+const RedactedSecret = "redacted"
+
+// ExportTenants exports all the tenant plans in the database and the webhook subscriptions in the order of tenant name.
+// The webhook signing secrets are redacted unless includeSecrets is specified.
+func (s *TenantPolicyHandler) ExportTenants(includeSecrets bool) TenantBundle {
+	tenants := s.listStoredTenants()
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i].Name < tenants[j].Name })
+	webhooks := webhook.Manager.Subscriptions()
+	for i := range webhooks {
+		if !includeSecrets && webhooks[i].Secret != "" {
+			webhooks[i].Secret = RedactedSecret
+		}
+	}
+	return TenantBundle{
+		Version:    TenantBundleVersion,
+		ExportedAt: time.Now(),
+		Tenants:    tenants,
+		Webhooks:   webhooks,
+	}
+}
+
+// MarshalTenantBundle encodes the bundle in json or yaml format
+func MarshalTenantBundle(bundle TenantBundle, format string) ([]byte, error) {
+	switch strings.ToLower(format) {
+	case "", "json":
+		return json.MarshalIndent(bundle, "", "  ")
+	case "yaml", "yml":
+		return yaml.Marshal(bundle)
+	default:
+		return nil, fmt.Errorf("unsupported bundle format %s", format)
+	}
+}
+
+// UnmarshalTenantBundle decodes the bundle in either json or yaml format and verifies the format version
+func UnmarshalTenantBundle(data []byte) (TenantBundle, error) {
+	var bundle TenantBundle
+	if err := yaml.Unmarshal(data, &bundle); err != nil {
+		return TenantBundle{}, err
+	}
+	if bundle.Version < 1 || bundle.Version > TenantBundleVersion {
+		return TenantBundle{}, fmt.Errorf("unsupported tenant bundle version %d", bundle.Version)
+	}
+	return bundle, nil
+}
+
+// ValidateTenantBundle validates every tenant plan in the bundle against the existing plan the same way as an update
+func ValidateTenantBundle(bundle TenantBundle, existing map[string]TenantPlan) []ImportError {
+	errs := []ImportError{}
+	names := make(map[string]bool)
+	for _, v := range bundle.Tenants {
+		if v.Name == "" {
+			errs = append(errs, ImportError{Error: "tenant name is required"})
+			continue
+		}
+		if names[v.Name] {
+			errs = append(errs, ImportError{Tenant: v.Name, Error: "duplicate tenant in the bundle"})
+			continue
+		}
+		names[v.Name] = true
+		if _, err := ReconcileTenantPlan(importedPlan(v), existing[v.Name]); err != nil {
+			errs = append(errs, ImportError{Tenant: v.Name, Error: err.Error()})
+		}
+	}
+	if err := webhook.ValidateSubscriptions(bundle.Webhooks); err != nil {
+		errs = append(errs, ImportError{Error: err.Error()})
+	}
+	return errs
+}
+
+// importedPlan resets the attributes only the server can assign
+func importedPlan(plan TenantPlan) TenantPlan {
+	plan.Version = 0
+	plan.History = nil
+	plan.Audit = "imported from tenant bundle"
+	return plan
+}
+
+// ImportTenants imports the tenant plans through UpdateTenant with the actor recorded in the history.
+// Nothing is changed if any tenant in the bundle fails the validation. Dry run only reports the changes.
+// The webhook subscriptions are validated but skipped, since they are loaded from WebhookConfigFile by every instance.
+func (s *TenantPolicyHandler) ImportTenants(bundle TenantBundle, mode, actor string, dryRun bool) (ImportResult, error) {
+	if mode != MergeImport && mode != ReplaceImport {
+		return ImportResult{}, fmt.Errorf("unsupported import mode %s", mode)
+	}
+	result := ImportResult{
+		Mode:            mode,
+		DryRun:          dryRun,
+		Created:         []string{},
+		Updated:         []string{},
+		Deleted:         []string{},
+		SkippedWebhooks: []string{},
+	}
+	for _, v := range bundle.Webhooks {
+		result.SkippedWebhooks = append(result.SkippedWebhooks, v.ID)
+	}
+
+	// the free plans only cached on demand are not in the database, an import creates rather than deletes them
+	existing := make(map[string]TenantPlan)
+	for _, v := range s.listStoredTenants() {
+		existing[v.Name] = v
+	}
+	if result.Errors = ValidateTenantBundle(bundle, existing); len(result.Errors) > 0 {
+		return result, fmt.Errorf("%d errors in the tenant bundle", len(result.Errors))
+	}
+
+	imported := make(map[string]bool)
+	for _, v := range bundle.Tenants {
+		imported[v.Name] = true
+		if _, ok := existing[v.Name]; ok {
+			result.Updated = append(result.Updated, v.Name)
+		} else {
+			result.Created = append(result.Created, v.Name)
+		}
+	}
+	if mode == ReplaceImport {
+		for k := range existing {
+			if !imported[k] {
+				result.Deleted = append(result.Deleted, k)
+			}
+		}
+		sort.Strings(result.Deleted)
+	}
+	if dryRun {
+		return result, nil
+	}
+
+	for _, v := range bundle.Tenants {
+		if _, _, err := s.UpdateTenant(v.Name, importedPlan(v), actor, AnyVersion); err != nil {
+			result.Errors = append(result.Errors, ImportError{Tenant: v.Name, Error: err.Error()})
+		}
+	}
+	for _, v := range result.Deleted {
+		if _, err := s.DeleteTenant(v, actor); err != nil {
+			result.Errors = append(result.Errors, ImportError{Tenant: v, Error: err.Error()})
+		}
+	}
+	if len(result.Errors) > 0 {
+		return result, fmt.Errorf("failed to import %d tenants", len(result.Errors))
+	}
+	return result, nil
+}
@@ -0,0 +1,71 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package policy
+
+import (
+	"github.com/datastax/burnell/src/webhook"
+)
+
+// TenantEventData is the payload of the tenant webhook events
+type TenantEventData struct {
+	PlanType     string       `json:"planType"`
+	PrevPlanType string       `json:"prevPlanType"`
+	TenantStatus TenantStatus `json:"tenantStatus"`
+	PrevStatus   TenantStatus `json:"prevStatus"`
+	Version      int64        `json:"version"`
+	Actor        string       `json:"actor"`
+	Reason       string       `json:"reason"`
+}
+
+// TenantChangeEvents returns the webhook event types of the change from the existing plan to the new plan
+func TenantChangeEvents(existingPlan, newPlan TenantPlan) []string {
+	if newPlan.TenantStatus == Deleted {
+		return []string{webhook.TenantDeleted}
+	}
+	if existingPlan.Name == "" {
+		return []string{webhook.TenantCreated}
+	}
+	events := []string{}
+	if existingPlan.PlanType != newPlan.PlanType {
+		events = append(events, webhook.TenantPlanChanged)
+	}
+	if existingPlan.TenantStatus != Suspended && newPlan.TenantStatus == Suspended {
+		events = append(events, webhook.TenantSuspended)
+	}
+	return events
+}
+
+// publishTenantEvents notifies the webhook subscriptions of the tenant plan change
+func publishTenantEvents(existingPlan, newPlan TenantPlan, actor string) {
+	data := TenantEventData{
+		PlanType:     newPlan.PlanType,
+		PrevPlanType: existingPlan.PlanType,
+		TenantStatus: newPlan.TenantStatus,
+		PrevStatus:   existingPlan.TenantStatus,
+		Version:      newPlan.Version,
+		Actor:        actor,
+		Reason:       newPlan.Audit,
+	}
+	for _, v := range TenantChangeEvents(existingPlan, newPlan) {
+		webhook.Manager.Publish(webhook.NewEvent(v, newPlan.Name, data))
+	}
+}
@@ -0,0 +1,227 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package policy
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TenantQuery is the filter, sort and pagination criteria to list tenants
+type TenantQuery struct {
+	PlanType     string
+	Status       TenantStatus // Reserved0 matches any status
+	Org          string
+	FeatureCode  string
+	UpdatedSince time.Time
+	SortBy       string
+	Descending   bool
+	Offset       int
+	Limit        int // 0 returns all the tenants after the offset
+}
+
+// TenantList is the paginated list of tenants
+type TenantList struct {
+	Total  int          `json:"total"`
+	Offset int          `json:"offset"`
+	Data   []TenantPlan `json:"data"`
+}
+
+var tenantStatusNames = map[TenantStatus]string{
+	Reserved0:   "none",
+	Activated:   "activated",
+	Deactivated: "deactivated",
+	Suspended:   "suspended",
+	Deleted:     "deleted",
+}
+
+// String returns the name of tenant status
+func (s TenantStatus) String() string {
+	if name, ok := tenantStatusNames[s]; ok {
+		return name
+	}
+	return strconv.Itoa(int(s))
+}
+
+// ParseTenantStatus parses tenant status either in the name or the numeric form
+func ParseTenantStatus(status string) (TenantStatus, error) {
+	status = strings.TrimSpace(strings.ToLower(status))
+	for k, v := range tenantStatusNames {
+		if k != Reserved0 && (v == status || strconv.Itoa(int(k)) == status) {
+			return k, nil
+		}
+	}
+	return Reserved0, fmt.Errorf("invalid tenant status %s", status)
+}
+
+// ListTenants returns all the tenant plans in the database
+func (s *TenantPolicyHandler) ListTenants() []TenantPlan {
+	s.tenantsLock.RLock()
+	defer s.tenantsLock.RUnlock()
+	plans := make([]TenantPlan, 0, len(s.tenants))
+	for _, v := range s.tenants {
+		plans = append(plans, v)
+	}
+	return plans
+}
+
+// listStoredTenants lists the tenant plans in the database, leaving out the free plans only cached on demand
+func (s *TenantPolicyHandler) listStoredTenants() []TenantPlan {
+	s.tenantsLock.RLock()
+	defer s.tenantsLock.RUnlock()
+	plans := make([]TenantPlan, 0, len(s.tenants))
+	for k, v := range s.tenants {
+		if !s.cacheOnly[k] {
+			plans = append(plans, v)
+		}
+	}
+	return plans
+}
+
+// MergeTenants merges tenant plans with the tenants known to Pulsar.
+// A Pulsar tenant without a plan record is listed with an empty plan type and status.
+func MergeTenants(plans []TenantPlan, pulsarTenants []string) []TenantPlan {
+	names := make(map[string]bool)
+	merged := make([]TenantPlan, 0, len(plans)+len(pulsarTenants))
+	for _, v := range plans {
+		names[v.Name] = true
+		merged = append(merged, v)
+	}
+	for _, v := range pulsarTenants {
+		if !names[v] {
+			names[v] = true
+			merged = append(merged, TenantPlan{Name: v})
+		}
+	}
+	return merged
+}
+
+// QueryTenants filters, sorts and paginates tenants. The plan history is omitted from the list.
+func QueryTenants(tenants []TenantPlan, q TenantQuery) (TenantList, error) {
+	if q.Offset < 0 || q.Limit < 0 {
+		return TenantList{}, fmt.Errorf("offset or limit cannot be negative")
+	}
+	less, err := tenantSortFunc(q.SortBy)
+	if err != nil {
+		return TenantList{}, err
+	}
+
+	matched := []TenantPlan{}
+	for _, t := range tenants {
+		if q.PlanType != "" && !strings.EqualFold(q.PlanType, t.PlanType) {
+			continue
+		}
+		if q.Status != Reserved0 && q.Status != t.TenantStatus {
+			continue
+		}
+		if q.Org != "" && q.Org != t.Org {
+			continue
+		}
+		if q.FeatureCode != "" && !IsFeatureSupported(q.FeatureCode, t.Policy.FeatureCodes) {
+			continue
+		}
+		if !q.UpdatedSince.IsZero() && t.UpdatedAt.Before(q.UpdatedSince) {
+			continue
+		}
+		t.History = nil
+		matched = append(matched, t)
+	}
+
+	sort.SliceStable(matched, func(i, j int) bool {
+		if q.Descending {
+			return less(matched[j], matched[i])
+		}
+		return less(matched[i], matched[j])
+	})
+
+	total := len(matched)
+	if q.Offset > total {
+		return TenantList{Total: total, Offset: total, Data: []TenantPlan{}}, nil
+	}
+	newOffset := q.Offset + q.Limit
+	if q.Limit == 0 || newOffset > total {
+		newOffset = total
+	}
+	return TenantList{
+		Total:  total,
+		Offset: newOffset,
+		Data:   matched[q.Offset:newOffset],
+	}, nil
+}
+
+func tenantSortFunc(sortBy string) (func(a, b TenantPlan) bool, error) {
+	switch sortBy {
+	case "", "name":
+		return func(a, b TenantPlan) bool { return a.Name < b.Name }, nil
+	case "planType":
+		return func(a, b TenantPlan) bool { return a.PlanType < b.PlanType }, nil
+	case "tenantStatus":
+		return func(a, b TenantPlan) bool { return a.TenantStatus < b.TenantStatus }, nil
+	case "org":
+		return func(a, b TenantPlan) bool { return a.Org < b.Org }, nil
+	case "updatedAt":
+		return func(a, b TenantPlan) bool { return a.UpdatedAt.Before(b.UpdatedAt) }, nil
+	default:
+		return nil, fmt.Errorf("unsupported sort attribute %s", sortBy)
+	}
+}
+
+// WriteTenantsCSV writes tenant plans in CSV format with a header line
+func WriteTenantsCSV(w io.Writer, tenants []TenantPlan) error {
+	writer := csv.NewWriter(w)
+	header := []string{"name", "planType", "tenantStatus", "org", "users", "updatedAt", "numOfTopics", "numOfNamespaces",
+		"messageHourRetention", "numOfProducers", "numOfConsumers", "functions", "featureCodes"}
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+	for _, t := range tenants {
+		updatedAt := ""
+		if !t.UpdatedAt.IsZero() {
+			updatedAt = t.UpdatedAt.Format(time.RFC3339)
+		}
+		record := []string{
+			t.Name,
+			t.PlanType,
+			t.TenantStatus.String(),
+			t.Org,
+			t.Users,
+			updatedAt,
+			strconv.Itoa(t.Policy.NumOfTopics),
+			strconv.Itoa(t.Policy.NumOfNamespaces),
+			strconv.Itoa(t.Policy.MessageHourRetention),
+			strconv.Itoa(t.Policy.NumOfProducers),
+			strconv.Itoa(t.Policy.NumOfConsumers),
+			strconv.Itoa(t.Policy.Functions),
+			t.Policy.FeatureCodes,
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
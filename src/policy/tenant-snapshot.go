@@ -0,0 +1,110 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package policy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// TenantSnapshot is a point in time copy of the tenant database and the position in the topic it was taken at
+type TenantSnapshot struct {
+	MessageID []byte                `json:"messageId"`
+	Tenants   map[string]TenantPlan `json:"tenants"`
+	Versions  map[string]int64      `json:"versions"`
+	CreatedAt time.Time             `json:"createdAt"`
+	Checksum  string                `json:"checksum"`
+}
+
+// checksum computes sha256 over the snapshot content excluding the checksum itself
+func (ts TenantSnapshot) checksum() (string, error) {
+	ts.Checksum = ""
+	data, err := json.Marshal(ts)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// WriteTenantSnapshot writes the snapshot with its checksum to the file.
+// The file is replaced atomically so a crash cannot leave a partial snapshot behind.
+func WriteTenantSnapshot(filePath string, snapshot TenantSnapshot) error {
+	var err error
+	if snapshot.Checksum, err = snapshot.checksum(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(filePath), filepath.Base(filePath)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err = tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err = tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err = tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), filePath)
+}
+
+// ReadTenantSnapshot reads a snapshot from the file and verifies its checksum
+func ReadTenantSnapshot(filePath string) (TenantSnapshot, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return TenantSnapshot{}, err
+	}
+	var snapshot TenantSnapshot
+	if err = json.Unmarshal(data, &snapshot); err != nil {
+		return TenantSnapshot{}, err
+	}
+	sum, err := snapshot.checksum()
+	if err != nil {
+		return TenantSnapshot{}, err
+	}
+	if sum != snapshot.Checksum {
+		return TenantSnapshot{}, fmt.Errorf("tenant snapshot %s checksum mismatch", filePath)
+	}
+	if snapshot.Tenants == nil {
+		snapshot.Tenants = make(map[string]TenantPlan)
+	}
+	if snapshot.Versions == nil {
+		snapshot.Versions = make(map[string]int64)
+	}
+	return snapshot, nil
+}
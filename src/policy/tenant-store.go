@@ -0,0 +1,117 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/datastax/burnell/src/util"
+)
+
+// ErrTenantNotFound is returned when the tenant does not exist in the store
+var ErrTenantNotFound = errors.New("tenant not found in database")
+
+// tenant store types
+const (
+	PulsarStore    = "pulsar"
+	ZookeeperStore = "zookeeper"
+	RestStore      = "rest"
+)
+
+// TenantStore is the storage backend of tenant plans
+type TenantStore interface {
+	Conn(hosts string) error
+	Get(tenantName string) (TenantPlan, error)
+	List() ([]TenantPlan, error)
+	Update(tenantPlan TenantPlan) error
+	// Delete removes the tenant, the plan is the final record with the Deleted status
+	Delete(tenantPlan TenantPlan) error
+	// Watch delivers all the existing tenant records and then every change asynchronously.
+	// A deleted tenant is delivered with the Deleted status. onReady is called once the existing records are delivered.
+	Watch(onChange func(TenantPlan), onReady func()) error
+	Close() error
+}
+
+// ResumableTenantStore is a tenant store that can resume watching from a saved position
+type ResumableTenantStore interface {
+	TenantStore
+	// Position returns the position of the last delivered change
+	Position() []byte
+	// Resume sets the position where the next Watch starts after
+	Resume(position []byte) error
+}
+
+// ConditionalTenantStore is a tenant store that updates a tenant only if the stored plan is still at the version
+// the update is based on, so that concurrent updates from multiple instances do not overwrite each other
+type ConditionalTenantStore interface {
+	TenantStore
+	// UpdateIfVersion updates the tenant plan if the stored plan's version is the expected version,
+	// otherwise it returns ErrVersionConflict. The version of a tenant that does not exist is 0.
+	UpdateIfVersion(tenantPlan TenantPlan, expectedVersion int64) error
+}
+
+// ConnectTenantStore creates and connects the tenant store configured by TenantStoreType, the Pulsar topic is the default store
+func ConnectTenantStore() (TenantStore, error) {
+	config := util.GetConfig()
+	var store TenantStore
+	hosts := config.TenantStoreURL
+	switch strings.ToLower(config.TenantStoreType) {
+	case "", PulsarStore:
+		topicName := util.AssignString(config.TenantManagmentTopic, "persistent://public/default/tenants-management")
+		store = NewPulsarTopicDriver(topicName, config.PulsarToken, config.TrustStore)
+		hosts = util.AssignString(hosts, config.PulsarURL)
+	case ZookeeperStore:
+		store = &ZookeeperDriver{RootPath: util.AssignString(config.TenantStorePath, "/burnell/tenants")}
+	case RestStore:
+		store = &RestClient{Token: config.TenantStoreToken}
+	default:
+		return nil, fmt.Errorf("unsupported tenant store type %s", config.TenantStoreType)
+	}
+
+	if err := store.Conn(hosts); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// getStorePlanPolicy returns the tenant's plan policy from the store or an empty policy if the tenant does not exist
+func getStorePlanPolicy(store TenantStore, tenantName string) PlanPolicy {
+	t, err := store.Get(tenantName)
+	if err != nil {
+		return PlanPolicy{}
+	}
+	return t.Policy
+}
+
+// evaluateStoreTenant evaluates the tenant exists and is activated in the store
+func evaluateStoreTenant(store TenantStore, tenantName string) error {
+	t, err := store.Get(tenantName)
+	if err != nil {
+		return err
+	}
+	if t.TenantStatus != Activated {
+		return fmt.Errorf("tenant %s is %s", tenantName, t.TenantStatus)
+	}
+	return nil
+}
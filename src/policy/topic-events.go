@@ -0,0 +1,286 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/datastax/burnell/src/util"
+)
+
+// topic lifecycle event types
+const (
+	TopicCreated        = "topic.created"
+	TopicDeleted        = "topic.deleted"
+	SubscriptionCreated = "subscription.created"
+	SubscriptionDeleted = "subscription.deleted"
+	ProducersChanged    = "producers.changed"
+	ConsumersChanged    = "consumers.changed"
+)
+
+// TopicEvent is a change between two successive polls of the topic stats
+type TopicEvent struct {
+	Seq          int64     `json:"seq"`
+	Type         string    `json:"type"`
+	Tenant       string    `json:"tenant"`
+	Namespace    string    `json:"namespace"`
+	Topic        string    `json:"topic"`
+	Subscription string    `json:"subscription,omitempty"`
+	Producers    int       `json:"producers"`       // the producer count after the change
+	Consumers    int       `json:"consumers"`       // the consumer count after the change
+	Delta        int       `json:"delta,omitempty"` // the change of the producer or consumer count
+	Timestamp    time.Time `json:"timestamp"`
+}
+
+// TopicEventList is a page of the tenant event feed, next is the sequence to resume from
+type TopicEventList struct {
+	Tenant string       `json:"tenant"`
+	Next   int64        `json:"next"`
+	Events []TopicEvent `json:"events"`
+}
+
+// topicSnapshot is the state of a topic compared between polls
+type topicSnapshot struct {
+	tenant        string
+	namespace     string
+	broker        string
+	producers     int
+	consumers     int
+	subscriptions map[string]bool
+}
+
+var (
+	// the snapshots of the last poll, nil until the first poll so that it does not report every topic as created
+	topicSnapshots map[string]topicSnapshot
+	// seeded from the boot time in microseconds so that the sequences keep increasing across restarts
+	// and a client resuming from a sequence of the previous process does not skip the new events
+	topicEventSeq  = time.Now().UnixNano() / int64(time.Microsecond)
+	topicEventFeed = make(map[string][]TopicEvent)
+	topicEventLock = sync.RWMutex{}
+
+	// the maximum number of events kept per tenant
+	topicEventFeedSize = util.GetEnvInt("TopicEventFeedSize", 1000)
+
+	topicEventProducer pulsar.Producer
+)
+
+// SetupTopicEventPublisher creates the producer to publish the topic events to the Pulsar topic
+func SetupTopicEventPublisher(topicName string) error {
+	client, err := NewPulsarClient(util.GetConfig().PulsarURL, util.GetConfig().PulsarToken, util.GetConfig().TrustStore)
+	if err != nil {
+		return err
+	}
+	producer, err := client.CreateProducer(pulsar.ProducerOptions{Topic: topicName})
+	if err != nil {
+		client.Close()
+		return err
+	}
+	topicEventLock.Lock()
+	topicEventProducer = producer
+	topicEventLock.Unlock()
+	return nil
+}
+
+// snapshotTopics builds the snapshots of the fresh topics in the cache
+func snapshotTopics(now time.Time) (map[string]topicSnapshot, error) {
+	topics, err := freshTopics(now)
+	if err != nil {
+		return nil, err
+	}
+	snapshots := make(map[string]topicSnapshot)
+	for _, p := range topics {
+		producers, consumers := CountTopicClients(p.Data)
+		snapshot := topicSnapshot{
+			tenant:        p.Tenant,
+			namespace:     p.Namespace,
+			broker:        p.Broker,
+			producers:     producers,
+			consumers:     consumers,
+			subscriptions: make(map[string]bool),
+		}
+		if data, ok := p.Data.(map[string]interface{}); ok {
+			if subs, ok := data["subscriptions"].(map[string]interface{}); ok {
+				for k := range subs {
+					snapshot.subscriptions[k] = true
+				}
+			}
+		}
+		snapshots[p.ID] = snapshot
+	}
+	return snapshots, nil
+}
+
+// diffTopicSnapshots returns the events from the previous to the current snapshots ordered by topic
+func diffTopicSnapshots(prev, current map[string]topicSnapshot, now time.Time) []TopicEvent {
+	events := []TopicEvent{}
+	event := func(eventType, topic, subscription string, s topicSnapshot, delta int) {
+		events = append(events, TopicEvent{
+			Type:         eventType,
+			Tenant:       s.tenant,
+			Namespace:    s.namespace,
+			Topic:        topic,
+			Subscription: subscription,
+			Producers:    s.producers,
+			Consumers:    s.consumers,
+			Delta:        delta,
+			Timestamp:    now,
+		})
+	}
+
+	topics := []string{}
+	for k := range current {
+		topics = append(topics, k)
+	}
+	for k := range prev {
+		if _, ok := current[k]; !ok {
+			topics = append(topics, k)
+		}
+	}
+	sort.Strings(topics)
+
+	for _, topic := range topics {
+		before, existed := prev[topic]
+		after, exists := current[topic]
+		switch {
+		case !exists:
+			event(TopicDeleted, topic, "", before, 0)
+			continue
+		case !existed:
+			event(TopicCreated, topic, "", after, 0)
+			before = topicSnapshot{subscriptions: map[string]bool{}}
+		default:
+			if delta := after.producers - before.producers; delta != 0 {
+				event(ProducersChanged, topic, "", after, delta)
+			}
+			if delta := after.consumers - before.consumers; delta != 0 {
+				event(ConsumersChanged, topic, "", after, delta)
+			}
+		}
+		for _, sub := range sortedKeys(after.subscriptions) {
+			if !before.subscriptions[sub] {
+				event(SubscriptionCreated, topic, sub, after, 0)
+			}
+		}
+		for _, sub := range sortedKeys(before.subscriptions) {
+			if !after.subscriptions[sub] {
+				event(SubscriptionDeleted, topic, sub, after, 0)
+			}
+		}
+	}
+	return events
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// RecordTopicEvents diffs the topic stats cache against the last poll, appends the events to the tenant feeds
+// and publishes them to the topic events Pulsar topic if it is configured. A topic missing from the cache is
+// only deleted if its broker is in the polled brokers, otherwise its last snapshot is kept until the broker is polled.
+func RecordTopicEvents(now time.Time, polled map[string]bool) []TopicEvent {
+	current, err := snapshotTopics(now)
+	if err != nil {
+		statsLog.Errorf("failed to read topic stats for topic events %v", err)
+		return nil
+	}
+
+	topicEventLock.Lock()
+	if topicSnapshots == nil {
+		topicSnapshots = current
+		topicEventLock.Unlock()
+		return nil
+	}
+	for k, v := range topicSnapshots {
+		if _, ok := current[k]; !ok && !polled[v.broker] {
+			current[k] = v
+		}
+	}
+	events := diffTopicSnapshots(topicSnapshots, current, now)
+	topicSnapshots = current
+	for i := range events {
+		topicEventSeq++
+		events[i].Seq = topicEventSeq
+		feed := append(topicEventFeed[events[i].Tenant], events[i])
+		if len(feed) > topicEventFeedSize {
+			feed = append([]TopicEvent{}, feed[len(feed)-topicEventFeedSize:]...)
+		}
+		topicEventFeed[events[i].Tenant] = feed
+	}
+	producer := topicEventProducer
+	topicEventLock.Unlock()
+
+	// the producer may block on a full queue so the events are sent without holding the lock
+	if producer != nil {
+		for _, e := range events {
+			publishTopicEvent(producer, e)
+		}
+	}
+	return events
+}
+
+// publishTopicEvent sends the event keyed by the tenant asynchronously
+func publishTopicEvent(producer pulsar.Producer, event TopicEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		statsLog.Errorf("failed to marshal topic event %v", err)
+		return
+	}
+	producer.SendAsync(context.Background(), &pulsar.ProducerMessage{
+		Payload: data,
+		Key:     event.Tenant,
+	}, func(_ pulsar.MessageID, _ *pulsar.ProducerMessage, err error) {
+		if err != nil {
+			statsLog.Errorf("failed to publish topic event %s %s %v", event.Type, event.Topic, err)
+		}
+	})
+}
+
+// TopicEvents returns up to the limit of the tenant's events after the sequence, filtered by the event types.
+// Limit 0 returns all the events.
+func TopicEvents(tenant string, after int64, types []string, limit int) TopicEventList {
+	topicEventLock.RLock()
+	defer topicEventLock.RUnlock()
+	list := TopicEventList{Tenant: tenant, Next: after, Events: []TopicEvent{}}
+	for _, e := range topicEventFeed[tenant] {
+		if e.Seq <= after {
+			continue
+		}
+		if limit > 0 && len(list.Events) >= limit {
+			break
+		}
+		list.Next = e.Seq
+		if len(types) == 0 || util.StrContains(types, e.Type) {
+			list.Events = append(list.Events, e)
+		}
+	}
+	return list
+}
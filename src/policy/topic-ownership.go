@@ -0,0 +1,194 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/datastax/burnell/src/util"
+)
+
+// ownership sources
+const (
+	OwnershipFromStats  = "stats"
+	OwnershipFromLookup = "lookup"
+)
+
+// TopicOwnership is the broker and the bundle range owning a topic
+type TopicOwnership struct {
+	Topic     string `json:"topic"`
+	Namespace string `json:"namespace"`
+	Broker    string `json:"broker"`
+	Bundle    string `json:"bundle"`
+	Source    string `json:"source"` // stats or lookup
+	Error     string `json:"error,omitempty"`
+}
+
+// lookupData is the response of the topic lookup API
+type lookupData struct {
+	BrokerURL    string `json:"brokerUrl"`
+	BrokerURLTLS string `json:"brokerUrlTls"`
+	HTTPURL      string `json:"httpUrl"`
+	HTTPURLTLS   string `json:"httpUrlTls"`
+}
+
+// the maximum number of topics requested by name in a query
+var maxOwnershipTopics = util.GetEnvInt("TopicOwnershipMaxTopics", 100)
+
+// TenantTopicOwnership returns the owner of the tenant's topics in the cache, filtered by the namespace, from the
+// broker and the bundle the topic stats were polled from. The requested topics not in the cache and the cached
+// topics without the owner are resolved by the lookup API with a bounded number of workers within an overall deadline.
+func TenantTopicOwnership(tenant, namespace string, topics []string, now time.Time) ([]TopicOwnership, error) {
+	if len(topics) > maxOwnershipTopics {
+		return nil, fmt.Errorf("at most %d topics can be requested", maxOwnershipTopics)
+	}
+	inNamespace := func(ns string) bool {
+		return namespace == "" || namespace == ns || tenant+"/"+namespace == ns
+	}
+	owners := make(map[string]TopicOwnership)
+	lookups := []TopicOwnership{}
+	for _, v := range topics {
+		t, ns, _, err := util.ExtractPartsFromTopicFn(v)
+		if err != nil {
+			return nil, err
+		}
+		if t != tenant {
+			return nil, fmt.Errorf("topic %s does not belong to tenant %s", v, tenant)
+		}
+		if inNamespace(t + "/" + ns) {
+			lookups = append(lookups, TopicOwnership{Topic: v, Namespace: t + "/" + ns})
+		}
+	}
+
+	cached, err := freshTenantTopics(tenant, now)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range cached {
+		if !inNamespace(p.Namespace) {
+			continue
+		}
+		owner := TopicOwnership{Topic: p.ID, Namespace: p.Namespace, Broker: p.Broker, Bundle: p.Bundle, Source: OwnershipFromStats}
+		if owner.Broker == "" || owner.Bundle == "" {
+			lookups = append(lookups, owner)
+			continue
+		}
+		owners[p.ID] = owner
+	}
+
+	pending := []TopicOwnership{}
+	for _, v := range lookups {
+		if _, ok := owners[v.Topic]; !ok {
+			// a placeholder to skip the duplicates, replaced by the lookup result
+			owners[v.Topic] = v
+			pending = append(pending, v)
+		}
+	}
+	for _, v := range lookupTopicsOwnership(pending, statsPollConcurrency, statsBrokerTimeout) {
+		owners[v.Topic] = v
+	}
+
+	ownership := make([]TopicOwnership, 0, len(owners))
+	for _, v := range owners {
+		ownership = append(ownership, v)
+	}
+	sort.Slice(ownership, func(i, j int) bool { return ownership[i].Topic < ownership[j].Topic })
+	return ownership, nil
+}
+
+// lookupTopicsOwnership resolves the topics by the lookup API with a bounded number of workers,
+// the topics not resolved by the deadline are returned with the error
+func lookupTopicsOwnership(topics []TopicOwnership, concurrency int, timeout time.Duration) []TopicOwnership {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	result := make([]TopicOwnership, len(topics))
+	var wg sync.WaitGroup
+	indexChan := make(chan int)
+	for i := 0; i < concurrency && i < len(topics); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexChan {
+				result[index] = lookupTopicOwnership(ctx, topics[index])
+			}
+		}()
+	}
+	for i := range topics {
+		indexChan <- i
+	}
+	close(indexChan)
+	wg.Wait()
+	return result
+}
+
+// lookupTopicOwnership resolves the owner broker and the bundle range of the topic by the lookup API
+func lookupTopicOwnership(ctx context.Context, owner TopicOwnership) TopicOwnership {
+	owner.Source = OwnershipFromLookup
+	if err := ctx.Err(); err != nil {
+		owner.Error = err.Error()
+		return owner
+	}
+	topicType := util.ConditionAssign(util.IsPersistentTopic(owner.Topic), "persistent/", "non-persistent/")
+	tenant, ns, topic, _ := util.ExtractPartsFromTopicFn(owner.Topic)
+	route := "lookup/v2/topic/" + topicType + tenant + "/" + ns + "/" + topic
+
+	lookup := lookupData{}
+	if err := brokerGetJSON(ctx, util.Config.BrokerProxyURL, route, &lookup); err != nil {
+		owner.Error = err.Error()
+		return owner
+	}
+	owner.Broker = lookupBrokerName(lookup)
+
+	body, err := brokerGet(ctx, util.Config.BrokerProxyURL, route+"/bundle")
+	if err != nil {
+		owner.Error = err.Error()
+		return owner
+	}
+	// the bundle range may be either a JSON string or plain text
+	if err = json.Unmarshal(body, &owner.Bundle); err != nil {
+		owner.Bundle = strings.TrimSpace(string(body))
+	}
+	return owner
+}
+
+// lookupBrokerName returns the broker in the host:port form used by the broker list
+func lookupBrokerName(lookup lookupData) string {
+	for _, v := range []string{lookup.HTTPURL, lookup.HTTPURLTLS, lookup.BrokerURL, lookup.BrokerURLTLS} {
+		if v != "" {
+			if parts := strings.SplitN(v, "://", 2); len(parts) == 2 {
+				return strings.TrimSuffix(parts[1], "/")
+			}
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,322 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/datastax/burnell/src/util"
+)
+
+// ErrStatsHistoryNotFound is returned when there is no history recorded for the topic or namespace
+var ErrStatsHistoryNotFound = errors.New("topic stats history does not exist")
+
+// StatsHistoryPoint is the average of the key metrics over a step of time
+type StatsHistoryPoint struct {
+	Timestamp time.Time `json:"timestamp"`
+	TopicStatsFields
+}
+
+// StatsHistory is the time series of a topic or a namespace
+type StatsHistory struct {
+	Tenant string              `json:"tenant"`
+	Series string              `json:"series"`
+	From   time.Time           `json:"from"`
+	To     time.Time           `json:"to"`
+	Step   int                 `json:"stepSeconds"`
+	Points []StatsHistoryPoint `json:"points"`
+}
+
+// StatsHistoryQuery is the series and the time range to query the history
+type StatsHistoryQuery struct {
+	Tenant string
+	Series string // either the topic full name or tenant/namespace
+	From   time.Time
+	To     time.Time
+	Step   time.Duration // rounded up to a multiple of the resolution
+}
+
+// statsBucket accumulates the samples within a resolution interval
+type statsBucket struct {
+	start int64 // unix second
+	count int
+	sum   TopicStatsFields
+}
+
+type statsSeries struct {
+	tenant    string
+	buckets   []statsBucket
+	updatedAt time.Time
+	seq       uint64 // the order of creation
+}
+
+// StatsHistoryStore is a bounded in-memory time series store of topic and namespace stats.
+// Samples are downsampled to the resolution, kept up to the retention and the number of series is capped
+// so that the memory is bounded by maxSeries * retention / resolution buckets of 104 bytes.
+type StatsHistoryStore struct {
+	resolution time.Duration
+	retention  time.Duration
+	maxSeries  int
+	series     map[string]*statsSeries
+	nextSeq    uint64
+	dropped    int64
+	lock       sync.RWMutex
+}
+
+// TopicStatsHistory is the history store of the topic stats cache,
+// the defaults of 2000 series * 24h / 300s buckets take about 60MB
+var TopicStatsHistory = NewStatsHistoryStore(
+	time.Duration(util.GetEnvInt("TopicStatsHistoryResolutionSecond", 300))*time.Second,
+	time.Duration(util.GetEnvInt("TopicStatsHistoryRetentionHour", 24))*time.Hour,
+	util.GetEnvInt("TopicStatsHistoryMaxSeries", 2000),
+)
+
+// NewStatsHistoryStore creates a history store, maxSeries 0 disables the store
+func NewStatsHistoryStore(resolution, retention time.Duration, maxSeries int) *StatsHistoryStore {
+	if resolution < time.Second {
+		resolution = time.Second
+	}
+	return &StatsHistoryStore{
+		resolution: resolution,
+		retention:  retention,
+		maxSeries:  maxSeries,
+		series:     make(map[string]*statsSeries),
+	}
+}
+
+// Record adds a sample of every topic and the sum of the topics per namespace to the history.
+// The aggregated partitioned topics are recorded as topics but excluded from the namespace sum.
+// The namespaces are added before the topics so that they are the last to be dropped over the maximum number of series.
+func (s *StatsHistoryStore) Record(topics []*TopicStats, now time.Time) {
+	if s.maxSeries <= 0 {
+		return
+	}
+	namespaces := make(map[string]*TopicStats)
+	for _, t := range topics {
+		if strings.HasPrefix(t.ID, util.PartitionPrefix) {
+			continue
+		}
+		ns, ok := namespaces[t.Namespace]
+		if !ok {
+			ns = &TopicStats{Tenant: t.Tenant}
+			namespaces[t.Namespace] = ns
+		}
+		ns.Fields = ns.Fields.add(t.Fields)
+	}
+	keys := make([]string, 0, len(namespaces))
+	for k := range namespaces {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, k := range keys {
+		s.add(k, namespaces[k].Tenant, namespaces[k].Fields.weightedMsgSize(), now)
+	}
+	for _, t := range topics {
+		s.add(t.ID, t.Tenant, t.Fields, now)
+	}
+	s.evict(now)
+}
+
+// DroppedSeries returns the number of series dropped over the maximum number of series
+func (s *StatsHistoryStore) DroppedSeries() int64 {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.dropped
+}
+
+// add records a sample in the current bucket of the series, the caller must hold the lock
+func (s *StatsHistoryStore) add(key, tenant string, fields TopicStatsFields, now time.Time) {
+	series, ok := s.series[key]
+	if !ok {
+		s.nextSeq++
+		series = &statsSeries{tenant: tenant, seq: s.nextSeq}
+		s.series[key] = series
+	}
+	series.updatedAt = now
+	start := now.Truncate(s.resolution).Unix()
+	if size := len(series.buckets); size > 0 && series.buckets[size-1].start == start {
+		series.buckets[size-1].count++
+		series.buckets[size-1].sum = series.buckets[size-1].sum.add(fields)
+		return
+	}
+	series.buckets = append(series.buckets, statsBucket{start: start, count: 1, sum: fields})
+
+	oldest := now.Add(-s.retention).Unix()
+	i := 0
+	for i < len(series.buckets) && series.buckets[i].start < oldest {
+		i++
+	}
+	if i > 0 {
+		series.buckets = append([]statsBucket{}, series.buckets[i:]...)
+	}
+}
+
+// evict removes the series without samples over the retention, then the least recently updated series
+// over the maximum number of series. Among the series updated at the same time the most recently created are
+// removed first, so that a poll over the maximum keeps the same series rather than an arbitrary subset.
+// The caller must hold the lock.
+func (s *StatsHistoryStore) evict(now time.Time) {
+	keys := []string{}
+	for k, v := range s.series {
+		if now.Sub(v.updatedAt) > s.retention {
+			delete(s.series, k)
+			continue
+		}
+		keys = append(keys, k)
+	}
+	if len(keys) <= s.maxSeries {
+		return
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := s.series[keys[i]], s.series[keys[j]]
+		if !a.updatedAt.Equal(b.updatedAt) {
+			return a.updatedAt.Before(b.updatedAt)
+		}
+		return a.seq > b.seq
+	})
+	for _, k := range keys[:len(keys)-s.maxSeries] {
+		delete(s.series, k)
+	}
+	s.dropped += int64(len(keys) - s.maxSeries)
+}
+
+// Query returns the series over the time range downsampled to the step.
+// Each point is the average of the samples within the step and the steps without samples are omitted.
+func (s *StatsHistoryStore) Query(q StatsHistoryQuery) (StatsHistory, error) {
+	if !q.From.Before(q.To) {
+		return StatsHistory{}, fmt.Errorf("from %s must be before to %s", q.From.Format(time.RFC3339), q.To.Format(time.RFC3339))
+	}
+	if q.Step < 0 {
+		return StatsHistory{}, fmt.Errorf("step cannot be negative")
+	}
+	step := s.resolution
+	if q.Step > step {
+		step = (q.Step + s.resolution - 1) / s.resolution * s.resolution
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	series, ok := s.series[q.Series]
+	if !ok || series.tenant != q.Tenant {
+		return StatsHistory{}, ErrStatsHistoryNotFound
+	}
+
+	history := StatsHistory{
+		Tenant: q.Tenant,
+		Series: q.Series,
+		From:   q.From,
+		To:     q.To,
+		Step:   int(step.Seconds()),
+		Points: []StatsHistoryPoint{},
+	}
+	from, to, stepSeconds := q.From.Unix(), q.To.Unix(), int64(step.Seconds())
+	var current *statsBucket
+	flush := func() {
+		if current != nil {
+			history.Points = append(history.Points, StatsHistoryPoint{
+				Timestamp:        time.Unix(current.start, 0).UTC(),
+				TopicStatsFields: current.sum.scale(1 / float64(current.count)),
+			})
+		}
+	}
+	for _, b := range series.buckets {
+		if b.start < from || b.start >= to {
+			continue
+		}
+		start := b.start - b.start%stepSeconds
+		if current == nil || current.start != start {
+			flush()
+			current = &statsBucket{start: start}
+		}
+		current.count += b.count
+		current.sum = current.sum.add(b.sum)
+	}
+	flush()
+	return history, nil
+}
+
+// RecordTopicStatsHistory records the fresh topic stats in the cache to the history
+func RecordTopicStatsHistory(now time.Time) {
+	txn := topicStatsDB.Txn(false)
+	defer txn.Abort()
+	result, err := txn.Get(topicStatsDBTable, "id")
+	if err != nil {
+		statsLog.Errorf("failed to read topic stats for history %v", err)
+		return
+	}
+	topics := []*TopicStats{}
+	for i := result.Next(); i != nil; i = result.Next() {
+		if p, ok := i.(*TopicStats); ok && now.Sub(p.UpdatedAt) < 90*time.Second {
+			topics = append(topics, p)
+		}
+	}
+	TopicStatsHistory.Record(topics, now)
+}
+
+func (f TopicStatsFields) add(o TopicStatsFields) TopicStatsFields {
+	return TopicStatsFields{
+		MsgRateIn:         f.MsgRateIn + o.MsgRateIn,
+		MsgRateOut:        f.MsgRateOut + o.MsgRateOut,
+		MsgThroughputIn:   f.MsgThroughputIn + o.MsgThroughputIn,
+		MsgThroughputOut:  f.MsgThroughputOut + o.MsgThroughputOut,
+		AverageMsgSize:    f.AverageMsgSize + o.AverageMsgSize,
+		StorageSize:       f.StorageSize + o.StorageSize,
+		BacklogSize:       f.BacklogSize + o.BacklogSize,
+		MsgBacklog:        f.MsgBacklog + o.MsgBacklog,
+		ProducerCount:     f.ProducerCount + o.ProducerCount,
+		ConsumerCount:     f.ConsumerCount + o.ConsumerCount,
+		SubscriptionCount: f.SubscriptionCount + o.SubscriptionCount,
+	}
+}
+
+// weightedMsgSize replaces the summed average message size with the one weighted by the message rate
+func (f TopicStatsFields) weightedMsgSize() TopicStatsFields {
+	f.AverageMsgSize = 0
+	if f.MsgRateIn > 0 {
+		f.AverageMsgSize = f.MsgThroughputIn / f.MsgRateIn
+	}
+	return f
+}
+
+func (f TopicStatsFields) scale(factor float64) TopicStatsFields {
+	return TopicStatsFields{
+		MsgRateIn:         f.MsgRateIn * factor,
+		MsgRateOut:        f.MsgRateOut * factor,
+		MsgThroughputIn:   f.MsgThroughputIn * factor,
+		MsgThroughputOut:  f.MsgThroughputOut * factor,
+		AverageMsgSize:    f.AverageMsgSize * factor,
+		StorageSize:       f.StorageSize * factor,
+		BacklogSize:       f.BacklogSize * factor,
+		MsgBacklog:        f.MsgBacklog * factor,
+		ProducerCount:     f.ProducerCount * factor,
+		ConsumerCount:     f.ConsumerCount * factor,
+		SubscriptionCount: f.SubscriptionCount * factor,
+	}
+}
@@ -0,0 +1,192 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package policy
+
+import (
+	"fmt"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// TopicStatsFields is the typed numeric fields parsed from the topic stats.
+// The msgBacklog, consumer and subscription counts are summed over all the subscriptions.
+type TopicStatsFields struct {
+	MsgRateIn         float64 `json:"msgRateIn"`
+	MsgRateOut        float64 `json:"msgRateOut"`
+	MsgThroughputIn   float64 `json:"msgThroughputIn"`
+	MsgThroughputOut  float64 `json:"msgThroughputOut"`
+	AverageMsgSize    float64 `json:"averageMsgSize"`
+	StorageSize       float64 `json:"storageSize"`
+	BacklogSize       float64 `json:"backlogSize"`
+	MsgBacklog        float64 `json:"msgBacklog"`
+	ProducerCount     float64 `json:"producerCount"`
+	ConsumerCount     float64 `json:"consumerCount"`
+	SubscriptionCount float64 `json:"subscriptionCount"`
+}
+
+// TopicStatsQuery is the filter, sort and projection criteria of topic stats
+type TopicStatsQuery struct {
+	Namespace  string // either the namespace name or tenant/namespace
+	NameGlob   string // matches the topic name without the tenant and namespace
+	SortBy     string // topic name by default, or any numeric field
+	Descending bool
+	Min        map[string]float64 // inclusive lower thresholds by field
+	Max        map[string]float64 // inclusive upper thresholds by field
+	Fields     []string           // only return these fields, either numeric fields or top level attributes of the stats
+}
+
+// index of the numeric field by json name
+var topicStatsFieldIndex = func() map[string]int {
+	index := make(map[string]int)
+	t := reflect.TypeOf(TopicStatsFields{})
+	for i := 0; i < t.NumField(); i++ {
+		index[strings.Split(t.Field(i).Tag.Get("json"), ",")[0]] = i
+	}
+	return index
+}()
+
+// ParseTopicStatsFields parses the numeric fields from a topic stats document
+func ParseTopicStatsFields(stats interface{}) TopicStatsFields {
+	fields := TopicStatsFields{}
+	data, ok := stats.(map[string]interface{})
+	if !ok {
+		return fields
+	}
+	v := reflect.ValueOf(&fields).Elem()
+	for name, i := range topicStatsFieldIndex {
+		if n, ok := data[name].(float64); ok {
+			v.Field(i).SetFloat(n)
+		}
+	}
+
+	// the counts are derived from the publishers and subscriptions
+	producers, consumers := CountTopicClients(stats)
+	fields.ProducerCount = float64(producers)
+	fields.ConsumerCount = float64(consumers)
+	subs, _ := data["subscriptions"].(map[string]interface{})
+	fields.SubscriptionCount = float64(len(subs))
+	backlog := 0.0
+	for _, s := range subs {
+		if sub, ok := s.(map[string]interface{}); ok {
+			if n, ok := sub["msgBacklog"].(float64); ok {
+				backlog += n
+			}
+		}
+	}
+	fields.MsgBacklog = backlog
+	return fields
+}
+
+// Value returns the numeric field by the json name
+func (f TopicStatsFields) Value(name string) (float64, bool) {
+	i, ok := topicStatsFieldIndex[name]
+	if !ok {
+		return 0, false
+	}
+	return reflect.ValueOf(f).Field(i).Float(), true
+}
+
+// Validate verifies the sort, threshold and glob attributes of the query
+func (q TopicStatsQuery) Validate() error {
+	if q.SortBy != "" && q.SortBy != "name" {
+		if _, ok := topicStatsFieldIndex[q.SortBy]; !ok {
+			return fmt.Errorf("unsupported sort field %s", q.SortBy)
+		}
+	}
+	for _, thresholds := range []map[string]float64{q.Min, q.Max} {
+		for k := range thresholds {
+			if _, ok := topicStatsFieldIndex[k]; !ok {
+				return fmt.Errorf("unsupported threshold field %s", k)
+			}
+		}
+	}
+	if _, err := path.Match(q.NameGlob, ""); err != nil {
+		return fmt.Errorf("invalid topic name pattern %s", q.NameGlob)
+	}
+	return nil
+}
+
+// Match evaluates if the topic stats meet the namespace, the name pattern and the thresholds
+func (q TopicStatsQuery) Match(ts *TopicStats) bool {
+	if q.Namespace != "" && q.Namespace != ts.Namespace && ts.Tenant+"/"+q.Namespace != ts.Namespace {
+		return false
+	}
+	if q.NameGlob != "" {
+		if ok, _ := path.Match(q.NameGlob, topicShortName(ts.ID)); !ok {
+			return false
+		}
+	}
+	for k, min := range q.Min {
+		if v, _ := ts.Fields.Value(k); v < min {
+			return false
+		}
+	}
+	for k, max := range q.Max {
+		if v, _ := ts.Fields.Value(k); v > max {
+			return false
+		}
+	}
+	return true
+}
+
+// Sort sorts the topic stats by the sort field with the topic name to break ties
+func (q TopicStatsQuery) Sort(topics []*TopicStats) {
+	sort.SliceStable(topics, func(i, j int) bool {
+		a, b := topics[i], topics[j]
+		if q.Descending {
+			a, b = b, a
+		}
+		if q.SortBy != "" && q.SortBy != "name" {
+			va, _ := a.Fields.Value(q.SortBy)
+			vb, _ := b.Fields.Value(q.SortBy)
+			if va != vb {
+				return va < vb
+			}
+		}
+		return a.ID < b.ID
+	})
+}
+
+// Project returns the stats with the query fields only, or the whole stats without the fields
+func (q TopicStatsQuery) Project(ts *TopicStats) interface{} {
+	if len(q.Fields) == 0 {
+		return ts.Data
+	}
+	data, _ := ts.Data.(map[string]interface{})
+	projection := make(map[string]interface{})
+	for _, name := range q.Fields {
+		if v, ok := ts.Fields.Value(name); ok {
+			projection[name] = v
+		} else if v, ok := data[name]; ok {
+			projection[name] = v
+		}
+	}
+	return projection
+}
+
+// topicShortName returns the topic name without the domain, tenant and namespace
+func topicShortName(topicFn string) string {
+	parts := strings.Split(topicFn, "/")
+	return parts[len(parts)-1]
+}
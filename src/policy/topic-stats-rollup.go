@@ -0,0 +1,118 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package policy
+
+import (
+	"fmt"
+	"time"
+)
+
+// StatsRollup is the topic stats aggregated over a namespace or a tenant.
+// The numeric fields are summed over the topics and averageMsgSize is weighted by the message rate.
+type StatsRollup struct {
+	Name   string `json:"name"` // tenant/namespace or tenant
+	Tenant string `json:"tenant"`
+	Topics int    `json:"topics"`
+	TopicStatsFields
+}
+
+// StatsRollupList is the paginated list of rollups
+type StatsRollupList struct {
+	Total  int           `json:"total"`
+	Offset int           `json:"offset"`
+	Data   []interface{} `json:"data"`
+}
+
+// RollupNamespaces aggregates the tenant's fresh topic stats per namespace,
+// filtered, sorted and projected by the query and paginated by the offset and limit
+func RollupNamespaces(tenant string, q TopicStatsQuery, offset, limit int) (StatsRollupList, error) {
+	return rollupTopicStats(tenant, q, offset, limit, func(ts *TopicStats) string { return ts.Namespace })
+}
+
+// RollupTenants aggregates the fresh topic stats per tenant, the namespace of the query is ignored
+func RollupTenants(q TopicStatsQuery, offset, limit int) (StatsRollupList, error) {
+	q.Namespace = ""
+	return rollupTopicStats("", q, offset, limit, func(ts *TopicStats) string { return ts.Tenant })
+}
+
+// rollupTopicStats sums the topic stats by the group key. A rollup is matched, sorted and projected as a topic
+// stats entry with the group key as the id, so that the name pattern applies to the namespace or the tenant name.
+func rollupTopicStats(tenant string, q TopicStatsQuery, offset, limit int, groupKey func(*TopicStats) string) (StatsRollupList, error) {
+	if offset < 0 || limit < 0 {
+		return StatsRollupList{}, fmt.Errorf("offset or limit cannot be negative")
+	}
+	if err := q.Validate(); err != nil {
+		return StatsRollupList{}, err
+	}
+
+	topics, err := freshTenantTopics(tenant, time.Now())
+	if err != nil {
+		return StatsRollupList{}, err
+	}
+
+	groups := make(map[string]*TopicStats)
+	counts := make(map[string]int)
+	for _, ts := range topics {
+		key := groupKey(ts)
+		group, ok := groups[key]
+		if !ok {
+			group = &TopicStats{ID: key, Tenant: ts.Tenant, Namespace: ts.Namespace}
+			groups[key] = group
+		}
+		group.Fields = group.Fields.add(ts.Fields)
+		counts[key]++
+	}
+
+	rollups := []*TopicStats{}
+	for _, v := range groups {
+		v.Fields = v.Fields.weightedMsgSize()
+		if q.Match(v) {
+			rollups = append(rollups, v)
+		}
+	}
+	q.Sort(rollups)
+
+	total := len(rollups)
+	if offset > total {
+		return StatsRollupList{Total: total, Offset: total, Data: []interface{}{}}, nil
+	}
+	newOffset := offset + limit
+	if limit == 0 || newOffset > total {
+		newOffset = total
+	}
+	data := []interface{}{}
+	for _, v := range rollups[offset:newOffset] {
+		rollup := StatsRollup{Name: v.ID, Tenant: v.Tenant, Topics: counts[v.ID], TopicStatsFields: v.Fields}
+		if len(q.Fields) == 0 {
+			data = append(data, rollup)
+			continue
+		}
+		projection := map[string]interface{}{"name": rollup.Name, "tenant": rollup.Tenant, "topics": rollup.Topics}
+		for _, name := range q.Fields {
+			if value, ok := v.Fields.Value(name); ok {
+				projection[name] = value
+			}
+		}
+		data = append(data, projection)
+	}
+	return StatsRollupList{Total: total, Offset: newOffset, Data: data}, nil
+}
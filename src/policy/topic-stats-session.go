@@ -0,0 +1,176 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package policy
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/datastax/burnell/src/util"
+	"github.com/hashicorp/go-memdb"
+)
+
+// ErrStatsSessionNotFound is returned when the topic stats session has expired or never existed
+var ErrStatsSessionNotFound = errors.New("topic stats session has expired or does not exist")
+
+// the idle time before a session expires and the maximum concurrent sessions per tenant,
+// the least recently used session of the tenant is evicted to open a new one beyond the maximum.
+// Sessions live in the memory of the replica that creates them.
+var statsSessionTTL = time.Duration(util.GetEnvInt("TopicStatsSessionTTLSecond", 300)) * time.Second
+var maxStatsSessions = util.GetEnvInt("TopicStatsMaxSessionsPerTenant", 5)
+
+// TopicStatsPage is a page of topic stats iterated from a session snapshot
+type TopicStatsPage struct {
+	SessionID string
+	Total     int
+	Offset    int
+	Topics    []string // topic names of the page in the query order
+	Data      map[string]interface{}
+}
+
+// statsSession is an immutable snapshot of a tenant's topic stats to iterate pages consistently
+type statsSession struct {
+	id        string
+	tenant    string
+	snapshot  *memdb.MemDB
+	query     TopicStatsQuery
+	keys      []string // topic IDs matched in the snapshot in the query order
+	expiresAt time.Time
+}
+
+var statsSessions = make(map[string]*statsSession)
+var statsSessionsLock = sync.Mutex{}
+
+// newStatsSession takes a snapshot of the topic stats database and creates a session for the tenant
+// with the topics matched and sorted by the query
+func newStatsSession(tenant string, query TopicStatsQuery, now time.Time) (*statsSession, error) {
+	statsSessionsLock.Lock()
+	defer statsSessionsLock.Unlock()
+	expireStatsSessions(now)
+
+	evictStatsSessions(tenant)
+
+	id, err := util.NewUUID()
+	if err != nil {
+		return nil, err
+	}
+	session := &statsSession{
+		id:        id,
+		tenant:    tenant,
+		snapshot:  topicStatsDB.Snapshot(),
+		query:     query,
+		keys:      []string{},
+		expiresAt: now.Add(statsSessionTTL),
+	}
+
+	txn := session.snapshot.Txn(false)
+	defer txn.Abort()
+	result, err := txn.Get(topicStatsDBTable, "tenant", tenant)
+	if err != nil {
+		return nil, err
+	}
+	topics := []*TopicStats{}
+	for i := result.Next(); i != nil; i = result.Next() {
+		if p, ok := i.(*TopicStats); ok && now.Sub(p.UpdatedAt) < 90*time.Second && query.Match(p) {
+			topics = append(topics, p)
+		}
+	}
+	query.Sort(topics)
+	for _, v := range topics {
+		session.keys = append(session.keys, v.ID)
+	}
+
+	statsSessions[id] = session
+	return session, nil
+}
+
+// getStatsSession returns the tenant's session and extends its expiry
+func getStatsSession(tenant, id string, now time.Time) (*statsSession, error) {
+	statsSessionsLock.Lock()
+	defer statsSessionsLock.Unlock()
+	expireStatsSessions(now)
+
+	session, ok := statsSessions[id]
+	if !ok || session.tenant != tenant {
+		return nil, ErrStatsSessionNotFound
+	}
+	session.expiresAt = now.Add(statsSessionTTL)
+	return session, nil
+}
+
+// closeStatsSession releases the session once the last page is returned
+func closeStatsSession(id string) {
+	statsSessionsLock.Lock()
+	defer statsSessionsLock.Unlock()
+	delete(statsSessions, id)
+}
+
+// expireStatsSessions removes expired sessions, the caller must hold the lock
+func expireStatsSessions(now time.Time) {
+	for k, v := range statsSessions {
+		if now.After(v.expiresAt) {
+			delete(statsSessions, k)
+		}
+	}
+}
+
+// evictStatsSessions removes the tenant's least recently used sessions to make room for a new one,
+// the caller must hold the lock
+func evictStatsSessions(tenant string) {
+	for {
+		var oldest *statsSession
+		count := 0
+		for _, v := range statsSessions {
+			if v.tenant == tenant {
+				count++
+				if oldest == nil || v.expiresAt.Before(oldest.expiresAt) {
+					oldest = v
+				}
+			}
+		}
+		if oldest == nil || count < maxStatsSessions {
+			return
+		}
+		delete(statsSessions, oldest.id)
+	}
+}
+
+// page returns the topic stats from the offset up to the page size
+func (ss *statsSession) page(offset, pageSize int) (int, []string, map[string]interface{}) {
+	topics := []string{}
+	data := make(map[string]interface{})
+	newOffset := offset + pageSize
+	if newOffset > len(ss.keys) {
+		newOffset = len(ss.keys)
+	}
+
+	txn := ss.snapshot.Txn(false)
+	defer txn.Abort()
+	for _, id := range ss.keys[offset:newOffset] {
+		if raw, err := txn.First(topicStatsDBTable, "id", id); err == nil && raw != nil {
+			topics = append(topics, id)
+			data[id] = ss.query.Project(raw.(*TopicStats))
+		}
+	}
+	return newOffset, topics, data
+}
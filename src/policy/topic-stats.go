@@ -22,6 +22,7 @@
 package policy
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -29,6 +30,7 @@ import (
 	"regexp"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/apex/log"
@@ -65,6 +67,11 @@ type TopicStats struct {
 	Topic     string      `json:"topic"`
 	Data      interface{} `json:"data"`
 	UpdatedAt time.Time   `json:"updatedAt"`
+	// the broker and the bundle range owning the topic when it was polled from the broker
+	Broker string `json:"broker,omitempty"`
+	Bundle string `json:"bundle,omitempty"`
+	// numeric fields parsed from the data
+	Fields TopicStatsFields `json:"fields"`
 }
 
 // InitTopicStatsDB initializes topicStats in-memory database
@@ -91,9 +98,10 @@ func InitTopicStatsDB() error {
 						Indexer: &memdb.StringFieldIndex{Field: "Namespace"},
 					},
 					"topic": &memdb.IndexSchema{
-						Name:    "topic",
-						Unique:  false,
-						Indexer: &memdb.StringFieldIndex{Field: "Topic"},
+						Name:         "topic",
+						Unique:       false,
+						AllowMissing: true,
+						Indexer:      &memdb.StringFieldIndex{Field: "Topic"},
 					},
 				},
 			},
@@ -107,6 +115,36 @@ func InitTopicStatsDB() error {
 	return err
 }
 
+// topicStatsFreshness is the age of the cached topic stats beyond which they are stale
+const topicStatsFreshness = 90 * time.Second
+
+// freshTenantTopics returns the fresh topic stats of the tenant, or all the tenants if the tenant is empty.
+// The aggregated partitioned topics are excluded since their partitions are cached as topics.
+func freshTenantTopics(tenant string, now time.Time) ([]*TopicStats, error) {
+	txn := topicStatsDB.Txn(false)
+	defer txn.Abort()
+	index, args := "id", []interface{}{}
+	if tenant != "" {
+		index, args = "tenant", []interface{}{tenant}
+	}
+	result, err := txn.Get(topicStatsDBTable, index, args...)
+	if err != nil {
+		return nil, err
+	}
+	topics := []*TopicStats{}
+	for i := result.Next(); i != nil; i = result.Next() {
+		if p, ok := i.(*TopicStats); ok && now.Sub(p.UpdatedAt) < topicStatsFreshness && !strings.HasPrefix(p.ID, util.PartitionPrefix) {
+			topics = append(topics, p)
+		}
+	}
+	return topics, nil
+}
+
+// freshTopics returns the fresh topic stats of all the tenants without the aggregated partitioned topics
+func freshTopics(now time.Time) ([]*TopicStats, error) {
+	return freshTenantTopics("", now)
+}
+
 // CountTopics counts the number of topics under a tenant, returns -1 if the tenant does not exist
 func CountTopics(tenant string) (map[string][]string, int) {
 	namespaces := make(map[string][]string)
@@ -173,44 +211,89 @@ func GetBrokers() []string {
 	return sort.StringSlice(brokers)
 }
 
-func brokersStatsTopicQuery() {
+func brokersStatsTopicQuery() BrokersPollResult {
+	start := time.Now()
 	brokers := GetBrokers()
 	// brokers = []string{util.Config.ProxyURL, util.Config.ProxyURL, util.Config.ProxyURL}
 
-	// key is tenant, value is partition topic name
-	var partitionTopicNames = make(map[string]string)
-	for _, v := range brokers {
-		if topics, err := brokerStatsTopicsQuery(v); err == nil {
-			for k, v := range topics {
-				partitionTopicNames[k] = v
-			}
-		}
-	}
+	result := PollBrokersTopicStats(brokers, statsPollConcurrency, statsBrokerTimeout)
+	// the aggregated partitioned-stats are refreshed by partitionedStatsWorker
+	TrackPartitionedTopics(result.PartitionTopics, time.Now())
+	statsPollDuration.Observe(time.Since(start).Seconds())
+	statsLog.Debugf("polled %d topics from %d brokers in %v, %d brokers failed", result.Topics, len(brokers), time.Since(start), len(result.Errors))
+	return result
+}
 
-	// make separate request for partition topic for aggrgated stats
-	for tenantKey, name := range partitionTopicNames {
-		if data, err := getSingleTopicStats(name, true); err == nil {
-			topicInfo := TopicStats{
-				ID:        util.PartitionPrefix + name,
-				Tenant:    tenantKey,
-				Namespace: "partition topics across namespaces",
-				UpdatedAt: time.Now(),
-				Data:      data,
-			}
+// BrokersPollResult is the outcome of a poll cycle over all the brokers
+type BrokersPollResult struct {
+	Topics          int
+	PartitionTopics map[string]bool  // partitioned topic fullnames
+	Polled          map[string]bool  // brokers polled successfully
+	Errors          map[string]error // key is broker
+}
 
-			txn := topicStatsDB.Txn(true)
-			txn.Insert(topicStatsDBTable, &topicInfo)
-			txn.Commit()
-		}
-	}
+// the maximum number of brokers polled concurrently and the deadline of each broker poll
+var statsPollConcurrency = util.GetEnvInt("StatsPollConcurrency", 8)
+var statsBrokerTimeout = time.Duration(util.GetEnvInt("StatsBrokerTimeoutSecond", 15)) * time.Second
+
+// PollBrokersTopicStats polls the topic stats of the brokers with a bounded number of workers.
+// Each broker has its own deadline so that a slow broker does not hold up the others.
+func PollBrokersTopicStats(brokers []string, concurrency int, timeout time.Duration) BrokersPollResult {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	result := BrokersPollResult{
+		PartitionTopics: make(map[string]bool),
+		Polled:          make(map[string]bool),
+		Errors:          make(map[string]error),
+	}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	brokerChan := make(chan string)
+	for i := 0; i < concurrency && i < len(brokers); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for broker := range brokerChan {
+				start := time.Now()
+				ctx, cancel := context.WithTimeout(context.Background(), timeout)
+				topics, partitionTopics, err := brokerStatsTopicsQuery(ctx, broker)
+				cancel()
+
+				brokerPollDuration.WithLabelValues(broker).Set(time.Since(start).Seconds())
+				brokerTopics.WithLabelValues(broker).Set(float64(topics))
+				if err != nil {
+					brokerPollErrors.WithLabelValues(broker).Inc()
+				}
 
+				lock.Lock()
+				result.Topics += topics
+				for k := range partitionTopics {
+					result.PartitionTopics[k] = true
+				}
+				if err != nil {
+					result.Errors[broker] = err
+				} else {
+					result.Polled[broker] = true
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+	for _, v := range brokers {
+		brokerChan <- v
+	}
+	close(brokerChan)
+	wg.Wait()
+	return result
 }
 
-// brokerStatsTopicsQuery returns a map of tenant and topic full name, and error of this operation
-func brokerStatsTopicsQuery(urlString string) (map[string]string, error) {
-	// key is tenant, value is partition topic name
-	var partitionTopicNames = make(map[string]string)
+// brokerStatsTopicsQuery caches the topic stats of a broker in one transaction,
+// returns the number of topics, a set of partitioned topic full names, and error of this operation
+func brokerStatsTopicsQuery(ctx context.Context, urlString string) (int, map[string]bool, error) {
+	var partitionTopicNames = make(map[string]bool)
 
+	broker := urlString
 	if !strings.HasPrefix(urlString, "http") {
 		urlString = "http://" + urlString
 	}
@@ -218,10 +301,10 @@ func brokerStatsTopicsQuery(urlString string) (map[string]string, error) {
 	statsLog.Debugf(" proxy request route is %s\n", topicStatsURL)
 
 	// Update the headers to allow for SSL redirection
-	newRequest, err := http.NewRequest(http.MethodGet, topicStatsURL, nil)
+	newRequest, err := http.NewRequestWithContext(ctx, http.MethodGet, topicStatsURL, nil)
 	if err != nil {
 		statsLog.Errorf("make http request %s error %v", topicStatsURL, err)
-		return partitionTopicNames, err
+		return 0, partitionTopicNames, err
 	}
 	newRequest.Header.Add("user-agent", "burnell")
 	newRequest.Header.Add("Authorization", "Bearer "+util.Config.PulsarToken)
@@ -234,27 +317,29 @@ func brokerStatsTopicsQuery(urlString string) (map[string]string, error) {
 	}
 	if err != nil {
 		statsLog.Errorf("make http request %s error %v", topicStatsURL, err)
-		return partitionTopicNames, err
+		return 0, partitionTopicNames, err
 	}
 
 	if response.StatusCode != http.StatusOK {
 		statsLog.Errorf("GET broker topic stats %s response status code %d", topicStatsURL, response.StatusCode)
-		return partitionTopicNames, err
+		return 0, partitionTopicNames, fmt.Errorf("GET broker topic stats response status code %d", response.StatusCode)
 	}
 
 	body, err := ioutil.ReadAll(response.Body)
 	if err != nil {
 		statsLog.Errorf("GET broker topic stats request %s error %v", topicStatsURL, err)
-		return partitionTopicNames, err
+		return 0, partitionTopicNames, err
 	}
 
 	// tenant's namespace/bundle hash/persistent/topicFullName
 	var result map[string]map[string]map[string]map[string]interface{}
 	if err = json.Unmarshal(body, &result); err != nil {
 		statsLog.Errorf("GET broker topic stats request %s unmarshal error %v", topicStatsURL, err)
-		return partitionTopicNames, err
+		return 0, partitionTopicNames, err
 	}
 
+	now := time.Now()
+	topics := []TopicStats{}
 	for k, v := range result {
 		tenant := strings.Split(k, "/")[0]
 		statsLog.Debugf("namespace %s tenant %s", k, tenant)
@@ -269,42 +354,30 @@ func brokerStatsTopicsQuery(urlString string) (map[string]string, error) {
 						ID:        topicFn,
 						Tenant:    tenant,
 						Namespace: k,
-						UpdatedAt: time.Now(),
+						Topic:     topicShortName(topicFn),
+						UpdatedAt: now,
 						Data:      v4,
+						Broker:    broker,
+						Bundle:    bundleKey,
 					}
 					if partitionName, isPartitionTopic := IsPartitionTopic(topicFn); isPartitionTopic {
-						partitionTopicNames[tenant] = partitionName
+						partitionTopicNames[partitionName] = true
 					}
 					// if parts := strings.Split(k, "/"); len(parts) == 2 && parts[0] != "public" {
 					//	namespaces[k] = util.IsPersistentTopic(topicFn)
 					//}
 
-					txn := topicStatsDB.Txn(true)
-					txn.Insert(topicStatsDBTable, &topicInfo)
-					txn.Commit()
+					topics = append(topics, topicInfo)
 				}
 			}
 		}
 	}
 
-	// make separate request for partition topic for aggrgated stats
-	for tenantKey, name := range partitionTopicNames {
-		if data, err := getSingleTopicStats(name, true); err == nil {
-			topicInfo := TopicStats{
-				ID:        util.PartitionPrefix + name,
-				Tenant:    tenantKey,
-				Namespace: "partition topics across namespaces",
-				UpdatedAt: time.Now(),
-				Data:      data,
-			}
-
-			txn := topicStatsDB.Txn(true)
-			txn.Insert(topicStatsDBTable, &topicInfo)
-			txn.Commit()
-		}
+	if err = UpsertTopicStatsBatch(topics); err != nil {
+		statsLog.Errorf("failed to cache broker %s topic stats %v", urlString, err)
+		return 0, partitionTopicNames, err
 	}
-
-	return partitionTopicNames, nil
+	return len(topics), partitionTopicNames, nil
 }
 
 func getTopicsFromNamespace(path string, isPersistent bool) ([]string, error) {
@@ -403,85 +476,125 @@ func getSingleTopicStats(topicFullname string, isPartitionTopic bool) (interface
 func CacheTopicStatsWorker() {
 	interval := time.Duration(util.GetEnvInt("StatsPullIntervalSecond", 9)) * time.Second
 	go func() {
-		brokersStatsTopicQuery()
+		result := brokersStatsTopicQuery()
+		RecordTopicStatsHistory(time.Now())
+		RecordSubscriptionTrends(time.Now())
+		RecordTopicEvents(time.Now(), result.Polled)
+		evaluateAlertRules(time.Now(), result.Polled)
+		refreshPartitionedStats()
+		go partitionedStatsWorker()
 		ticker := time.NewTicker(interval)
 		for {
 			select {
 			case <-ticker.C:
-				brokersStatsTopicQuery()
+				result := brokersStatsTopicQuery()
+				RecordTopicStatsHistory(time.Now())
+				RecordSubscriptionTrends(time.Now())
+				RecordTopicEvents(time.Now(), result.Polled)
+				evaluateAlertRules(time.Now(), result.Polled)
 			}
 		}
 	}()
 }
 
-// PaginateTopicStats paginate topic statistics returns based on offset and page size limit
-func PaginateTopicStats(tenant string, offset, pageSize int, mandatoryTopics []string) (int, int, map[string]interface{}) {
-	txn := topicStatsDB.Txn(false)
-	result, err := txn.Get(topicStatsDBTable, "tenant", tenant)
-	if err != nil {
-		return -1, -1, nil
-	}
+// UpsertTopicStats inserts or updates the topic stats in the cache with the numeric fields parsed
+func UpsertTopicStats(topicInfo TopicStats) error {
+	return UpsertTopicStatsBatch([]TopicStats{topicInfo})
+}
 
-	allTopics := make(map[string]interface{})
-	keys := make([]string, 0)
-	for i := result.Next(); i != nil; i = result.Next() {
-		p, ok := i.(*TopicStats)
-		if ok {
-			if time.Since(p.UpdatedAt) < 90*time.Second {
-				keys = append(keys, p.ID)
-				allTopics[p.ID] = p.Data
-			} else {
-				txn.DeleteAll(topicStatsDBTable, "id", p.ID)
-			}
+// UpsertTopicStatsBatch inserts or updates a batch of topic stats in one transaction
+func UpsertTopicStatsBatch(topics []TopicStats) error {
+	txn := topicStatsDB.Txn(true)
+	for i := range topics {
+		topicInfo := topics[i]
+		topicInfo.Fields = ParseTopicStatsFields(topicInfo.Data)
+		if err := txn.Insert(topicStatsDBTable, &topicInfo); err != nil {
+			txn.Abort()
+			return err
 		}
 	}
-	txn.Abort()
+	txn.Commit()
+	return nil
+}
 
-	// make sure mandatory topics stats exists
+// cacheMandatoryTopicStats makes sure mandatory topics stats exist in the cache,
+// the topics must be the full names of the tenant's topics
+func cacheMandatoryTopicStats(tenant string, mandatoryTopics []string) error {
 	for _, name := range mandatoryTopics {
-		if _, ok := allTopics[name]; !ok {
-			tName, isPartitioned := util.ParsePartitionTopicName(name)
-			if data, err := getSingleTopicStats(tName, isPartitioned); err == nil {
-				var ns string
-				if _, namespace, _, err := util.ExtractPartsFromTopicFn(tName); err == nil {
-					ns = tenant + "/" + namespace
-				}
-				ns = util.ConditionAssign(isPartitioned, "partition topics across namespaces", ns)
-
-				topicInfo := TopicStats{
-					ID:        util.PartitionPrefix + name,
-					Tenant:    tenant,
-					Namespace: ns,
-					UpdatedAt: time.Now(),
-					Data:      data,
-				}
+		tName, isPartitioned := util.ParsePartitionTopicName(name)
+		topicTenant, namespace, topic, err := util.ExtractPartsFromTopicFn(tName)
+		if err != nil {
+			return err
+		}
+		if topicTenant != tenant {
+			return fmt.Errorf("topic %s does not belong to tenant %s", name, tenant)
+		}
 
-				txn := topicStatsDB.Txn(true)
-				txn.Insert(topicStatsDBTable, &topicInfo)
-				txn.Commit()
+		txn := topicStatsDB.Txn(false)
+		raw, err := txn.First(topicStatsDBTable, "id", name)
+		txn.Abort()
+		if err == nil && raw != nil {
+			continue
+		}
 
-			}
+		if data, err := getSingleTopicStats(tName, isPartitioned); err == nil {
+			UpsertTopicStats(TopicStats{
+				ID:        name,
+				Tenant:    tenant,
+				Namespace: tenant + "/" + namespace,
+				Topic:     topic,
+				UpdatedAt: time.Now(),
+				Data:      data,
+			})
 		}
 	}
+	return nil
+}
 
-	totalSize := len(keys)
+// PaginateTopicStats paginates topic statistics based on offset and page size limit from a session snapshot.
+// The first page without session id creates the session with the topics matched and sorted by the query,
+// so that the later pages iterate the same topics even if topics are added or expired in the cache.
+// The later pages take the query of the session. The session is released after the last page.
+func PaginateTopicStats(tenant, sessionID string, query TopicStatsQuery, offset, pageSize int, mandatoryTopics []string) (TopicStatsPage, error) {
+	if offset < 0 || pageSize < 0 {
+		return TopicStatsPage{}, fmt.Errorf("offset or limit cannot be negative")
+	}
+	if err := query.Validate(); err != nil {
+		return TopicStatsPage{}, err
+	}
+	now := time.Now()
+	var session *statsSession
+	var err error
+	if sessionID == "" {
+		if err = cacheMandatoryTopicStats(tenant, mandatoryTopics); err != nil {
+			return TopicStatsPage{}, err
+		}
+		session, err = newStatsSession(tenant, query, now)
+	} else {
+		session, err = getStatsSession(tenant, sessionID, now)
+	}
+	if err != nil {
+		return TopicStatsPage{}, err
+	}
 
+	totalSize := len(session.keys)
 	// returns no data since what's asked is already over the total size
 	if offset > totalSize {
-		return -1, -1, nil
+		closeStatsSession(session.id)
+		return TopicStatsPage{SessionID: session.id, Total: totalSize, Offset: totalSize}, nil
 	}
 
-	newMap := make(map[string]interface{})
-	sort.Strings(keys)
-	newOffset := offset + pageSize
-	if newOffset > totalSize {
-		newOffset = totalSize
-	}
-	reqKeys := keys[offset:newOffset]
-	for _, v := range reqKeys {
-		newMap[v] = allTopics[v]
+	newOffset, topics, data := session.page(offset, pageSize)
+	if newOffset >= totalSize {
+		closeStatsSession(session.id)
 	}
-	return totalSize, newOffset, newMap
+	return TopicStatsPage{
+		SessionID: session.id,
+		Total:     totalSize,
+		Offset:    newOffset,
+		Topics:    topics,
+		Data:      data,
+	}, nil
 }
 
 // AggregateBrokersStats aggregates all brokers' statistics
@@ -0,0 +1,415 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/apex/log"
+	"github.com/datastax/burnell/src/util"
+)
+
+/**
+ * Data design - we use a topic as a database table to store tenant document.
+ * Every change is a message keyed by the tenant name so that the topic can be compacted.
+**/
+
+// the signal to track if the liveness of the reader process
+type liveSignal struct{}
+
+// PulsarTopicDriver is the tenant store backed by a Pulsar topic
+type PulsarTopicDriver struct {
+	client     pulsar.Client
+	topicName  string
+	token      string
+	trustStore string
+	// the position of the last message delivered to the watcher
+	lastMessageID pulsar.MessageID
+	// the latest record per tenant delivered to the watcher or sent by this driver,
+	// it has every tenant once the watcher has replayed the topic from the earliest message
+	tenants  map[string]TenantPlan
+	replayed bool
+	resumed  bool
+	lock     sync.RWMutex
+	logger   *log.Entry
+}
+
+// NewPulsarTopicDriver creates a Pulsar topic tenant store
+func NewPulsarTopicDriver(topicName, token, trustStore string) *PulsarTopicDriver {
+	return &PulsarTopicDriver{
+		topicName:  topicName,
+		token:      token,
+		trustStore: trustStore,
+		tenants:    make(map[string]TenantPlan),
+		logger:     log.WithFields(log.Fields{"app": "tenantdb", "store": PulsarStore}),
+	}
+}
+
+// NewPulsarTopicDriverWithClient creates a Pulsar topic tenant store over an established client
+func NewPulsarTopicDriverWithClient(client pulsar.Client, topicName string) *PulsarTopicDriver {
+	p := NewPulsarTopicDriver(topicName, "", "")
+	p.client = client
+	return p
+}
+
+// Conn creates the Pulsar client
+func (p *PulsarTopicDriver) Conn(pulsarURL string) error {
+	var err error
+	p.client, err = NewPulsarClient(pulsarURL, p.token, p.trustStore)
+	return err
+}
+
+// NewPulsarClient creates a Pulsar client with the optional token and the trust store required by pulsar+ssl
+func NewPulsarClient(pulsarURL, token, trustStore string) (pulsar.Client, error) {
+	clientOpt := pulsar.ClientOptions{
+		URL:               pulsarURL,
+		OperationTimeout:  30 * time.Second,
+		ConnectionTimeout: 30 * time.Second,
+	}
+
+	if token != "" {
+		clientOpt.Authentication = pulsar.NewAuthenticationToken(token)
+	}
+
+	if strings.HasPrefix(pulsarURL, "pulsar+ssl://") {
+		if trustStore == "" {
+			return nil, fmt.Errorf("this is fatal that we are missing trustStore while pulsar+ssl is required")
+		}
+		clientOpt.TLSTrustCertsFilePath = trustStore
+	}
+
+	return pulsar.NewClient(clientOpt)
+}
+
+func (p *PulsarTopicDriver) createReader(startMessageID pulsar.MessageID) (pulsar.Reader, error) {
+	return p.client.CreateReader(pulsar.ReaderOptions{
+		Topic:          p.topicName,
+		StartMessageID: startMessageID,
+		// only the latest record per tenant is required if the topic has been compacted
+		ReadCompacted: util.IsPersistentTopic(p.topicName),
+	})
+}
+
+// List replays the topic from the earliest message and returns the latest record of every existing tenant
+func (p *PulsarTopicDriver) List() ([]TenantPlan, error) {
+	reader, err := p.createReader(pulsar.EarliestMessageID())
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	tenants := make(map[string]TenantPlan)
+	ctx := context.Background()
+	for reader.HasNext() {
+		data, err := reader.Next(ctx)
+		if err != nil {
+			return nil, err
+		}
+		t := TenantPlan{}
+		if err = json.Unmarshal(data.Payload(), &t); err != nil {
+			p.logger.Errorf("tenant unmarshal error %v", err)
+			continue
+		}
+		if existing, ok := tenants[t.Name]; ok && IsStaleTenantVersion(existing.Version, t.Version) {
+			continue
+		}
+		tenants[t.Name] = t
+	}
+
+	plans := make([]TenantPlan, 0, len(tenants))
+	for _, v := range tenants {
+		if v.TenantStatus != Deleted {
+			plans = append(plans, v)
+		}
+	}
+	return plans, nil
+}
+
+// Get returns the latest record of the tenant. The topic is only replayed until the watcher has replayed it.
+func (p *PulsarTopicDriver) Get(tenantName string) (TenantPlan, error) {
+	p.lock.RLock()
+	if p.replayed {
+		t, ok := p.tenants[tenantName]
+		p.lock.RUnlock()
+		if !ok || t.TenantStatus == Deleted {
+			return TenantPlan{}, ErrTenantNotFound
+		}
+		return t, nil
+	}
+	p.lock.RUnlock()
+
+	plans, err := p.List()
+	if err != nil {
+		return TenantPlan{}, err
+	}
+	for _, v := range plans {
+		if v.Name == tenantName {
+			return v, nil
+		}
+	}
+	return TenantPlan{}, ErrTenantNotFound
+}
+
+// the producer name shared by the writers of every instance, since the broker admits one producer
+// with the same name on a topic at a time, holding the producer serializes the writes across instances
+const tenantWriterName = "burnell-tenant-writer"
+
+// the time to wait for the writer producer held by another instance
+var tenantWriterTimeout = time.Duration(util.GetEnvInt("TenantWriterTimeoutSecond", 10)) * time.Second
+
+// Update sends the tenant record to the topic
+func (p *PulsarTopicDriver) Update(tenantPlan TenantPlan) error {
+	producer, err := p.acquireWriter()
+	if err != nil {
+		return err
+	}
+	defer producer.Close()
+	return p.send(producer, tenantPlan)
+}
+
+// UpdateIfVersion sends the tenant record only if the latest record in the topic is at the expected version.
+// The topic is read to the end while holding the writer so that no other instance can write in between,
+// therefore there is a single record per version and the compacted topic keeps the same record as the watchers.
+func (p *PulsarTopicDriver) UpdateIfVersion(tenantPlan TenantPlan, expectedVersion int64) error {
+	producer, err := p.acquireWriter()
+	if err != nil {
+		return err
+	}
+	defer producer.Close()
+
+	latest, err := p.readLatest(tenantPlan.Name)
+	if err != nil {
+		return err
+	}
+	current := latest
+	if current.TenantStatus == Deleted {
+		current = TenantPlan{}
+	}
+	if err = CheckTenantVersion(current, expectedVersion); err != nil {
+		return err
+	}
+	if IsStaleTenantVersion(latest.Version, tenantPlan.Version) {
+		return fmt.Errorf("%w: version %d has been written", ErrVersionConflict, tenantPlan.Version)
+	}
+	return p.send(producer, tenantPlan)
+}
+
+// acquireWriter creates the producer with the shared writer name, retrying while another instance holds it
+func (p *PulsarTopicDriver) acquireWriter() (pulsar.Producer, error) {
+	deadline := time.Now().Add(tenantWriterTimeout)
+	for {
+		producer, err := p.client.CreateProducer(pulsar.ProducerOptions{
+			Topic:           p.topicName,
+			Name:            tenantWriterName,
+			DisableBatching: true,
+		})
+		if err == nil {
+			return producer, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("unable to acquire the tenant database writer %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// readLatest replays the topic to the end and returns the latest record of the tenant including a deleted one,
+// the records are also applied to the latest records served by Get
+func (p *PulsarTopicDriver) readLatest(tenantName string) (TenantPlan, error) {
+	reader, err := p.createReader(pulsar.EarliestMessageID())
+	if err != nil {
+		return TenantPlan{}, err
+	}
+	defer reader.Close()
+
+	latest := TenantPlan{}
+	ctx := context.Background()
+	for reader.HasNext() {
+		data, err := reader.Next(ctx)
+		if err != nil {
+			return TenantPlan{}, err
+		}
+		t := TenantPlan{}
+		if err = json.Unmarshal(data.Payload(), &t); err != nil {
+			continue
+		}
+		p.applyLatest(t)
+		if t.Name == tenantName && !IsStaleTenantVersion(latest.Version, t.Version) {
+			latest = t
+		}
+	}
+	return latest, nil
+}
+
+// send writes the tenant record keyed by the tenant name with the writer producer
+func (p *PulsarTopicDriver) send(producer pulsar.Producer, tenantPlan TenantPlan) error {
+	data, err := json.Marshal(tenantPlan)
+	if err != nil {
+		return err
+	}
+	msg := pulsar.ProducerMessage{
+		Payload: data,
+		Key:     tenantPlan.Name,
+	}
+
+	if _, err = producer.Send(context.Background(), &msg); err != nil {
+		return err
+	}
+	producer.Flush()
+	p.applyLatest(tenantPlan)
+
+	p.logger.Infof("send to Pulsar %s", tenantPlan.Name)
+	return nil
+}
+
+// applyLatest keeps the record unless it is stale, the same rule the tenant map applies to the topic order
+func (p *PulsarTopicDriver) applyLatest(t TenantPlan) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if existing, ok := p.tenants[t.Name]; ok && IsStaleTenantVersion(existing.Version, t.Version) {
+		return
+	}
+	p.tenants[t.Name] = t
+}
+
+// Delete sends the deleted tenant record to the topic, the record is kept for the plan history
+func (p *PulsarTopicDriver) Delete(tenantPlan TenantPlan) error {
+	tenantPlan.TenantStatus = Deleted
+	return p.Update(tenantPlan)
+}
+
+// Watch listens to the topic from the resumed position or the earliest message.
+// The reader is recreated from the last delivered message whenever it fails.
+func (p *PulsarTopicDriver) Watch(onChange func(TenantPlan), onReady func()) error {
+	var once sync.Once
+	ready := func() { once.Do(onReady) }
+	go func() {
+		sig := make(chan *liveSignal)
+		go p.dbListener(sig, onChange, ready)
+		for {
+			select {
+			case <-sig:
+				time.Sleep(time.Second)
+				go p.dbListener(sig, onChange, ready)
+			}
+		}
+	}()
+	return nil
+}
+
+// dbListener listens db updates
+func (p *PulsarTopicDriver) dbListener(sig chan *liveSignal, onChange func(TenantPlan), onReady func()) error {
+	defer func(termination chan *liveSignal) {
+		p.logger.Errorf("tenant db listener terminated")
+		termination <- &liveSignal{}
+	}(sig)
+	// resume from the last delivered message, either from the snapshot or before the reader failure
+	p.lock.RLock()
+	startMessageID := p.lastMessageID
+	p.lock.RUnlock()
+	if startMessageID == nil {
+		startMessageID = pulsar.EarliestMessageID()
+	}
+	p.logger.Infof("listens to tenant database changes from message id %v", startMessageID)
+	reader, err := p.createReader(startMessageID)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	ctx := context.Background()
+	caughtUp := false
+
+	// infinite loop to receive messages
+	for {
+		if !caughtUp && !reader.HasNext() {
+			caughtUp = true
+			p.lock.Lock()
+			// a resumed watcher has not read the records before the resumed position
+			p.replayed = !p.resumed
+			p.lock.Unlock()
+			onReady()
+		}
+		data, err := reader.Next(ctx)
+		if err != nil {
+			p.logger.Errorf("tenant db listener reader error %v", err)
+			return err
+		}
+		t := TenantPlan{}
+		if err = json.Unmarshal(data.Payload(), &t); err != nil {
+			p.logger.Errorf("tenant unmarshal error %v", err)
+		} else {
+			p.logger.Infof("tenant %s plan %v", t.Name, t)
+			p.applyLatest(t)
+			onChange(t)
+		}
+
+		p.lock.Lock()
+		p.lastMessageID = data.ID()
+		p.lock.Unlock()
+	}
+}
+
+// Position returns the serialized id of the last delivered message
+func (p *PulsarTopicDriver) Position() []byte {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if p.lastMessageID == nil {
+		return nil
+	}
+	return p.lastMessageID.Serialize()
+}
+
+// Resume sets the message id where the next Watch starts after
+func (p *PulsarTopicDriver) Resume(position []byte) error {
+	msgID, err := pulsar.DeserializeMessageID(position)
+	if err != nil {
+		return err
+	}
+	p.lock.Lock()
+	p.lastMessageID = msgID
+	p.resumed = true
+	p.lock.Unlock()
+	return nil
+}
+
+// Close closes the Pulsar client
+func (p *PulsarTopicDriver) Close() error {
+	p.client.Close()
+	return nil
+}
+
+// GetPlanPolicy gets the policy
+func (p *PulsarTopicDriver) GetPlanPolicy(tenantName string) PlanPolicy {
+	return getStorePlanPolicy(p, tenantName)
+}
+
+// Evaluate evaluates the tenant exists and is activated
+func (p *PulsarTopicDriver) Evaluate(tenantName string) error {
+	return evaluateStoreTenant(p, tenantName)
+}
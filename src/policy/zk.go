@@ -22,41 +22,283 @@
 package policy
 
 import (
+	"encoding/json"
+	"fmt"
+	"path"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/apex/log"
 	"github.com/samuel/go-zookeeper/zk"
 )
 
+// ZkConn is the zookeeper connection operations used by the driver, it is satisfied by *zk.Conn
+type ZkConn interface {
+	Get(path string) ([]byte, *zk.Stat, error)
+	GetW(path string) ([]byte, *zk.Stat, <-chan zk.Event, error)
+	Set(path string, data []byte, version int32) (*zk.Stat, error)
+	Create(path string, data []byte, flags int32, acl []zk.ACL) (string, error)
+	Delete(path string, version int32) error
+	Exists(path string) (bool, *zk.Stat, error)
+	Children(path string) ([]string, *zk.Stat, error)
+	ChildrenW(path string) ([]string, *zk.Stat, <-chan zk.Event, error)
+	Close()
+}
+
 // ZookeeperDriver is the zookeeper database connector
+// Every tenant plan is stored as a JSON document in a znode under the root path.
 type ZookeeperDriver struct {
-	zkDriver *zk.Conn
+	RootPath string
+	zkDriver ZkConn
+	// the tenant znodes being watched
+	watched map[string]bool
+	lock    sync.Mutex
+	done    chan struct{}
+	logger  *log.Entry
+}
+
+// NewZookeeperDriver creates a zookeeper driver over an established connection
+func NewZookeeperDriver(conn ZkConn, rootPath string) (*ZookeeperDriver, error) {
+	z := &ZookeeperDriver{RootPath: rootPath}
+	return z, z.init(conn)
 }
 
 // Conn connects to zookeeper
 func (z *ZookeeperDriver) Conn(hosts string) error {
 	hostList := strings.Split(hosts, ",")
-	// hostList := []string{"127.0.0.1"}
 
-	var err error
-	z.zkDriver, _, err = zk.Connect(hostList, 4*time.Second)
+	conn, _, err := zk.Connect(hostList, 4*time.Second)
+	if err != nil {
+		return err
+	}
+	return z.init(conn)
+}
+
+func (z *ZookeeperDriver) init(conn ZkConn) error {
+	z.zkDriver = conn
+	z.watched = make(map[string]bool)
+	z.done = make(chan struct{})
+	z.logger = log.WithFields(log.Fields{"app": "tenantdb", "store": ZookeeperStore})
+	return z.ensurePath(z.RootPath)
+}
+
+// ensurePath creates the znode and all its parents if they do not exist
+func (z *ZookeeperDriver) ensurePath(nodePath string) error {
+	current := ""
+	for _, v := range strings.Split(strings.Trim(nodePath, "/"), "/") {
+		current = current + "/" + v
+		exists, _, err := z.zkDriver.Exists(current)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if _, err = z.zkDriver.Create(current, nil, 0, zk.WorldACL(zk.PermAll)); err != nil && err != zk.ErrNodeExists {
+			return err
+		}
+	}
+	return nil
+}
+
+func (z *ZookeeperDriver) tenantPath(tenantName string) string {
+	return path.Join(z.RootPath, tenantName)
+}
+
+// Get gets the tenant plan from the tenant znode
+func (z *ZookeeperDriver) Get(tenantName string) (TenantPlan, error) {
+	data, _, err := z.zkDriver.Get(z.tenantPath(tenantName))
+	if err == zk.ErrNoNode {
+		return TenantPlan{}, ErrTenantNotFound
+	} else if err != nil {
+		return TenantPlan{}, err
+	}
+	t := TenantPlan{}
+	err = json.Unmarshal(data, &t)
+	return t, err
+}
+
+// List lists all the tenant plans under the root path
+func (z *ZookeeperDriver) List() ([]TenantPlan, error) {
+	children, _, err := z.zkDriver.Children(z.RootPath)
+	if err != nil {
+		return nil, err
+	}
+	plans := []TenantPlan{}
+	for _, v := range children {
+		t, err := z.Get(v)
+		if err == ErrTenantNotFound {
+			// deleted after the children are listed
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		plans = append(plans, t)
+	}
+	return plans, nil
+}
+
+// Update creates or overwrites the tenant znode
+func (z *ZookeeperDriver) Update(tenantPlan TenantPlan) error {
+	data, err := json.Marshal(tenantPlan)
 	if err != nil {
 		return err
 	}
-	/*_, __, _, err := zkDriver.ChildrenW("/")
+	nodePath := z.tenantPath(tenantPlan.Name)
+	_, err = z.zkDriver.Set(nodePath, data, -1)
+	if err == zk.ErrNoNode {
+		_, err = z.zkDriver.Create(nodePath, data, 0, zk.WorldACL(zk.PermAll))
+		if err == zk.ErrNodeExists {
+			_, err = z.zkDriver.Set(nodePath, data, -1)
+		}
+	}
+	return err
+}
+
+// UpdateIfVersion updates the tenant znode only if the stored plan is at the expected version.
+// The znode version read with the plan guards against a concurrent update between the read and the write.
+func (z *ZookeeperDriver) UpdateIfVersion(tenantPlan TenantPlan, expectedVersion int64) error {
+	data, err := json.Marshal(tenantPlan)
 	if err != nil {
 		return err
 	}
-	*/
+	nodePath := z.tenantPath(tenantPlan.Name)
+	current, stat, err := z.zkDriver.Get(nodePath)
+	if err == zk.ErrNoNode {
+		if err = CheckTenantVersion(TenantPlan{}, expectedVersion); err != nil {
+			return err
+		}
+		_, err = z.zkDriver.Create(nodePath, data, 0, zk.WorldACL(zk.PermAll))
+		if err == zk.ErrNodeExists {
+			return fmt.Errorf("%w: tenant %s has been created concurrently", ErrVersionConflict, tenantPlan.Name)
+		}
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	stored := TenantPlan{}
+	if err = json.Unmarshal(current, &stored); err != nil {
+		return err
+	}
+	if err = CheckTenantVersion(stored, expectedVersion); err != nil {
+		return err
+	}
+	_, err = z.zkDriver.Set(nodePath, data, stat.Version)
+	if err == zk.ErrBadVersion || err == zk.ErrNoNode {
+		return fmt.Errorf("%w: tenant %s has been changed concurrently", ErrVersionConflict, tenantPlan.Name)
+	}
+	return err
+}
+
+// Delete deletes the tenant znode
+func (z *ZookeeperDriver) Delete(tenantPlan TenantPlan) error {
+	err := z.zkDriver.Delete(z.tenantPath(tenantPlan.Name), -1)
+	if err == zk.ErrNoNode {
+		return ErrTenantNotFound
+	}
+	return err
+}
+
+// Watch watches the root path for new tenants and every tenant znode for changes and deletion
+func (z *ZookeeperDriver) Watch(onChange func(TenantPlan), onReady func()) error {
+	go z.watchChildren(onChange, onReady)
+	return nil
+}
+
+func (z *ZookeeperDriver) watchChildren(onChange func(TenantPlan), onReady func()) {
+	var once sync.Once
+	for {
+		children, _, ch, err := z.zkDriver.ChildrenW(z.RootPath)
+		if err != nil {
+			z.logger.Errorf("failed to watch zookeeper path %s error %v", z.RootPath, err)
+			if z.sleep(time.Second) {
+				return
+			}
+			continue
+		}
+
+		var initial sync.WaitGroup
+		z.lock.Lock()
+		for _, v := range children {
+			if !z.watched[v] {
+				z.watched[v] = true
+				initial.Add(1)
+				go z.watchTenant(v, onChange, initial.Done)
+			}
+		}
+		z.lock.Unlock()
+		initial.Wait()
+		once.Do(onReady)
+
+		select {
+		case <-ch:
+		case <-z.done:
+			return
+		}
+	}
+}
+
+// watchTenant delivers the tenant znode content until the znode is deleted, delivered is called after the first read
+func (z *ZookeeperDriver) watchTenant(tenantName string, onChange func(TenantPlan), delivered func()) {
+	var once sync.Once
+	defer once.Do(delivered)
+	for {
+		data, _, ch, err := z.zkDriver.GetW(z.tenantPath(tenantName))
+		if err == zk.ErrNoNode {
+			z.lock.Lock()
+			delete(z.watched, tenantName)
+			z.lock.Unlock()
+			onChange(TenantPlan{Name: tenantName, TenantStatus: Deleted})
+			return
+		} else if err != nil {
+			z.logger.Errorf("failed to watch tenant %s error %v", tenantName, err)
+			if z.sleep(time.Second) {
+				return
+			}
+			continue
+		}
+
+		t := TenantPlan{}
+		if err = json.Unmarshal(data, &t); err != nil {
+			z.logger.Errorf("tenant %s unmarshal error %v", tenantName, err)
+		} else {
+			onChange(t)
+		}
+		once.Do(delivered)
+
+		select {
+		case <-ch:
+		case <-z.done:
+			return
+		}
+	}
+}
+
+// sleep waits for the duration and returns true if the driver is closed
+func (z *ZookeeperDriver) sleep(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return false
+	case <-z.done:
+		return true
+	}
+}
+
+// Close closes the zookeeper connection and stops watching
+func (z *ZookeeperDriver) Close() error {
+	close(z.done)
+	z.zkDriver.Close()
 	return nil
 }
 
 // GetPlanPolicy gets the policy
 func (z *ZookeeperDriver) GetPlanPolicy(tenantName string) PlanPolicy {
-	return PlanPolicy{}
+	return getStorePlanPolicy(z, tenantName)
 }
 
-// Evaluate gets the policy
+// Evaluate evaluates the tenant exists and is activated
 func (z *ZookeeperDriver) Evaluate(tenantName string) error {
-	return nil
+	return evaluateStoreTenant(z, tenantName)
 }
@@ -32,15 +32,19 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/datastax/burnell/src/icrypto"
 	"github.com/datastax/burnell/src/logclient"
 	"github.com/datastax/burnell/src/metrics"
 	"github.com/datastax/burnell/src/policy"
 	"github.com/datastax/burnell/src/util"
+	"github.com/datastax/burnell/src/webhook"
 	"github.com/gorilla/mux"
 	"github.com/kafkaesque-io/pulsar-beam/src/model"
 	"github.com/kafkaesque-io/pulsar-beam/src/route"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"github.com/apex/log"
 )
@@ -62,6 +66,7 @@ type TopicStatsResponse struct {
 	SessionID string                 `json:"sessionId"`
 	Offset    int                    `json:"offset"`
 	Total     int                    `json:"total"`
+	Topics    []string               `json:"topics"`
 	Data      map[string]interface{} `json:"data"`
 }
 
@@ -125,6 +130,16 @@ func StatusPage(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+// ReadinessHandler reports ready once the tenant database has caught up with the topic
+func ReadinessHandler(w http.ResponseWriter, r *http.Request) {
+	if util.IsStatsMode() || policy.TenantManager.IsReady() {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	w.Header().Set("Retry-After", "5")
+	w.WriteHeader(http.StatusServiceUnavailable)
+}
+
 // DirectBrokerProxyHandler - Pulsar broker admin REST API
 func DirectBrokerProxyHandler(w http.ResponseWriter, r *http.Request) {
 	requestURL := util.SingleJoinSlash(util.Config.BrokerProxyURL, r.URL.RequestURI())
@@ -140,13 +155,14 @@ func DirectFunctionProxyHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "missing subject", http.StatusUnauthorized)
 			return
 		}
-		_, role := ExtractTenant(subject)
-		isSuperUser := util.StrContains(util.SuperRoles, role)
+		// the tenant has been verified against the subject and its organization by AuthVerifyTenantJWT
+		isSuperUser := hasSuperRole(subject)
 		vars := mux.Vars(r)
 		if tenant, ok := vars["tenant"]; ok {
 			limit := policy.TenantManager.GetFunctionsLimit(tenant)
 			log.Infof("tenant %s with function limit %d, actual counts %d, is superuser %v", tenant, logclient.TenantFunctionCount(tenant), limit, isSuperUser)
 			if logclient.TenantFunctionCount(tenant) >= limit && !isSuperUser {
+				notifyQuotaLimitReached(tenant, policy.QuotaFunctions, limit)
 				http.Error(w, "over the number of function limit under the current plan, please upgrade your plan", http.StatusPaymentRequired)
 				return
 			}
@@ -375,6 +391,50 @@ func NamespacePolicyProxyHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// RetentionPolicyProxyHandler enforces the namespace retention time within the tenant plan,
+// infinite retention requires the infinite message retention feature code the same way as FeatureCodeRequired
+func RetentionPolicyProxyHandler(w http.ResponseWriter, r *http.Request) {
+	subject := r.Header.Get(injectedSubs)
+	if subject == "" {
+		http.Error(w, "missing subject", http.StatusUnauthorized)
+		return
+	}
+	if hasSuperRole(subject) {
+		DirectBrokerProxyHandler(w, r)
+		return
+	}
+	tenant, ok := mux.Vars(r)["tenant"]
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	var retention policy.NamespaceRetention
+	if err = json.Unmarshal(body, &retention); err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	if retention.IsInfinite() && !verifyFeatureCode(w, subject, policy.InfiniteMessageRetention, []string{tenant}) {
+		return
+	}
+	if !policy.TenantManager.EvaluateRetention(tenant, retention) {
+		http.Error(w, "over the quota limit", http.StatusPaymentRequired)
+		return
+	}
+
+	// restore the body for the proxy
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	DirectBrokerProxyHandler(w, r)
+}
+
 // BrokerAggregatorHandler aggregates all broker-stats and reply
 func BrokerAggregatorHandler(w http.ResponseWriter, r *http.Request) {
 	// RequestURI() should have /admin/v2 to be passed as broker's URL route
@@ -399,17 +459,36 @@ func BrokerAggregatorHandler(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+// BrokersSummaryHandler summarizes the load, bundle and topic distribution over all the brokers
+func BrokersSummaryHandler(w http.ResponseWriter, r *http.Request) {
+	u, _ := url.Parse(r.URL.String())
+	top := queryParamInt(u.Query(), "top", 5)
+	if top < 0 {
+		util.ResponseErrorJSON(fmt.Errorf("top cannot be negative"), w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	summary := policy.ClusterBrokersSummary(top)
+	data, err := json.Marshal(summary)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
 // TopicProxyHandler enforces the number of topic based on the plan type
 func TopicProxyHandler(w http.ResponseWriter, r *http.Request) {
-	limitEnforceProxyHandler(w, r, policy.TenantManager.EvaluateAlwaysSuccessful)
+	limitEnforceProxyHandler(w, r, policy.QuotaTopics, policy.TenantManager.EvaluateAlwaysSuccessful)
 }
 
 // NamespaceLimitEnforceProxyHandler enforces the number of namespace limit based on the plan type
 func NamespaceLimitEnforceProxyHandler(w http.ResponseWriter, r *http.Request) {
-	limitEnforceProxyHandler(w, r, policy.TenantManager.EvaluateNamespaceLimit)
+	limitEnforceProxyHandler(w, r, policy.QuotaNamespaces, policy.TenantManager.EvaluateNamespaceLimit)
 }
 
-func limitEnforceProxyHandler(w http.ResponseWriter, r *http.Request, eval func(tenant string) (bool, error)) {
+func limitEnforceProxyHandler(w http.ResponseWriter, r *http.Request, dimension string, eval func(tenant string) (bool, error)) {
 	if r.Method == http.MethodGet {
 		CachedProxyGETHandler(w, r)
 		return
@@ -432,6 +511,8 @@ func limitEnforceProxyHandler(w http.ResponseWriter, r *http.Request, eval func(
 		} else if ok {
 			DirectBrokerProxyHandler(w, r)
 		} else {
+			plan, _ := policy.TenantManager.GetOrCreateTenant(tenant)
+			notifyQuotaLimitReached(tenant, dimension, policy.PlanLimit(plan.Policy, dimension))
 			http.Error(w, "over the quota limit", http.StatusPaymentRequired)
 		}
 	} else {
@@ -439,6 +520,18 @@ func limitEnforceProxyHandler(w http.ResponseWriter, r *http.Request, eval func(
 	}
 }
 
+// notifyQuotaLimitReached notifies the webhook subscriptions of a request denied by the plan limit
+func notifyQuotaLimitReached(tenant, dimension string, limit int) {
+	if policy.IsQuotaLimitReportDue(tenant, dimension, time.Now()) {
+		webhook.Manager.Publish(webhook.NewEvent(webhook.QuotaLimitReached, tenant, policy.QuotaUsage{
+			Dimension: dimension,
+			Limit:     limit,
+			Usage:     limit,
+			Percent:   100,
+		}))
+	}
+}
+
 // FunctionStatusHandler returns a function's status including worker ID as the FunctionLogHandler sees
 func FunctionStatusHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
@@ -541,11 +634,6 @@ func PulsarFederatedPrometheusHandler(w http.ResponseWriter, r *http.Request) {
 		tenant = metrics.SuperRole
 	}
 
-	//TODO: disable the feature since the backend database has to populated
-	/*if !policy.TenantManager.EvaluateFeatureCode(tenant, policy.BrokerMetrics) {
-		http.Error(w, "", http.StatusForbidden)
-	}
-	*/
 	tenantFederatedPrometheus(tenant, w)
 }
 
@@ -630,14 +718,29 @@ func TenantTopicStatsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	totalSize, newOffset, topics := policy.PaginateTopicStats(tenant, offset, pageSize, topicList)
-	if totalSize > 0 {
+	query, err := topicStatsQueryParams(params)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	page, err := policy.PaginateTopicStats(tenant, queryParamString(params, "sessionId", ""), query, offset, pageSize, topicList)
+	if err != nil {
+		statusCode := http.StatusUnprocessableEntity
+		if errors.Is(err, policy.ErrStatsSessionNotFound) {
+			statusCode = http.StatusNotFound
+		}
+		util.ResponseErrorJSON(err, w, statusCode)
+		return
+	}
+	if page.Total > 0 && page.Data != nil {
 		data, err := json.Marshal(TopicStatsResponse{
 			Tenant:    tenant,
-			SessionID: "reserverd for snapshot iteration",
-			Offset:    newOffset,
-			Total:     totalSize,
-			Data:      topics,
+			SessionID: page.SessionID,
+			Offset:    page.Offset,
+			Total:     page.Total,
+			Topics:    page.Topics,
+			Data:      page.Data,
 		})
 		if err != nil {
 			http.Error(w, "failed to marshal cached data", http.StatusInternalServerError)
@@ -651,6 +754,307 @@ func TenantTopicStatsHandler(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+// StatsRollupHandler aggregates the topic stats per namespace of the tenant in the path,
+// or per tenant without the tenant in the path
+func StatsRollupHandler(w http.ResponseWriter, r *http.Request) {
+	tenant := mux.Vars(r)["tenant"]
+	u, _ := url.Parse(r.URL.String())
+	params := u.Query()
+
+	query, err := topicStatsQueryParams(params)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	offset := queryParamInt(params, "offset", 0)
+	limit := queryParamInt(params, "limit", 50)
+
+	var result policy.StatsRollupList
+	if tenant == "" {
+		result, err = policy.RollupTenants(query, offset, limit)
+	} else {
+		result, err = policy.RollupNamespaces(tenant, query, offset, limit)
+	}
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// queryParamPeriod parses the idle period as a duration, or returns the default period
+func queryParamPeriod(params url.Values) (time.Duration, error) {
+	if period := queryParamString(params, "period", ""); period != "" {
+		return time.ParseDuration(period)
+	}
+	return policy.DefaultIdlePeriod, nil
+}
+
+// IdleTopicsHandler reports the tenant's idle topics and the subscriptions with a growing backlog but no consumers
+func IdleTopicsHandler(w http.ResponseWriter, r *http.Request) {
+	tenant := mux.Vars(r)["tenant"]
+	u, _ := url.Parse(r.URL.String())
+	period, err := queryParamPeriod(u.Query())
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	report, err := policy.IdleTopicsReport(tenant, period, time.Now())
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	data, err := json.Marshal(report)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// IdleTopicsCleanupHandler deletes the idle topics and unsubscribes the orphaned subscriptions in the request body,
+// or everything in the idle report without a body. It is a dry run unless dryRun=false is specified.
+func IdleTopicsCleanupHandler(w http.ResponseWriter, r *http.Request) {
+	tenant := mux.Vars(r)["tenant"]
+	u, _ := url.Parse(r.URL.String())
+	params := u.Query()
+	dryRun := queryParamString(params, "dryRun", "true") != "false"
+	period, err := queryParamPeriod(params)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	var req policy.IdleCleanupRequest
+	if err := decoder.Decode(&req); err != nil && err != io.EOF {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	result, err := policy.CleanupIdleTopics(tenant, req, period, dryRun, time.Now())
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	if !dryRun {
+		log.Infof("idle topics cleanup of tenant %s by %s %v", tenant, r.Header.Get(injectedSubs), result.Actions)
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// TopicEventsHandler returns the tenant's topic lifecycle events after the sequence
+func TopicEventsHandler(w http.ResponseWriter, r *http.Request) {
+	tenant := mux.Vars(r)["tenant"]
+	u, _ := url.Parse(r.URL.String())
+	params := u.Query()
+	after := queryParamInt(params, "after", 0)
+	limit := queryParamInt(params, "limit", 100)
+	if after < 0 || limit < 0 {
+		util.ResponseErrorJSON(fmt.Errorf("after or limit cannot be negative"), w, http.StatusUnprocessableEntity)
+		return
+	}
+	var types []string
+	if eventTypes := queryParamString(params, "type", ""); eventTypes != "" {
+		types = strings.Split(eventTypes, ",")
+	}
+
+	data, err := json.Marshal(policy.TopicEvents(tenant, int64(after), types, limit))
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// TopicOwnershipHandler returns the broker and the bundle range owning each of the tenant's topics,
+// the topic query parameter can be repeated to resolve the topics not in the cache
+func TopicOwnershipHandler(w http.ResponseWriter, r *http.Request) {
+	tenant := mux.Vars(r)["tenant"]
+	u, _ := url.Parse(r.URL.String())
+	params := u.Query()
+
+	ownership, err := policy.TenantTopicOwnership(tenant, queryParamString(params, "namespace", ""), params["topic"], time.Now())
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	data, err := json.Marshal(ownership)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// ConnectionStatsHandler lists the producers and consumers connected to the tenant's topics
+func ConnectionStatsHandler(w http.ResponseWriter, r *http.Request) {
+	tenant := mux.Vars(r)["tenant"]
+	u, _ := url.Parse(r.URL.String())
+	params := u.Query()
+
+	query := policy.ConnectionQuery{
+		Namespace:     queryParamString(params, "namespace", ""),
+		Topic:         queryParamString(params, "topic", ""),
+		Type:          queryParamString(params, "type", ""),
+		Address:       queryParamString(params, "address", ""),
+		ClientVersion: queryParamString(params, "clientVersion", ""),
+		Role:          queryParamString(params, "role", ""),
+		Offset:        queryParamInt(params, "offset", 0),
+		Limit:         queryParamInt(params, "limit", 50),
+	}
+	result, err := policy.QueryConnections(tenant, query, time.Now())
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// SubscriptionStatsHandler lists the tenant's subscriptions with the lag, consumers and backlog trend
+func SubscriptionStatsHandler(w http.ResponseWriter, r *http.Request) {
+	tenant := mux.Vars(r)["tenant"]
+	u, _ := url.Parse(r.URL.String())
+	params := u.Query()
+
+	query := policy.SubscriptionQuery{
+		Namespace:  queryParamString(params, "namespace", ""),
+		Topic:      queryParamString(params, "topic", ""),
+		NameGlob:   queryParamString(params, "name", ""),
+		Type:       queryParamString(params, "type", ""),
+		SortBy:     queryParamString(params, "sort", "name"),
+		Descending: queryParamString(params, "order", "asc") == "desc",
+		Offset:     queryParamInt(params, "offset", 0),
+		Limit:      queryParamInt(params, "limit", 50),
+	}
+	var err error
+	if query.Min, query.Max, err = queryParamThresholds(params); err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	result, err := policy.QuerySubscriptions(tenant, query, time.Now())
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// TopicStatsMetricsHandler exposes the cached topic and subscription stats of a tenant, or all the tenants
+// without the tenant in the path, in Prometheus text format
+func TopicStatsMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(policy.TopicStatsCollector{Tenant: mux.Vars(r)["tenant"]})
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// PartitionedTopicStatsHandler returns the tenant's partitioned topics with the partition stats rolled up
+func PartitionedTopicStatsHandler(w http.ResponseWriter, r *http.Request) {
+	tenant := mux.Vars(r)["tenant"]
+	data, err := json.Marshal(policy.RollupPartitionedTopics(tenant))
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// TopicStatsHistoryHandler returns the time series of a topic or a namespace stats
+func TopicStatsHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	tenant := mux.Vars(r)["tenant"]
+	u, _ := url.Parse(r.URL.String())
+	params := u.Query()
+
+	query := policy.StatsHistoryQuery{
+		Tenant: tenant,
+		Series: queryParamString(params, "topic", ""),
+		To:     time.Now(),
+	}
+	if ns := queryParamString(params, "namespace", ""); ns != "" {
+		if query.Series != "" {
+			util.ResponseErrorJSON(fmt.Errorf("either topic or namespace can be specified"), w, http.StatusUnprocessableEntity)
+			return
+		}
+		query.Series = ns
+		if !strings.HasPrefix(ns, tenant+"/") {
+			query.Series = tenant + "/" + ns
+		}
+	}
+	if query.Series == "" {
+		util.ResponseErrorJSON(fmt.Errorf("missing topic or namespace"), w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	var err error
+	if to := queryParamString(params, "to", ""); to != "" {
+		if query.To, err = time.Parse(time.RFC3339, to); err != nil {
+			util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	query.From = query.To.Add(-time.Hour)
+	if from := queryParamString(params, "from", ""); from != "" {
+		if query.From, err = time.Parse(time.RFC3339, from); err != nil {
+			util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	if step := queryParamString(params, "step", ""); step != "" {
+		if query.Step, err = time.ParseDuration(step); err != nil {
+			util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	history, err := policy.TopicStatsHistory.Query(query)
+	if err != nil {
+		statusCode := http.StatusUnprocessableEntity
+		if errors.Is(err, policy.ErrStatsHistoryNotFound) {
+			statusCode = http.StatusNotFound
+		}
+		util.ResponseErrorJSON(err, w, statusCode)
+		return
+	}
+	data, err := json.Marshal(history)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
 // GroupTopicsByNamespaceHandler groups topics under a tenant's namespace
 func GroupTopicsByNamespaceHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
@@ -692,6 +1096,44 @@ func queryParamString(params url.Values, name string, defaultV string) string {
 	return defaultV
 }
 
+// topicStatsQueryParams parses the filter, sort and projection of topic stats from the query parameters.
+// The thresholds are specified as min.<field>=n and max.<field>=n, and the projection as fields=a,b
+func topicStatsQueryParams(params url.Values) (policy.TopicStatsQuery, error) {
+	query := policy.TopicStatsQuery{
+		Namespace:  queryParamString(params, "namespace", ""),
+		NameGlob:   queryParamString(params, "name", ""),
+		SortBy:     queryParamString(params, "sort", "name"),
+		Descending: queryParamString(params, "order", "asc") == "desc",
+	}
+	if fields := queryParamString(params, "fields", ""); fields != "" {
+		query.Fields = strings.Split(fields, ",")
+	}
+	var err error
+	query.Min, query.Max, err = queryParamThresholds(params)
+	return query, err
+}
+
+// queryParamThresholds parses the thresholds specified as min.<field>=n and max.<field>=n
+func queryParamThresholds(params url.Values) (map[string]float64, map[string]float64, error) {
+	min, max := make(map[string]float64), make(map[string]float64)
+	for k, v := range params {
+		var thresholds map[string]float64
+		if strings.HasPrefix(k, "min.") {
+			thresholds = min
+		} else if strings.HasPrefix(k, "max.") {
+			thresholds = max
+		} else {
+			continue
+		}
+		n, err := strconv.ParseFloat(v[0], 64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid threshold %s=%s", k, v[0])
+		}
+		thresholds[k[len("min."):]] = n
+	}
+	return min, max, nil
+}
+
 // TenantManagementHandler manages tenant CRUD operations.
 func TenantManagementHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
@@ -724,12 +1166,17 @@ func TenantManagementHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 	case http.MethodDelete:
-		if newPlan, err = policy.TenantManager.DeleteTenant(tenant); err != nil {
+		if newPlan, err = policy.TenantManager.DeleteTenant(tenant, r.Header.Get(injectedSubs)); err != nil {
 			util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
 			return
 		}
 
 	case http.MethodPost:
+		expectedVersion, err := parseIfMatch(r.Header.Get("If-Match"))
+		if err != nil {
+			util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+			return
+		}
 		decoder := json.NewDecoder(r.Body)
 		defer r.Body.Close()
 
@@ -740,7 +1187,7 @@ func TenantManagementHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		var statusCode int
-		if newPlan, statusCode, err = policy.TenantManager.UpdateTenant(tenant, *doc); err != nil {
+		if newPlan, statusCode, err = policy.TenantManager.UpdateTenant(tenant, *doc, r.Header.Get(injectedSubs), expectedVersion); err != nil {
 			log.Errorf("updateTenant %v", err)
 			util.ResponseErrorJSON(err, w, statusCode)
 			return
@@ -751,10 +1198,97 @@ func TenantManagementHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if data, err := json.Marshal(newPlan); err == nil {
+		w.Header().Set("ETag", tenantPlanETag(newPlan))
 		w.Write(data)
 	}
 }
 
+// tenantPlanETag builds an entity tag from the tenant plan version
+func tenantPlanETag(plan policy.TenantPlan) string {
+	return strconv.Quote(strconv.FormatInt(plan.Version, 10))
+}
+
+// parseIfMatch parses the If-Match header into the expected tenant plan version.
+// A missing header or `*` matches any version.
+func parseIfMatch(ifMatch string) (int64, error) {
+	ifMatch = strings.TrimSpace(ifMatch)
+	if ifMatch == "" || ifMatch == "*" {
+		return policy.AnyVersion, nil
+	}
+	version, err := strconv.ParseInt(strings.Trim(strings.TrimPrefix(ifMatch, "W/"), `"`), 10, 64)
+	if err != nil || version < 0 {
+		return 0, fmt.Errorf("invalid If-Match header %s", ifMatch)
+	}
+	return version, nil
+}
+
+// TenantHistoryHandler returns the change history of a tenant plan
+func TenantHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tenant, ok := vars["tenant"]
+	if !ok {
+		http.Error(w, "missing tenant name", http.StatusUnprocessableEntity)
+		return
+	}
+
+	plan, err := policy.TenantManager.GetTenant(tenant)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusNotFound)
+		return
+	}
+
+	data, err := json.Marshal(plan.History)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// TenantHistoryDiffHandler returns the differences between two versions of a tenant plan
+func TenantHistoryDiffHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tenant, ok := vars["tenant"]
+	if !ok {
+		http.Error(w, "missing tenant name", http.StatusUnprocessableEntity)
+		return
+	}
+	u, _ := url.Parse(r.URL.String())
+	params := u.Query()
+	from := int64(queryParamInt(params, "from", -1))
+	to := int64(queryParamInt(params, "to", -1))
+	if from < 0 || to < 0 {
+		util.ResponseErrorJSON(errors.New("from and to versions are required"), w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	plan, err := policy.TenantManager.GetTenant(tenant)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusNotFound)
+		return
+	}
+
+	changes, err := policy.DiffTenantHistory(plan.History, from, to)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusNotFound)
+		return
+	}
+
+	data, err := json.Marshal(policy.TenantPlanDiff{
+		Tenant:  tenant,
+		From:    from,
+		To:      to,
+		Changes: changes,
+	})
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
 // PulsarBeamGetTopicHandler gets the topic details
 func PulsarBeamGetTopicHandler(w http.ResponseWriter, r *http.Request) {
 	topicKey, err := route.GetTopicKey(r)
@@ -770,10 +1304,13 @@ func PulsarBeamGetTopicHandler(w http.ResponseWriter, r *http.Request) {
 		util.ResponseErrorJSON(err, w, http.StatusNotFound)
 		return
 	}
-	if !route.VerifySubjectBasedOnTopic(doc.TopicFullName, r.Header.Get("injectedSubs"), extractEvalTenant) {
+	if !route.VerifySubjectBasedOnTopic(doc.TopicFullName, r.Header.Get("injectedSubs"), evalTenantRole(requiredOrgRole(r.Method))) {
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
+	if !verifyTopicFeatureCode(w, r, doc.TopicFullName, policy.PulsarBeam) {
+		return
+	}
 
 	resJSON, err := json.Marshal(doc)
 	if err != nil {
@@ -802,10 +1339,13 @@ func PulsarBeamUpdateTopicHandler(w http.ResponseWriter, r *http.Request) {
 		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
 		return
 	}
-	if !route.VerifySubjectBasedOnTopic(doc.TopicFullName, r.Header.Get("injectedSubs"), extractEvalTenant) {
+	if !route.VerifySubjectBasedOnTopic(doc.TopicFullName, r.Header.Get("injectedSubs"), evalTenantRole(requiredOrgRole(r.Method))) {
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
+	if !verifyTopicFeatureCode(w, r, doc.TopicFullName, policy.PulsarBeam) {
+		return
+	}
 
 	if _, err = model.ValidateTopicConfig(doc); err != nil {
 		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
@@ -851,10 +1391,13 @@ func PulsarBeamDeleteTopicHandler(w http.ResponseWriter, r *http.Request) {
 		util.ResponseErrorJSON(err, w, http.StatusNotFound)
 		return
 	}
-	if !route.VerifySubjectBasedOnTopic(doc.TopicFullName, r.Header.Get("injectedSubs"), extractEvalTenant) {
+	if !route.VerifySubjectBasedOnTopic(doc.TopicFullName, r.Header.Get("injectedSubs"), evalTenantRole(requiredOrgRole(r.Method))) {
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
+	if !verifyTopicFeatureCode(w, r, doc.TopicFullName, policy.PulsarBeam) {
+		return
+	}
 
 	deletedKey, err := policy.PulsarBeamManager.DeleteByKey(topicKey)
 	if err != nil {
@@ -885,20 +1428,32 @@ func VerifyTenant(r *http.Request) (string, string, bool) {
 
 // VerifySubject verifies the subject can meet the requirement.
 func VerifySubject(requiredSubject, tokenSubjects string) bool {
+	return VerifySubjectRole(requiredSubject, tokenSubjects, policy.ViewerRole)
+}
+
+// VerifySubjectRole verifies the subject can meet the requirement either by the tenant naming convention
+// or by at least the required role in the organization owning the tenant.
+func VerifySubjectRole(requiredSubject, tokenSubjects string, role policy.OrgRole) bool {
 	for _, v := range strings.Split(tokenSubjects, ",") {
 		if util.StrContains(util.SuperRoles, v) {
 			return true
 		}
-		subCase1, subCase2 := ExtractTenant(v)
-		return requiredSubject == subCase1 || requiredSubject == subCase2
+		if policy.OrgManager.HasTenantRole(requiredSubject, v, role) {
+			return true
+		}
+		if subCase1, subCase2 := ExtractTenant(v); requiredSubject == subCase1 || requiredSubject == subCase2 {
+			return true
+		}
 	}
 	return false
 }
 
-// this is a callback for Pulsar Beam's route.VerifySubjectBasedOnTopic
-func extractEvalTenant(requiredSubject, tokenSub string) bool {
-	subCase1, subCase2 := ExtractTenant(tokenSub)
-	return requiredSubject == subCase1 || requiredSubject == subCase2
+// evalTenantRole returns a callback for Pulsar Beam's route.VerifySubjectBasedOnTopic
+// that verifies the subject either by the tenant naming convention or by the role in the organization owning the tenant
+func evalTenantRole(role policy.OrgRole) func(requiredSubject, tokenSub string) bool {
+	return func(requiredSubject, tokenSub string) bool {
+		return VerifySubjectRole(requiredSubject, tokenSub, role)
+	}
 }
 
 // ExtractTenant attempts to extract tenant based on delimiter `-` and `-client-`
@@ -23,10 +23,12 @@ package route
 
 //middleware includes auth, rate limit, and etc.
 import (
+	"fmt"
 	"net/http"
 	"strings"
 
 	"github.com/apex/log"
+	"github.com/datastax/burnell/src/policy"
 	"github.com/datastax/burnell/src/util"
 	"github.com/gorilla/mux"
 )
@@ -78,7 +80,7 @@ func AuthVerifyTenantJWT(next http.Handler) http.Handler {
 		r.Header.Set(injectedSubs, subjects)
 		vars := mux.Vars(r)
 		if tenantName, ok := vars["tenant"]; ok {
-			if VerifySubject(tenantName, subjects) {
+			if VerifySubjectRole(tenantName, subjects, requiredOrgRole(r.Method)) {
 				next.ServeHTTP(w, r)
 				return
 			}
@@ -103,6 +105,7 @@ func SuperRoleRequired(next http.Handler) http.Handler {
 
 		if err == nil && util.StrContains(util.SuperRoles, subject) {
 			log.Infof("superroles Authenticated")
+			r.Header.Set(injectedSubs, subject)
 			next.ServeHTTP(w, r)
 		} else {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
@@ -111,6 +114,65 @@ func SuperRoleRequired(next http.Handler) http.Handler {
 	})
 }
 
+// hasSuperRole returns true if any of the token subjects is a super role
+func hasSuperRole(subjects string) bool {
+	for _, v := range strings.Split(subjects, ",") {
+		if util.StrContains(util.SuperRoles, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// requiredOrgRole is the minimum organization role to access a tenant with the http method
+func requiredOrgRole(method string) policy.OrgRole {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return policy.ViewerRole
+	default:
+		return policy.AdminRole
+	}
+}
+
+// AuthVerifyOrgJWT ensures the token subject is a member of the organization, an admin for any change
+func AuthVerifyOrgJWT(next http.Handler) http.Handler {
+	return authVerifyOrgRole(next, func(r *http.Request) policy.OrgRole {
+		return requiredOrgRole(r.Method)
+	})
+}
+
+// OrgOwnerRequired ensures the token subject is an owner of the organization
+func OrgOwnerRequired(next http.Handler) http.Handler {
+	return authVerifyOrgRole(next, func(r *http.Request) policy.OrgRole {
+		return policy.OwnerRole
+	})
+}
+
+func authVerifyOrgRole(next http.Handler, requiredRole func(r *http.Request) policy.OrgRole) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !util.IsPulsarJWTEnabled() {
+			r.Header.Set(injectedSubs, util.DummySuperRole)
+			next.ServeHTTP(w, r)
+			return
+		}
+		tokenStr := strings.TrimSpace(strings.Replace(r.Header.Get("Authorization"), "Bearer", "", 1))
+		subject, err := util.JWTAuth.GetTokenSubject(tokenStr)
+		if err != nil {
+			http.Error(w, "failed to obtain subject", http.StatusUnauthorized)
+			return
+		}
+
+		r.Header.Set(injectedSubs, subject)
+		orgName := mux.Vars(r)["org"]
+		if util.StrContains(util.SuperRoles, subject) || policy.OrgManager.HasOrgRole(orgName, subject, requiredRole(r)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		log.Errorf("Authenticated subject %s does not have the required role in organization %s", subject, orgName)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	})
+}
+
 // AuthHeaderRequired is a very weak auth to verify token existence only.
 func AuthHeaderRequired(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -153,3 +215,85 @@ func ResponseJSONContentType(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// routes served before the tenant database catches up
+var readinessExemptRoutes = map[string]bool{
+	"liveness":  true,
+	"readiness": true,
+	"metrics":   true,
+}
+
+// TenantDBReady rejects requests until the tenant database has caught up with the topic
+// so that plan enforcement never works against a partial tenant map
+func TenantDBReady(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if util.IsStatsMode() || policy.TenantManager.IsReady() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if route := mux.CurrentRoute(r); route != nil && readinessExemptRoutes[route.GetName()] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "tenant database is not ready", http.StatusServiceUnavailable)
+	})
+}
+
+// FeatureCodeRequired rejects requests unless the tenant plan enables the feature code.
+// The tenant is the one in the route, otherwise either the one derived from a token subject or any tenant
+// owned by an organization where a subject has the role required by the method. Super roles are always allowed.
+// The routes of a single topic evaluate the topic's tenant in the handler by verifyTopicFeatureCode instead.
+func FeatureCodeRequired(feature string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subjects := r.Header.Get(injectedSubs)
+		tenants := []string{}
+		if tenant, ok := mux.Vars(r)["tenant"]; ok {
+			tenants = append(tenants, tenant)
+		} else {
+			for _, subject := range strings.Split(subjects, ",") {
+				subCase1, subCase2 := ExtractTenant(subject)
+				tenants = append(tenants, subCase2, subCase1)
+				// the tenants of the organizations the subject is a member of
+				tenants = append(tenants, policy.MemberTenants(subject, requiredOrgRole(r.Method), policy.OrgManager.ListOrgs(), policy.TenantManager.ListTenants())...)
+			}
+		}
+		if verifyFeatureCode(w, subjects, feature, tenants) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// verifyTopicFeatureCode verifies the feature code against the tenant of the topic, it responds with the error if rejected
+func verifyTopicFeatureCode(w http.ResponseWriter, r *http.Request, topicFullName, feature string) bool {
+	tenant, _, _, err := util.ExtractPartsFromTopicFn(topicFullName)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return false
+	}
+	return verifyFeatureCode(w, r.Header.Get(injectedSubs), feature, []string{tenant})
+}
+
+// verifyFeatureCode evaluates if any of the tenants enables the feature and records the usage.
+// The request is only recorded in the feature usage unless the feature codes are enforced by EnforceFeatureCodes,
+// otherwise it responds with 403 and returns false.
+func verifyFeatureCode(w http.ResponseWriter, subjects, feature string, tenants []string) bool {
+	if hasSuperRole(subjects) {
+		return true
+	}
+	for _, tenant := range tenants {
+		if policy.TenantManager.EvaluateFeatureCode(tenant, feature) {
+			policy.RecordFeatureUsage(tenant, feature, true)
+			return true
+		}
+	}
+
+	policy.RecordFeatureUsage(tenants[0], feature, false)
+	if !util.IsFeatureCodeEnforced() {
+		// only the usage is recorded until the enforcement is enabled
+		return true
+	}
+	log.Errorf("feature %s is not enabled for tenant %s", feature, tenants[0])
+	util.ResponseErrorJSON(fmt.Errorf("feature %s is not enabled for tenant %s", feature, tenants[0]), w, http.StatusForbidden)
+	return false
+}
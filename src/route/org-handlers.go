@@ -0,0 +1,168 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+
+	"github.com/apex/log"
+	"github.com/datastax/burnell/src/policy"
+	"github.com/datastax/burnell/src/util"
+	"github.com/gorilla/mux"
+)
+
+// OrgListHandler lists all the organizations
+func OrgListHandler(w http.ResponseWriter, r *http.Request) {
+	orgs := policy.OrgManager.ListOrgs()
+	sort.Slice(orgs, func(i, j int) bool { return orgs[i].Name < orgs[j].Name })
+	data, err := json.Marshal(orgs)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// OrgHandler gets, creates or deletes an organization
+func OrgHandler(w http.ResponseWriter, r *http.Request) {
+	orgName, ok := mux.Vars(r)["org"]
+	if !ok {
+		http.Error(w, "missing organization name", http.StatusUnprocessableEntity)
+		return
+	}
+
+	var org policy.Organization
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		if org, err = policy.OrgManager.GetOrg(orgName); err != nil {
+			util.ResponseErrorJSON(err, w, http.StatusNotFound)
+			return
+		}
+
+	case http.MethodDelete:
+		if org, err = policy.OrgManager.DeleteOrg(orgName); err != nil {
+			statusCode := http.StatusInternalServerError
+			if errors.Is(err, policy.ErrOrgNotFound) {
+				statusCode = http.StatusNotFound
+			}
+			util.ResponseErrorJSON(err, w, statusCode)
+			return
+		}
+
+	case http.MethodPost:
+		decoder := json.NewDecoder(r.Body)
+		defer r.Body.Close()
+		if err = decoder.Decode(&org); err != nil {
+			util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+			return
+		}
+		org.Name = orgName
+
+		var statusCode int
+		if org, statusCode, err = policy.OrgManager.CreateOrg(org); err != nil {
+			log.Errorf("create organization %s error %v", orgName, err)
+			util.ResponseErrorJSON(err, w, statusCode)
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	org.Tenants = policy.OrgTenants(orgName, policy.TenantManager.ListTenants())
+	data, err := json.Marshal(org)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// OrgMembersHandler lists the members of an organization
+func OrgMembersHandler(w http.ResponseWriter, r *http.Request) {
+	org, err := policy.OrgManager.GetOrg(mux.Vars(r)["org"])
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusNotFound)
+		return
+	}
+	data, err := json.Marshal(org.Members)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// OrgMemberHandler adds, changes the role of, or removes a member of an organization
+func OrgMemberHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	orgName, user := vars["org"], vars["user"]
+
+	var org policy.Organization
+	var statusCode int
+	var err error
+	switch r.Method {
+	case http.MethodPut:
+		member := policy.OrgMember{}
+		decoder := json.NewDecoder(r.Body)
+		defer r.Body.Close()
+		if err = decoder.Decode(&member); err != nil {
+			util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+			return
+		}
+		var role policy.OrgRole
+		if role, err = policy.ParseOrgRole(string(member.Role)); err != nil {
+			util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+			return
+		}
+		org, statusCode, err = policy.OrgManager.SetMember(orgName, user, role)
+		if err != nil {
+			util.ResponseErrorJSON(err, w, statusCode)
+			return
+		}
+
+	case http.MethodDelete:
+		if org, statusCode, err = policy.OrgManager.RemoveMember(orgName, user); err != nil {
+			util.ResponseErrorJSON(err, w, statusCode)
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	log.Infof("organization %s member %s updated by %s", orgName, user, r.Header.Get(injectedSubs))
+	data, err := json.Marshal(org.Members)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
@@ -25,6 +25,7 @@ import (
 	"net/http"
 
 	"github.com/apex/log"
+	"github.com/datastax/burnell/src/policy"
 	"github.com/datastax/burnell/src/util"
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -50,6 +51,7 @@ func NewRouter() *mux.Router {
 	// Order of routes definition matters
 
 	router.Path("/liveness").Methods(http.MethodGet).Name("liveness").Handler(NoAuth(Logger(http.HandlerFunc(StatusPage), "liveness")))
+	router.Path("/readiness").Methods(http.MethodGet).Name("readiness").Handler(NoAuth(http.HandlerFunc(ReadinessHandler)))
 	router.Path("/subject/{sub}").Methods(http.MethodGet).Name("token server").Handler(SuperRoleRequired(Logger(http.HandlerFunc(TokenSubjectHandler), "token server")))
 	router.PathPrefix("/ws/").Name("websocket proxy proxy").
 		Handler(http.HandlerFunc(WebsocketAuthProxyHandler))
@@ -59,13 +61,53 @@ func NewRouter() *mux.Router {
 	router.Path("/pulsarmetrics/{tenant}").Methods(http.MethodGet).Name("pulsar metrics").
 		Handler(SuperRoleRequired(http.HandlerFunc(PulsarFederatedDebugPrometheusHandler)))
 	router.Path("/pulsarmetrics").Methods(http.MethodGet).Name("pulsar metrics").
-		Handler(AuthVerifyJWT(http.HandlerFunc(PulsarFederatedPrometheusHandler)))
+		Handler(AuthVerifyJWT(FeatureCodeRequired(policy.BrokerMetrics, http.HandlerFunc(PulsarFederatedPrometheusHandler))))
 
 	// Tenant policy management URL
+	router.Path("/k/features").Methods(http.MethodGet).Name("kafkaesque feature codes").
+		Handler(AuthVerifyJWT(http.HandlerFunc(FeatureCodesHandler)))
+	router.Path("/k/tenants").Methods(http.MethodGet).Name("kafkaesque tenant list").
+		Handler(SuperRoleRequired(http.HandlerFunc(TenantListHandler)))
+	router.Path("/k/tenants/quota").Methods(http.MethodGet).Name("kafkaesque tenants over quota").
+		Handler(SuperRoleRequired(http.HandlerFunc(TenantsOverQuotaHandler)))
+	router.Path("/k/tenants/export").Methods(http.MethodGet).Name("kafkaesque tenants export").
+		Handler(SuperRoleRequired(http.HandlerFunc(TenantExportHandler)))
+	router.Path("/k/tenants/import").Methods(http.MethodPost).Name("kafkaesque tenants import").
+		Handler(SuperRoleRequired(http.HandlerFunc(TenantImportHandler)))
 	router.Path("/k/tenant/{tenant}").Methods(http.MethodGet).Name("kafkaesque tenant management GET").
 		Handler(AuthVerifyTenantJWT(http.HandlerFunc(TenantManagementHandler)))
 	router.Path("/k/tenant/{tenant}").Methods(http.MethodDelete, http.MethodPost).Name("kafkaesque tenant management").
 		Handler(SuperRoleRequired(http.HandlerFunc(TenantManagementHandler)))
+	router.Path("/k/tenant/{tenant}/quota").Methods(http.MethodGet).Name("kafkaesque tenant quota usage").
+		Handler(AuthVerifyTenantJWT(http.HandlerFunc(TenantQuotaHandler)))
+	router.Path("/k/tenant/{tenant}/features").Methods(http.MethodGet).Name("kafkaesque tenant features").
+		Handler(AuthVerifyTenantJWT(http.HandlerFunc(TenantFeaturesHandler)))
+	router.Path("/k/tenant/{tenant}/alerts").Methods(http.MethodGet, http.MethodPost).Name("kafkaesque tenant alert rules").
+		Handler(AuthVerifyTenantJWT(http.HandlerFunc(TenantAlertsHandler)))
+	router.Path("/k/tenant/{tenant}/alerts/{id}").Methods(http.MethodPut, http.MethodDelete).Name("kafkaesque tenant alert rule").
+		Handler(AuthVerifyTenantJWT(http.HandlerFunc(TenantAlertHandler)))
+	router.Path("/k/tenant/{tenant}/history").Methods(http.MethodGet).Name("kafkaesque tenant plan history").
+		Handler(AuthVerifyTenantJWT(http.HandlerFunc(TenantHistoryHandler)))
+	router.Path("/k/tenant/{tenant}/history/diff").Methods(http.MethodGet).Name("kafkaesque tenant plan history diff").
+		Handler(AuthVerifyTenantJWT(http.HandlerFunc(TenantHistoryDiffHandler)))
+
+	// Organization and membership management URL
+	router.Path("/k/orgs").Methods(http.MethodGet).Name("organization list").
+		Handler(SuperRoleRequired(http.HandlerFunc(OrgListHandler)))
+	router.Path("/k/org/{org}").Methods(http.MethodGet).Name("organization GET").
+		Handler(AuthVerifyOrgJWT(http.HandlerFunc(OrgHandler)))
+	router.Path("/k/org/{org}").Methods(http.MethodDelete, http.MethodPost).Name("organization management").
+		Handler(SuperRoleRequired(http.HandlerFunc(OrgHandler)))
+	router.Path("/k/org/{org}/members").Methods(http.MethodGet).Name("organization members").
+		Handler(AuthVerifyOrgJWT(http.HandlerFunc(OrgMembersHandler)))
+	router.Path("/k/org/{org}/members/{user}").Methods(http.MethodPut, http.MethodDelete).Name("organization member management").
+		Handler(OrgOwnerRequired(http.HandlerFunc(OrgMemberHandler)))
+
+	// Outbound webhook subscriptions and delivery history
+	router.Path("/k/webhooks").Methods(http.MethodGet).Name("webhook subscriptions").
+		Handler(SuperRoleRequired(http.HandlerFunc(WebhookListHandler)))
+	router.Path("/k/webhooks/deliveries").Methods(http.MethodGet).Name("webhook deliveries").
+		Handler(SuperRoleRequired(http.HandlerFunc(WebhookDeliveriesHandler)))
 
 	if util.GetConfig().PulsarBeamTopic != "" {
 		// Pulsar Beam topic and webhook management URL
@@ -84,14 +126,38 @@ func NewRouter() *mux.Router {
 	// Collect tenant topics statistics in one call
 	router.Path("/stats/topics/{tenant}").Methods(http.MethodGet).Name("tenant topic stats").
 		Handler(AuthVerifyTenantJWT(http.HandlerFunc(TenantTopicStatsHandler)))
+	router.Path("/stats/metrics/{tenant}").Methods(http.MethodGet).Name("tenant topic stats metrics").
+		Handler(AuthVerifyTenantJWT(http.HandlerFunc(TopicStatsMetricsHandler)))
+	router.Path("/stats/metrics").Methods(http.MethodGet).Name("topic stats metrics").
+		Handler(SuperRoleRequired(http.HandlerFunc(TopicStatsMetricsHandler)))
+	router.Path("/stats/subscriptions/{tenant}").Methods(http.MethodGet).Name("tenant subscription stats").
+		Handler(AuthVerifyTenantJWT(http.HandlerFunc(SubscriptionStatsHandler)))
+	router.Path("/stats/partitioned-topics/{tenant}").Methods(http.MethodGet).Name("tenant partitioned topic stats").
+		Handler(AuthVerifyTenantJWT(http.HandlerFunc(PartitionedTopicStatsHandler)))
+	router.Path("/stats/namespaces/{tenant}").Methods(http.MethodGet).Name("tenant namespace stats").
+		Handler(AuthVerifyTenantJWT(http.HandlerFunc(StatsRollupHandler)))
+	router.Path("/stats/tenants").Methods(http.MethodGet).Name("tenant stats").
+		Handler(SuperRoleRequired(http.HandlerFunc(StatsRollupHandler)))
+	router.Path("/stats/idle/{tenant}").Methods(http.MethodGet).Name("tenant idle topics").
+		Handler(AuthVerifyTenantJWT(http.HandlerFunc(IdleTopicsHandler)))
+	router.Path("/stats/idle/{tenant}/cleanup").Methods(http.MethodPost).Name("tenant idle topics cleanup").
+		Handler(SuperRoleRequired(http.HandlerFunc(IdleTopicsCleanupHandler)))
+	router.Path("/stats/events/{tenant}").Methods(http.MethodGet).Name("tenant topic events").
+		Handler(AuthVerifyTenantJWT(http.HandlerFunc(TopicEventsHandler)))
+	router.Path("/stats/ownership/{tenant}").Methods(http.MethodGet).Name("tenant topic ownership").
+		Handler(AuthVerifyTenantJWT(http.HandlerFunc(TopicOwnershipHandler)))
+	router.Path("/stats/connections/{tenant}").Methods(http.MethodGet).Name("tenant client connections").
+		Handler(AuthVerifyTenantJWT(http.HandlerFunc(ConnectionStatsHandler)))
+	router.Path("/stats/history/{tenant}").Methods(http.MethodGet).Name("tenant topic stats history").
+		Handler(AuthVerifyTenantJWT(http.HandlerFunc(TopicStatsHistoryHandler)))
 
 	// Retrieve function logs, instance is optional and default to 0
 	router.Path("/function-logs/{tenant}/{namespace}/{function}").Methods(http.MethodGet).Name("function-logs").
-		Handler(AuthVerifyTenantJWT(http.HandlerFunc(FunctionLogsHandler)))
+		Handler(AuthVerifyTenantJWT(FeatureCodeRequired(policy.FunctionLogs, http.HandlerFunc(FunctionLogsHandler))))
 	router.Path("/function-logs/{tenant}/{namespace}/{function}/{instance}").Methods(http.MethodGet).Name("function-logs").
-		Handler(AuthVerifyTenantJWT(http.HandlerFunc(FunctionLogsHandler)))
+		Handler(AuthVerifyTenantJWT(FeatureCodeRequired(policy.FunctionLogs, http.HandlerFunc(FunctionLogsHandler))))
 	router.Path("/function-status/{tenant}/{namespace}/{function}").Methods(http.MethodGet).Name("function-logs-status").
-		Handler(AuthVerifyTenantJWT(http.HandlerFunc(FunctionStatusHandler)))
+		Handler(AuthVerifyTenantJWT(FeatureCodeRequired(policy.FunctionLogs, http.HandlerFunc(FunctionStatusHandler))))
 
 	// aggregated topics under namespaces
 	router.Path("/admin/v2/topics/{tenant}").Methods(http.MethodGet).Name("topics-grouped-by-namespaces").
@@ -104,6 +170,8 @@ func NewRouter() *mux.Router {
 		Handler(SuperRoleRequired(http.HandlerFunc(DirectBrokerProxyHandler)))
 
 	// /broker-stats
+	router.Path("/admin/v2/broker-stats/summary").Methods(http.MethodGet).Name("brokers summary").
+		Handler(SuperRoleRequired(http.HandlerFunc(BrokersSummaryHandler)))
 	router.PathPrefix("/admin/v2/broker-stats").Methods(http.MethodGet).
 		Handler(SuperRoleRequired(http.HandlerFunc(BrokerAggregatorHandler)))
 	// Exception is broker-resource-availability/{tenant}/{namespace}
@@ -160,8 +228,13 @@ func NewRouter() *mux.Router {
 		Handler(SuperRoleRequired(http.HandlerFunc(DirectBrokerProxyHandler)))
 	router.PathPrefix("/admin/v2/namespaces/{tenant}/{namespace}/replicatorDispatchRate").Methods(http.MethodPost).
 		Handler(SuperRoleRequired(http.HandlerFunc(DirectBrokerProxyHandler)))
+	// tenants can only set the namespace retention within their plans when it is enabled
+	retentionAuth := SuperRoleRequired
+	if util.IsTenantRetentionAllowed() {
+		retentionAuth = AuthVerifyTenantJWT
+	}
 	router.PathPrefix("/admin/v2/namespaces/{tenant}/{namespace}/retention").Methods(http.MethodPost).
-		Handler(SuperRoleRequired(http.HandlerFunc(DirectBrokerProxyHandler)))
+		Handler(retentionAuth(http.HandlerFunc(RetentionPolicyProxyHandler)))
 	router.PathPrefix("/admin/v2/namespaces/{tenant}/{namespace}/subscribeRate").Methods(http.MethodPost).
 		Handler(SuperRoleRequired(http.HandlerFunc(DirectBrokerProxyHandler)))
 	router.PathPrefix("/admin/v2/namespaces/{tenant}/{namespace}/subscriptionAuthMode").Methods(http.MethodPost).
@@ -302,6 +375,8 @@ func NewRouter() *mux.Router {
 	// TODO rate limit can be added per route basis
 	router.Use(LimitRate)
 
+	router.Use(TenantDBReady)
+
 	router.Use(ResponseJSONContentType)
 
 	log.Warnf("router added")
@@ -0,0 +1,439 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/datastax/burnell/src/logclient"
+	"github.com/datastax/burnell/src/policy"
+	"github.com/datastax/burnell/src/util"
+	"github.com/datastax/burnell/src/webhook"
+	"github.com/gorilla/mux"
+)
+
+// TenantListHandler lists tenants from both the plan database and Pulsar with filters, sorting and pagination
+func TenantListHandler(w http.ResponseWriter, r *http.Request) {
+	u, _ := url.Parse(r.URL.String())
+	params := u.Query()
+	isCSV := queryParamString(params, "format", "json") == "csv" || strings.Contains(r.Header.Get("Accept"), "text/csv")
+	// CSV export returns all the tenants unless the limit is specified
+	defaultLimit := 50
+	if isCSV {
+		defaultLimit = 0
+	}
+
+	query := policy.TenantQuery{
+		PlanType:    queryParamString(params, "planType", ""),
+		Org:         queryParamString(params, "org", ""),
+		FeatureCode: queryParamString(params, "featureCode", ""),
+		SortBy:      queryParamString(params, "sort", "name"),
+		Descending:  queryParamString(params, "order", "asc") == "desc",
+		Offset:      queryParamInt(params, "offset", 0),
+		Limit:       queryParamInt(params, "limit", defaultLimit),
+	}
+	if status := queryParamString(params, "status", ""); status != "" {
+		tenantStatus, err := policy.ParseTenantStatus(status)
+		if err != nil {
+			util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+			return
+		}
+		query.Status = tenantStatus
+	}
+	if since := queryParamString(params, "updatedSince", ""); since != "" {
+		updatedSince, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+			return
+		}
+		query.UpdatedSince = updatedSince
+	}
+
+	pulsarTenants, err := getTenantNameList()
+	if err != nil {
+		log.Errorf("failed to list Pulsar tenants %v", err)
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+
+	tenants := policy.MergeTenants(policy.TenantManager.ListTenants(), pulsarTenants)
+	result, err := policy.QueryTenants(tenants, query)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	if isCSV {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", "attachment; filename=tenants.csv")
+		w.WriteHeader(http.StatusOK)
+		if err := policy.WriteTenantsCSV(w, result.Data); err != nil {
+			log.Errorf("failed to write tenants csv %v", err)
+		}
+		return
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// collectTenantQuota collects the live resource usage of a tenant and compares it with the plan limits
+func collectTenantQuota(plan policy.TenantPlan) (policy.TenantQuota, error) {
+	namespaces, err := policy.AdminAPIGETRespStringArray("namespaces/" + plan.Name)
+	if err != nil {
+		return policy.TenantQuota{}, err
+	}
+	retention, err := policy.NamespaceRetentionHours(namespaces)
+	if err != nil {
+		return policy.TenantQuota{}, err
+	}
+	_, topics := policy.CountTopics(plan.Name)
+	if topics < 0 {
+		topics = 0
+	}
+	producers, consumers := policy.CountTenantClients(plan.Name)
+
+	quota := policy.BuildTenantQuota(plan, policy.TenantResourceUsage{
+		Topics:         topics,
+		Namespaces:     len(namespaces),
+		Producers:      producers,
+		Consumers:      consumers,
+		Functions:      logclient.TenantFunctionCount(plan.Name),
+		RetentionHours: retention,
+	})
+	return quota, nil
+}
+
+// the default quota usage alert threshold in percent
+var quotaAlertPercent = util.GetEnvInt("QuotaAlertPercent", 80)
+
+// the interval to evaluate the quota usage of all tenants against the alert threshold, 0 disables the evaluation
+var quotaAlertInterval = time.Duration(util.GetEnvInt("QuotaAlertIntervalSecond", 300)) * time.Second
+
+// QuotaAlertWatchDog evaluates the quota usage of all tenants on schedule, so that the threshold crossings
+// are notified without anyone calling the quota endpoints. It only runs on the notification leader replica.
+func QuotaAlertWatchDog() {
+	if quotaAlertInterval <= 0 {
+		log.Warnf("quota alert evaluation is disabled")
+		return
+	}
+	if !util.IsNotificationLeader() {
+		log.Infof("quota alert evaluation runs on the notification leader replica only")
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(quotaAlertInterval)
+		for range ticker.C {
+			if policy.TenantManager.IsReady() {
+				evaluateQuotaAlerts()
+			}
+		}
+	}()
+}
+
+// evaluateQuotaAlerts notifies the webhook subscriptions of the plan dimensions newly over the alert threshold
+func evaluateQuotaAlerts() {
+	pulsarTenants, err := getTenantNameList()
+	if err != nil {
+		log.Errorf("quota alert failed to list Pulsar tenants %v", err)
+		return
+	}
+	for _, v := range policy.MergeTenants(policy.TenantManager.ListTenants(), pulsarTenants) {
+		// the tenants without a plan are not cached as free plans by a background evaluation
+		plan, err := policy.TenantManager.GetTenant(v.Name)
+		if err != nil {
+			log.Debugf("quota alert skips tenant %s without a plan", v.Name)
+			continue
+		}
+		quota, err := collectTenantQuota(plan)
+		if err != nil {
+			log.Errorf("quota alert failed to collect tenant %s quota usage %v", v.Name, err)
+			continue
+		}
+		for _, crossed := range policy.QuotaThresholdCrossings(quota, float64(quotaAlertPercent)) {
+			webhook.Manager.Publish(webhook.NewEvent(webhook.QuotaThresholdCrossed, plan.Name, crossed))
+		}
+	}
+}
+
+// TenantQuotaHandler returns the usage of every plan dimension against the tenant plan limits
+func TenantQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	tenant := mux.Vars(r)["tenant"]
+	if !policy.IsTenant(tenant) {
+		util.ResponseErrorJSON(fmt.Errorf("tenant %s does not exist", tenant), w, http.StatusNotFound)
+		return
+	}
+	// the same plan evaluated by the limit enforcement
+	plan, _ := policy.TenantManager.GetOrCreateTenant(tenant)
+
+	quota, err := collectTenantQuota(plan)
+	if err != nil {
+		log.Errorf("failed to collect tenant %s quota usage %v", tenant, err)
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+
+	data, err := json.Marshal(quota)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// TenantsOverQuotaHandler lists all the tenants with any plan dimension over the usage threshold in percent
+func TenantsOverQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	u, _ := url.Parse(r.URL.String())
+	threshold := queryParamInt(u.Query(), "threshold", quotaAlertPercent)
+
+	pulsarTenants, err := getTenantNameList()
+	if err != nil {
+		log.Errorf("failed to list Pulsar tenants %v", err)
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+
+	quotas := []policy.TenantQuota{}
+	for _, v := range policy.MergeTenants(policy.TenantManager.ListTenants(), pulsarTenants) {
+		plan, _ := policy.TenantManager.GetOrCreateTenant(v.Name)
+		quota, err := collectTenantQuota(plan)
+		if err != nil {
+			log.Errorf("failed to collect tenant %s quota usage %v", v.Name, err)
+			continue
+		}
+		quotas = append(quotas, quota)
+	}
+
+	data, err := json.Marshal(policy.FilterOverQuota(quotas, float64(threshold)))
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// TenantFeaturesHandler lists all the feature codes with the enabled state and usage counters of the tenant
+func TenantFeaturesHandler(w http.ResponseWriter, r *http.Request) {
+	tenant := mux.Vars(r)["tenant"]
+	plan, _ := policy.TenantManager.GetOrCreateTenant(tenant)
+
+	data, err := json.Marshal(policy.TenantFeatures(tenant, plan.Policy.FeatureCodes))
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// FeatureCodesHandler lists all the feature codes in effect
+func FeatureCodesHandler(w http.ResponseWriter, r *http.Request) {
+	data, err := json.Marshal(policy.FeatureCodes)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// TenantExportHandler exports all the tenant plans in a versioned bundle in json or yaml format,
+// the webhook signing secrets are only exported with includeSecrets=true
+func TenantExportHandler(w http.ResponseWriter, r *http.Request) {
+	u, _ := url.Parse(r.URL.String())
+	format := queryParamString(u.Query(), "format", "json")
+	includeSecrets := queryParamString(u.Query(), "includeSecrets", "false") == "true"
+	data, err := policy.MarshalTenantBundle(policy.TenantManager.ExportTenants(includeSecrets), format)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	if format == "yaml" || format == "yml" {
+		w.Header().Set("Content-Type", "application/x-yaml")
+	}
+	w.Header().Set("Content-Disposition", "attachment; filename=tenants."+format)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// TenantImportHandler imports a tenant bundle in either merge or replace mode, dryRun only reports the changes
+func TenantImportHandler(w http.ResponseWriter, r *http.Request) {
+	u, _ := url.Parse(r.URL.String())
+	params := u.Query()
+	mode := queryParamString(params, "mode", policy.MergeImport)
+	dryRun := queryParamString(params, "dryRun", "false") == "true"
+
+	body, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	bundle, err := policy.UnmarshalTenantBundle(body)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+
+	statusCode := http.StatusOK
+	result, err := policy.TenantManager.ImportTenants(bundle, mode, r.Header.Get(injectedSubs), dryRun)
+	if err != nil {
+		log.Errorf("failed to import tenant bundle %v", err)
+		if len(result.Errors) == 0 {
+			util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+			return
+		}
+		statusCode = http.StatusUnprocessableEntity
+		if len(result.Created)+len(result.Updated)+len(result.Deleted) > 0 {
+			// the bundle is valid but some of the updates failed
+			statusCode = http.StatusInternalServerError
+		}
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(statusCode)
+	w.Write(data)
+}
+
+// TenantAlertsResponse is the alert rules and the alert states of a tenant
+type TenantAlertsResponse struct {
+	Tenant string             `json:"tenant"`
+	Limit  int                `json:"limit"`
+	Rules  []policy.AlertRule `json:"rules"`
+	Alerts []policy.Alert     `json:"alerts"`
+}
+
+// TenantAlertsHandler lists the tenant's alert rules with the alert states, or creates an alert rule
+func TenantAlertsHandler(w http.ResponseWriter, r *http.Request) {
+	tenant := mux.Vars(r)["tenant"]
+	plan, err := policy.TenantManager.GetTenant(tenant)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusNotFound)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		updateAlertRule(w, r, plan, "")
+		return
+	}
+
+	rules := plan.AlertRules
+	if rules == nil {
+		rules = []policy.AlertRule{}
+	}
+	data, err := json.Marshal(TenantAlertsResponse{
+		Tenant: tenant,
+		Limit:  policy.AlertRuleLimit(plan),
+		Rules:  rules,
+		Alerts: policy.TenantAlerts(tenant),
+	})
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// TenantAlertHandler updates or deletes an alert rule of the tenant
+func TenantAlertHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tenant, ruleID := vars["tenant"], vars["id"]
+	plan, err := policy.TenantManager.GetTenant(tenant)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusNotFound)
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		updateAlertRule(w, r, plan, ruleID)
+		return
+	}
+
+	newPlan, err := policy.RemoveAlertRule(plan, ruleID)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusNotFound)
+		return
+	}
+	newPlan.Audit = "alert rule " + ruleID + " deleted"
+	if _, statusCode, err := policy.TenantManager.UpdateTenant(tenant, newPlan, r.Header.Get(injectedSubs), plan.Version); err != nil {
+		util.ResponseErrorJSON(err, w, statusCode)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// updateAlertRule creates the alert rule in the request body, or replaces the rule by the id
+func updateAlertRule(w http.ResponseWriter, r *http.Request, plan policy.TenantPlan, ruleID string) {
+	var rule policy.AlertRule
+	decoder := json.NewDecoder(r.Body)
+	defer r.Body.Close()
+	if err := decoder.Decode(&rule); err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusUnprocessableEntity)
+		return
+	}
+	rule.ID = ruleID
+
+	newPlan, rule, err := policy.AddAlertRule(plan, rule)
+	if err != nil {
+		statusCode := http.StatusUnprocessableEntity
+		if errors.Is(err, policy.ErrAlertRuleNotFound) {
+			statusCode = http.StatusNotFound
+		}
+		util.ResponseErrorJSON(err, w, statusCode)
+		return
+	}
+	newPlan.Audit = "alert rule " + rule.ID + util.ConditionAssign(ruleID == "", " created", " updated")
+	// the rules are stored with the tenant plan, a concurrent plan update is rejected with 409
+	if _, statusCode, err := policy.TenantManager.UpdateTenant(plan.Name, newPlan, r.Header.Get(injectedSubs), plan.Version); err != nil {
+		util.ResponseErrorJSON(err, w, statusCode)
+		return
+	}
+
+	data, err := json.Marshal(rule)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
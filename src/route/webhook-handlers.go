@@ -0,0 +1,68 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package route
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+
+	"github.com/datastax/burnell/src/util"
+	"github.com/datastax/burnell/src/webhook"
+)
+
+// WebhookListHandler lists the webhook subscriptions without the secrets
+func WebhookListHandler(w http.ResponseWriter, r *http.Request) {
+	subs := webhook.Manager.Subscriptions()
+	for i := range subs {
+		subs[i].Secret = ""
+	}
+
+	data, err := json.Marshal(subs)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// WebhookDeliveriesHandler queries the webhook delivery history, the most recent first
+func WebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	u, _ := url.Parse(r.URL.String())
+	params := u.Query()
+	deliveries := webhook.Manager.Deliveries(webhook.DeliveryQuery{
+		SubscriptionID: queryParamString(params, "subscription", ""),
+		Tenant:         queryParamString(params, "tenant", ""),
+		EventType:      queryParamString(params, "event", ""),
+		Status:         queryParamString(params, "status", ""),
+		Limit:          queryParamInt(params, "limit", 100),
+	})
+
+	data, err := json.Marshal(deliveries)
+	if err != nil {
+		util.ResponseErrorJSON(err, w, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
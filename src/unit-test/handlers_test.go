@@ -22,9 +22,15 @@
 package tests
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
+	"github.com/datastax/burnell/src/policy"
 	. "github.com/datastax/burnell/src/route"
+	"github.com/datastax/burnell/src/util"
+	"github.com/gorilla/mux"
 )
 
 func TestSubjectMatch(t *testing.T) {
@@ -41,6 +47,10 @@ func TestSubjectMatch(t *testing.T) {
 	assert(t, !VerifySubject("chris-datastax-client", "chris-datastax-client-client-client-12345qbc"), "")
 	assert(t, !VerifySubject("chris-kafkaesque", "chris-datastax-12345qbc"), "")
 
+	// every subject of the token is evaluated
+	assert(t, VerifySubject("chris-datastax", "chris-kafkaesque-12345qbc,chris-datastax-12345qbc"), "")
+	assert(t, !VerifySubject("chris-datastax", "chris-kafkaesque-12345qbc,chris-pulsar-12345qbc"), "")
+
 	t1, t2 := ExtractTenant("chris-datastax-12345qbc")
 	equals(t, t1, t2)
 
@@ -65,3 +75,40 @@ func TestSubjectMatch(t *testing.T) {
 	equals(t, t1, t2)
 
 }
+
+func TestFeatureCodeGates(t *testing.T) {
+	server := httptest.NewServer(newTenantService("secret"))
+	defer server.Close()
+	store := &policy.RestClient{Token: "secret"}
+	errNil(t, store.Conn(server.URL+"/v1"))
+	errNil(t, store.Update(policy.TenantPlan{Name: "beam-tenant", PlanType: policy.FreeTier, TenantStatus: policy.Activated, Version: 1,
+		Policy: policy.PlanPolicy{FeatureCodes: policy.PulsarBeam}}))
+	errNil(t, store.Update(policy.TenantPlan{Name: "plain-tenant", PlanType: policy.FreeTier, TenantStatus: policy.Activated, Version: 1}))
+
+	config := util.Config
+	defer func() { util.Config = config }()
+	util.Config.TenantStoreType, util.Config.TenantStoreURL, util.Config.TenantStoreToken = "rest", server.URL+"/v1", "secret"
+	util.Config.EnforceFeatureCodes = "true"
+	errNil(t, policy.TenantManager.Connect())
+	waitFor(t, policy.TenantManager.IsReady, "tenant database ready")
+
+	// the subject is a member of both tenants, but only the topic's tenant enables the feature
+	req := httptest.NewRequest(http.MethodPost, "/pulsarbeam/v2/topic", strings.NewReader(`{"TopicFullName":"persistent://plain-tenant/ns1/topic1"}`))
+	req.Header.Set("injectedSubs", "beam-tenant-12345qbc,plain-tenant-12345qbc")
+	rr := httptest.NewRecorder()
+	PulsarBeamUpdateTopicHandler(rr, req)
+	equals(t, http.StatusForbidden, rr.Code)
+	assert(t, strings.Contains(rr.Body.String(), "feature pulsar-beam is not enabled for tenant plain-tenant"), rr.Body.String())
+
+	// infinite retention is gated the same way as the feature code routes
+	retention := func(body string) int {
+		req := httptest.NewRequest(http.MethodPost, "/admin/v2/namespaces/plain-tenant/ns1/retention", strings.NewReader(body))
+		req = mux.SetURLVars(req, map[string]string{"tenant": "plain-tenant"})
+		req.Header.Set("injectedSubs", "plain-tenant-12345qbc")
+		rr := httptest.NewRecorder()
+		RetentionPolicyProxyHandler(rr, req)
+		return rr.Code
+	}
+	equals(t, http.StatusForbidden, retention(`{"retentionTimeInMinutes":60,"retentionSizeInMB":-1}`))
+	equals(t, http.StatusPaymentRequired, retention(`{"retentionTimeInMinutes":6000000,"retentionSizeInMB":100}`))
+}
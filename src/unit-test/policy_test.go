@@ -22,8 +22,16 @@
 package tests
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	. "github.com/datastax/burnell/src/policy"
 	"github.com/datastax/burnell/src/util"
@@ -61,6 +69,64 @@ func TestFeatureCodeMap(t *testing.T) {
 	assert(t, len(FeatureCodeMap) == len(KafkaesqueFeatureCodes), "featureCodeMap matches the size of KafkaesqueFeatureCodes")
 }
 
+func TestLoadFeatureCodes(t *testing.T) {
+	errNil(t, BuildFeatureCodeMap())
+	assert(t, IsFeatureSupported(BrokerMetrics, "brokerMetrics"), "broker metrics is supported by the alias")
+	assert(t, IsFeatureSupported(BrokerMetrics, "cut, brokerMetrics"), "broker metrics is supported by the alias with space")
+	assert(t, !IsFeatureSupported(BrokerMetrics, "imr"), "another feature's alias does not enable broker metrics")
+
+	dir, err := ioutil.TempDir("", "feature-codes")
+	errNil(t, err)
+	defer os.RemoveAll(dir)
+	defer func() {
+		FeatureCodes = KafkaesqueFeatureCodes
+		BuildFeatureCodeMap()
+	}()
+
+	filePath := filepath.Join(dir, "features.yml")
+	errNil(t, ioutil.WriteFile(filePath, []byte("- name: broker-metrics\n  alias: metrics\n- name: new-feature\n  description: a new feature\n"), 0644))
+	errNil(t, LoadFeatureCodes(filePath))
+	equals(t, 2, len(FeatureCodes))
+	equals(t, 2, len(FeatureCodeMap))
+	assert(t, IsFeatureSupported(BrokerMetrics, "metrics"), "broker metrics is supported by the loaded alias")
+	assert(t, !IsFeatureSupported(BrokerMetrics, "brokerMetrics"), "the default alias is replaced")
+
+	errNil(t, ioutil.WriteFile(filePath, []byte("- name: invalid feature\n"), 0644))
+	assertErr(t, "invalid feature code name invalid feature", LoadFeatureCodes(filePath))
+	equals(t, 2, len(FeatureCodes))
+	assertErr(t, "open "+filepath.Join(dir, "missing.yml")+": no such file or directory", LoadFeatureCodes(filepath.Join(dir, "missing.yml")))
+}
+
+func TestFeatureUsage(t *testing.T) {
+	errNil(t, BuildFeatureCodeMap())
+	RecordFeatureUsage("feature-usage-tenant", BrokerMetrics, true)
+	RecordFeatureUsage("feature-usage-tenant", BrokerMetrics, true)
+	RecordFeatureUsage("feature-usage-tenant", FunctionLogs, false)
+
+	usage := GetFeatureUsage("feature-usage-tenant")
+	equals(t, int64(2), usage[BrokerMetrics].Allowed)
+	equals(t, int64(0), usage[BrokerMetrics].Denied)
+	equals(t, int64(1), usage[FunctionLogs].Denied)
+	equals(t, 0, len(GetFeatureUsage("another-tenant")))
+
+	features := TenantFeatures("feature-usage-tenant", "brokerMetrics,pulsar-beam")
+	equals(t, len(FeatureCodes), len(features))
+	for _, v := range features {
+		switch v.Name {
+		case BrokerMetrics:
+			assert(t, v.Enabled, "broker metrics is enabled")
+			equals(t, int64(2), v.Usage.Allowed)
+		case PulsarBeam:
+			assert(t, v.Enabled, "pulsar beam is enabled")
+		case FunctionLogs:
+			assert(t, !v.Enabled, "function logs is not enabled")
+			equals(t, int64(1), v.Usage.Denied)
+		default:
+			assert(t, !v.Enabled, v.Name+" is not enabled")
+		}
+	}
+}
+
 func TestIsPartitionTopic(t *testing.T) {
 	name, is := IsPartitionTopic("persistent://ming-luo/local-useast1-gcp/partition-topic2-partition-0")
 	fmt.Printf("name is %s", name)
@@ -84,3 +150,403 @@ func TestIsPartitionTopic(t *testing.T) {
 	assert(t, util.IsPersistentTopic("persistent://ming-luo/local-useast1-gcp/partition-topic2-partition-1o9"), "")
 	assert(t, !util.IsPersistentTopic("non-persistent://ming-luo/local-useast1-gcp/partition-topic2"), "")
 }
+
+func TestTenantAuditHistory(t *testing.T) {
+	created, err := ReconcileTenantPlan(TenantPlan{Name: "tenant1", PlanType: FreeTier}, TenantPlan{})
+	errNil(t, err)
+	equals(t, "initial creation", created.Audit)
+	created = AppendAuditEntry(created, TenantPlan{}, "superuser", created.Audit)
+	equals(t, 1, len(created.History))
+	equals(t, int64(1), created.History[0].Version)
+	equals(t, "superuser", created.History[0].Actor)
+	equals(t, "", created.History[0].PrevPlanType)
+	equals(t, FreeTier, created.History[0].NewPlanType)
+
+	upgraded, err := ReconcileTenantPlan(TenantPlan{Name: "tenant1", PlanType: StarterTier, Audit: "upgrade",
+		Policy: TenantPlanPolicies.StarterPlan}, created)
+	errNil(t, err)
+	equals(t, "upgrade", upgraded.Audit)
+	upgraded = AppendAuditEntry(upgraded, created, "anotheradmin", upgraded.Audit)
+	equals(t, 2, len(upgraded.History))
+	equals(t, 1, len(created.History))
+	equals(t, int64(2), upgraded.History[1].Version)
+	equals(t, "anotheradmin", upgraded.History[1].Actor)
+	equals(t, FreeTier, upgraded.History[1].PrevPlanType)
+	equals(t, StarterTier, upgraded.History[1].NewPlanType)
+	equals(t, "upgrade", upgraded.History[1].Reason)
+
+	changes, err := DiffTenantHistory(upgraded.History, 1, 2)
+	errNil(t, err)
+	diffs := make(map[string]FieldDiff)
+	for _, v := range changes {
+		diffs[v.Field] = v
+	}
+	equals(t, FieldDiff{Field: "planType", From: FreeTier, To: StarterTier}, diffs["planType"])
+	equals(t, FieldDiff{Field: "policy.numOfTopics", From: 5, To: 20}, diffs["policy.numOfTopics"])
+	_, ok := diffs["tenantStatus"]
+	assert(t, !ok, "tenant status is unchanged")
+
+	changes, err = DiffTenantHistory(upgraded.History, 2, 2)
+	errNil(t, err)
+	equals(t, 0, len(changes))
+
+	_, err = DiffTenantHistory(upgraded.History, 1, 3)
+	assertErr(t, "version 3 is not found in the tenant history", err)
+}
+
+func TestQueryTenants(t *testing.T) {
+	now := time.Now()
+	plans := []TenantPlan{
+		{Name: "tenant-c", PlanType: FreeTier, TenantStatus: Activated, Org: "org1", UpdatedAt: now.Add(-2 * time.Hour),
+			Policy: PlanPolicy{FeatureCodes: FeatureAllDisabled}},
+		{Name: "tenant-a", PlanType: StarterTier, TenantStatus: Suspended, Org: "org2", UpdatedAt: now.Add(-1 * time.Hour),
+			Policy: PlanPolicy{FeatureCodes: BrokerMetrics}, History: []AuditEntry{{Version: 1}}},
+		{Name: "tenant-b", PlanType: PrivateTier, TenantStatus: Activated, Org: "org1", UpdatedAt: now,
+			Policy: PlanPolicy{FeatureCodes: FeatureAllEnabled}},
+	}
+	tenants := MergeTenants(plans, []string{"tenant-a", "tenant-d"})
+	equals(t, 4, len(tenants))
+
+	result, err := QueryTenants(tenants, TenantQuery{})
+	errNil(t, err)
+	equals(t, 4, result.Total)
+	equals(t, 4, result.Offset)
+	equals(t, "tenant-a", result.Data[0].Name)
+	equals(t, "tenant-d", result.Data[3].Name)
+	equals(t, Reserved0, result.Data[3].TenantStatus)
+	assert(t, result.Data[0].History == nil, "history is omitted from the list")
+	equals(t, 1, len(plans[1].History))
+
+	result, err = QueryTenants(tenants, TenantQuery{Org: "org1", SortBy: "updatedAt", Descending: true})
+	errNil(t, err)
+	equals(t, 2, result.Total)
+	equals(t, "tenant-b", result.Data[0].Name)
+	equals(t, "tenant-c", result.Data[1].Name)
+
+	result, err = QueryTenants(tenants, TenantQuery{FeatureCode: BrokerMetrics})
+	errNil(t, err)
+	equals(t, 2, result.Total)
+
+	status, err := ParseTenantStatus("Suspended")
+	errNil(t, err)
+	result, err = QueryTenants(tenants, TenantQuery{Status: status, UpdatedSince: now.Add(-90 * time.Minute)})
+	errNil(t, err)
+	equals(t, 1, result.Total)
+	equals(t, "tenant-a", result.Data[0].Name)
+
+	result, err = QueryTenants(tenants, TenantQuery{Offset: 1, Limit: 2})
+	errNil(t, err)
+	equals(t, 4, result.Total)
+	equals(t, 3, result.Offset)
+	equals(t, "tenant-b", result.Data[0].Name)
+
+	_, err = QueryTenants(tenants, TenantQuery{SortBy: "bogus"})
+	assertErr(t, "unsupported sort attribute bogus", err)
+	_, err = ParseTenantStatus("none")
+	assertErr(t, "invalid tenant status none", err)
+
+	var buf bytes.Buffer
+	errNil(t, WriteTenantsCSV(&buf, result.Data))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	equals(t, 3, len(lines))
+	assert(t, strings.HasPrefix(lines[1], "tenant-b,private,activated,org1,"), "csv record %s", lines[1])
+}
+
+func TestTenantPlanVersion(t *testing.T) {
+	plan := TenantPlan{Name: "tenant1", PlanType: FreeTier, Version: 3}
+	errNil(t, CheckTenantVersion(plan, AnyVersion))
+	errNil(t, CheckTenantVersion(plan, 3))
+	err := CheckTenantVersion(plan, 2)
+	assert(t, errors.Is(err, ErrVersionConflict), "version mismatch is a conflict")
+	errNil(t, CheckTenantVersion(TenantPlan{}, 0))
+	assert(t, errors.Is(CheckTenantVersion(TenantPlan{}, 1), ErrVersionConflict), "tenant does not exist")
+
+	assert(t, !IsStaleTenantVersion(3, 4), "newer version")
+	assert(t, IsStaleTenantVersion(3, 3), "the same version has been applied")
+	assert(t, IsStaleTenantVersion(3, 2), "older version")
+	assert(t, !IsStaleTenantVersion(3, 0), "unversioned legacy record")
+
+	updated := AppendAuditEntry(TenantPlan{Name: "tenant1", PlanType: StarterTier, Version: 4}, plan, "superuser", "upgrade")
+	equals(t, int64(4), updated.History[0].Version)
+}
+
+func TestTenantSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tenant-snapshot")
+	errNil(t, err)
+	defer os.RemoveAll(dir)
+	snapshotFile := filepath.Join(dir, "tenants.json")
+
+	_, err = ReadTenantSnapshot(snapshotFile)
+	assert(t, err != nil, "snapshot does not exist")
+
+	snapshot := TenantSnapshot{
+		MessageID: []byte{8, 1, 16, 2},
+		Tenants: map[string]TenantPlan{
+			"tenant1": {Name: "tenant1", PlanType: FreeTier, Version: 2},
+		},
+		Versions:  map[string]int64{"tenant1": 2, "tenant2": 5},
+		CreatedAt: time.Now(),
+	}
+	errNil(t, WriteTenantSnapshot(snapshotFile, snapshot))
+
+	loaded, err := ReadTenantSnapshot(snapshotFile)
+	errNil(t, err)
+	equals(t, snapshot.MessageID, loaded.MessageID)
+	equals(t, FreeTier, loaded.Tenants["tenant1"].PlanType)
+	equals(t, int64(5), loaded.Versions["tenant2"])
+	assert(t, loaded.Checksum != "", "checksum is written")
+
+	// tamper the snapshot content
+	data, err := ioutil.ReadFile(snapshotFile)
+	errNil(t, err)
+	errNil(t, ioutil.WriteFile(snapshotFile, bytes.Replace(data, []byte(`"tenant2":5`), []byte(`"tenant2":6`), 1), 0644))
+	_, err = ReadTenantSnapshot(snapshotFile)
+	assert(t, err != nil && strings.Contains(err.Error(), "checksum mismatch"), "tampered snapshot is rejected")
+}
+
+func TestOrganizationMembership(t *testing.T) {
+	role, err := ParseOrgRole(" Admin")
+	errNil(t, err)
+	equals(t, AdminRole, role)
+	_, err = ParseOrgRole("superuser")
+	assert(t, err != nil, "invalid role")
+
+	assert(t, OwnerRole.Permits(AdminRole), "owner can admin")
+	assert(t, AdminRole.Permits(ViewerRole), "admin can view")
+	assert(t, !ViewerRole.Permits(AdminRole), "viewer cannot admin")
+	assert(t, !AdminRole.Permits(OwnerRole), "admin cannot manage membership")
+	assert(t, !OrgRole("").Permits(ViewerRole), "no role")
+
+	org := Organization{Name: "acme"}
+	assert(t, ValidateOrganization(org) != nil, "an owner is required")
+	org, err = org.SetMember("alice", OwnerRole)
+	errNil(t, err)
+	errNil(t, ValidateOrganization(org))
+	org, err = org.SetMember("bob", ViewerRole)
+	errNil(t, err)
+	org, err = org.SetMember("bob", AdminRole)
+	errNil(t, err)
+	equals(t, 2, len(org.Members))
+	member, ok := org.GetMember("bob")
+	assert(t, ok, "bob is a member")
+	equals(t, AdminRole, member.Role)
+
+	_, err = org.SetMember("alice", AdminRole)
+	assert(t, err != nil, "the last owner cannot be demoted")
+	_, err = org.RemoveMember("alice")
+	assert(t, err != nil, "the last owner cannot be removed")
+	_, err = org.RemoveMember("carol")
+	assert(t, err != nil, "carol is not a member")
+	org, err = org.RemoveMember("bob")
+	errNil(t, err)
+	_, ok = org.GetMember("bob")
+	assert(t, !ok, "bob has been removed")
+
+	duplicated := Organization{Name: "acme", Members: []OrgMember{{User: "alice", Role: OwnerRole}, {User: "alice", Role: ViewerRole}}}
+	assert(t, ValidateOrganization(duplicated) != nil, "duplicated member")
+
+	tenants := []TenantPlan{{Name: "t2", Org: "acme"}, {Name: "t1", Org: "acme"}, {Name: "t3", Org: "other"}}
+	equals(t, []string{"t1", "t2"}, OrgTenants("acme", tenants))
+
+	orgs := []Organization{org, {Name: "other", Members: []OrgMember{{User: "carol", Role: ViewerRole}}}}
+	equals(t, []string{"t1", "t2"}, MemberTenants("alice", AdminRole, orgs, tenants))
+	equals(t, []string{"t3"}, MemberTenants("carol", ViewerRole, orgs, tenants))
+	equals(t, []string{}, MemberTenants("carol", AdminRole, orgs, tenants))
+	equals(t, []string{}, MemberTenants("dave", ViewerRole, orgs, tenants))
+}
+
+func TestTenantQuota(t *testing.T) {
+	plan := TenantPlan{Name: "tenant1", PlanType: FreeTier, Policy: TenantPlanPolicies.FreePlan}
+	quota := BuildTenantQuota(plan, TenantResourceUsage{
+		Topics:         4,
+		Namespaces:     1,
+		Producers:      1,
+		Consumers:      0,
+		Functions:      2,
+		RetentionHours: 24,
+	})
+	equals(t, "tenant1", quota.Tenant)
+	equals(t, 6, len(quota.Quotas))
+	equals(t, QuotaUsage{Dimension: QuotaTopics, Limit: 5, Usage: 4, Percent: 80}, quota.Quotas[0])
+	equals(t, float64(100), quota.Quotas[1].Percent)
+	equals(t, float64(200), quota.MaxPercent)
+	equals(t, float64(50), quota.Quotas[5].Percent)
+
+	over := quota.OverQuota(80)
+	equals(t, 3, len(over))
+	equals(t, QuotaFunctions, over[2].Dimension)
+
+	infinite := BuildTenantQuota(plan, TenantResourceUsage{RetentionHours: InfiniteRetention})
+	equals(t, float64(100), infinite.Quotas[5].Percent)
+	plan.Policy.FeatureCodes = InfiniteMessageRetention
+	allowed := BuildTenantQuota(plan, TenantResourceUsage{RetentionHours: InfiniteRetention})
+	equals(t, float64(0), allowed.Quotas[5].Percent)
+
+	low := BuildTenantQuota(TenantPlan{Name: "tenant2", Policy: TenantPlanPolicies.ProductionPlan}, TenantResourceUsage{Topics: 1})
+	tenants := FilterOverQuota([]TenantQuota{low, infinite, allowed, quota}, 80)
+	equals(t, 2, len(tenants))
+	equals(t, float64(200), tenants[0].MaxPercent)
+	equals(t, float64(100), tenants[1].MaxPercent)
+
+	var stats interface{}
+	errNil(t, json.Unmarshal([]byte(`{"publishers":[{},{}],"subscriptions":{"s1":{"consumers":[{}]},"s2":{"consumers":[{},{}]}}}`), &stats))
+	producers, consumers := CountTopicClients(stats)
+	equals(t, 2, producers)
+	equals(t, 3, consumers)
+	producers, consumers = CountTopicClients(nil)
+	equals(t, 0, producers+consumers)
+
+	// -1 is unlimited
+	private := BuildTenantQuota(TenantPlan{Name: "private1", PlanType: PrivateTier, Policy: TenantPlanPolicies.PrivatePlan}, TenantResourceUsage{
+		Topics:    50,
+		Producers: 300,
+		Consumers: 500,
+		Functions: 20,
+	})
+	equals(t, QuotaUsage{Dimension: QuotaProducers, Limit: -1, Usage: 300, Percent: 0}, private.Quotas[2])
+	equals(t, float64(0), private.Quotas[4].Percent)
+	equals(t, float64(1), private.MaxPercent)
+	equals(t, 0, len(private.OverQuota(80)))
+	equals(t, 0, len(FilterOverQuota([]TenantQuota{private}, 80)))
+	equals(t, 0, len(QuotaThresholdCrossings(private, 80)))
+	unlimited := BuildTenantQuota(TenantPlan{Name: "private2", Policy: PlanPolicy{MessageHourRetention: -1}}, TenantResourceUsage{RetentionHours: InfiniteRetention})
+	equals(t, float64(0), unlimited.Quotas[5].Percent)
+}
+
+func TestScheduledPlanChange(t *testing.T) {
+	now := time.Now()
+	expiry := now.Add(time.Hour)
+	trial, err := ReconcileTenantPlan(TenantPlan{Name: "trial", PlanType: ProductionTier, ExpiresAt: &expiry}, TenantPlan{})
+	errNil(t, err)
+	assert(t, trial.ExpiresAt != nil, "the trial expiry is set")
+
+	_, ok := DueScheduledChange(trial, now)
+	assert(t, !ok, "the trial has not expired")
+	downgrade, ok := DueScheduledChange(trial, expiry)
+	assert(t, ok, "the trial has expired")
+	equals(t, FreeTier, downgrade.PlanType)
+	equals(t, TenantPlanPolicies.FreePlan, downgrade.Policy)
+	assert(t, IsDowngrade(trial.Policy, downgrade.Policy), "production to free is a downgrade")
+	assert(t, !IsDowngrade(TenantPlanPolicies.FreePlan, TenantPlanPolicies.PrivatePlan), "free to private is an upgrade")
+
+	// the expiry and the next plan are kept unless specified in the request
+	updated, err := ReconcileTenantPlan(TenantPlan{Name: "trial", PlanType: ProductionTier,
+		NextPlan: &ScheduledPlan{PlanType: StarterTier}}, trial)
+	errNil(t, err)
+	equals(t, expiry, *updated.ExpiresAt)
+	toStarter, ok := DueScheduledChange(updated, expiry.Add(time.Second))
+	assert(t, ok, "the next plan takes effect at the expiry")
+	equals(t, StarterTier, toStarter.PlanType)
+
+	applied, err := ReconcileTenantPlan(toStarter, updated)
+	errNil(t, err)
+	assert(t, applied.ExpiresAt == nil, "the expiry is cleared")
+	assert(t, applied.NextPlan == nil, "the next plan is cleared")
+	equals(t, TenantPlanPolicies.StarterPlan.NumOfTopics, applied.Policy.NumOfTopics)
+
+	// an upgrade at the next billing period
+	_, err = ReconcileTenantPlan(TenantPlan{Name: "trial", PlanType: FreeTier, NextPlan: &ScheduledPlan{PlanType: DedicatedTier}}, applied)
+	assertErr(t, "the scheduled plan requires either an effective time or the plan expiry", err)
+	_, err = ReconcileTenantPlan(TenantPlan{Name: "trial", PlanType: FreeTier, NextPlan: &ScheduledPlan{PlanType: "gold"}}, applied)
+	assertErr(t, "invalid scheduled plan type gold", err)
+	upgrade, err := ReconcileTenantPlan(TenantPlan{Name: "trial", PlanType: StarterTier,
+		NextPlan: &ScheduledPlan{PlanType: DedicatedTier, EffectiveAt: expiry}}, applied)
+	errNil(t, err)
+	toDedicated, ok := DueScheduledChange(upgrade, expiry)
+	assert(t, ok, "the upgrade is in effect")
+	equals(t, DedicatedTier, toDedicated.PlanType)
+	assert(t, !IsDowngrade(upgrade.Policy, toDedicated.Policy), "starter to dedicated is not a downgrade")
+
+	retentions := map[string]NamespaceRetention{
+		"trial/ns3": {RetentionTimeInMinutes: 60},
+		"trial/ns1": {RetentionTimeInMinutes: 60},
+		"trial/ns2": {RetentionTimeInMinutes: -1},
+	}
+	equals(t, []string{"trial/ns2", "trial/ns3"}, OverLimitNamespaces(retentions, TenantPlanPolicies.FreePlan))
+	equals(t, []string{"trial/ns2", "trial/ns3"}, OverLimitNamespaces(retentions, TenantPlanPolicies.StarterPlan))
+	equals(t, []string{}, OverLimitNamespaces(retentions, TenantPlanPolicies.PrivatePlan))
+
+	// the flagged namespaces survive an admin update unless specified in the request
+	toStarter.OverLimitNamespaces = OverLimitNamespaces(retentions, toStarter.Policy)
+	flagged, err := ReconcileTenantPlan(toStarter, updated)
+	errNil(t, err)
+	kept, err := ReconcileTenantPlan(TenantPlan{Name: "trial", PlanType: StarterTier, Audit: "admin update"}, flagged)
+	errNil(t, err)
+	equals(t, []string{"trial/ns2", "trial/ns3"}, kept.OverLimitNamespaces)
+	cleared, err := ReconcileTenantPlan(TenantPlan{Name: "trial", PlanType: StarterTier, OverLimitNamespaces: []string{}}, kept)
+	errNil(t, err)
+	equals(t, 0, len(cleared.OverLimitNamespaces))
+
+	infiniteSize := NamespaceRetention{RetentionTimeInMinutes: 60, RetentionSizeInMB: -1}
+	assert(t, !infiniteSize.WithinPlan(TenantPlanPolicies.DedicatedPlan), "infinite size requires the feature code")
+	assert(t, infiniteSize.WithinPlan(TenantPlanPolicies.PrivatePlan), "infinite size with the feature code")
+}
+
+func TestTenantBundle(t *testing.T) {
+	expiry := time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC)
+	bundle := TenantBundle{
+		Version: TenantBundleVersion,
+		Tenants: []TenantPlan{
+			{Name: "tenant1", PlanType: FreeTier, TenantStatus: Activated, Policy: TenantPlanPolicies.FreePlan, Version: 3},
+			{Name: "tenant2", PlanType: ProductionTier, TenantStatus: Suspended, ExpiresAt: &expiry},
+		},
+	}
+	for _, format := range []string{"json", "yaml"} {
+		data, err := MarshalTenantBundle(bundle, format)
+		errNil(t, err)
+		decoded, err := UnmarshalTenantBundle(data)
+		errNil(t, err)
+		equals(t, 2, len(decoded.Tenants))
+		equals(t, TenantPlanPolicies.FreePlan, decoded.Tenants[0].Policy)
+		equals(t, Suspended, decoded.Tenants[1].TenantStatus)
+		equals(t, expiry, *decoded.Tenants[1].ExpiresAt)
+	}
+	_, err := MarshalTenantBundle(bundle, "xml")
+	assertErr(t, "unsupported bundle format xml", err)
+	_, err = UnmarshalTenantBundle([]byte(`{"version":2,"tenants":[]}`))
+	assertErr(t, "unsupported tenant bundle version 2", err)
+	_, err = UnmarshalTenantBundle([]byte(`tenants: []`))
+	assertErr(t, "unsupported tenant bundle version 0", err)
+
+	existing := map[string]TenantPlan{"tenant1": bundle.Tenants[0]}
+	equals(t, 0, len(ValidateTenantBundle(bundle, existing)))
+
+	bundle.Tenants = append(bundle.Tenants, TenantPlan{Name: "tenant1", PlanType: StarterTier},
+		TenantPlan{Name: "tenant3", PlanType: "gold"}, TenantPlan{PlanType: FreeTier})
+	errs := ValidateTenantBundle(bundle, existing)
+	equals(t, 3, len(errs))
+	equals(t, ImportError{Tenant: "tenant1", Error: "duplicate tenant in the bundle"}, errs[0])
+	equals(t, ImportError{Tenant: "tenant3", Error: "a valid plan type is missing"}, errs[1])
+	equals(t, ImportError{Error: "tenant name is required"}, errs[2])
+}
+
+func TestTenantBundleCachedPlans(t *testing.T) {
+	store, err := NewZookeeperDriver(newInMemoryZk(), "/burnell/bundle")
+	errNil(t, err)
+	handler := NewTenantPolicyHandler(store)
+	_, _, err = handler.UpdateTenant("stored", TenantPlan{PlanType: StarterTier}, "admin", AnyVersion)
+	errNil(t, err)
+	// a free plan cached on demand for a tenant without a plan record
+	_, err = handler.GetOrCreateTenant("cached")
+	errNil(t, err)
+	equals(t, 2, len(handler.ListTenants()))
+
+	bundle := handler.ExportTenants(false)
+	equals(t, []string{"stored"}, tenantNames(bundle.Tenants))
+
+	result, err := handler.ImportTenants(TenantBundle{Version: TenantBundleVersion,
+		Tenants: []TenantPlan{{Name: "imported", PlanType: FreeTier}}}, ReplaceImport, "admin", true)
+	errNil(t, err)
+	equals(t, []string{"stored"}, result.Deleted)
+
+	// a cached plan in the bundle is created in the database
+	result, err = handler.ImportTenants(TenantBundle{Version: TenantBundleVersion,
+		Tenants: []TenantPlan{{Name: "cached", PlanType: StarterTier}}}, ReplaceImport, "admin", false)
+	errNil(t, err)
+	equals(t, []string{"cached"}, result.Created)
+	equals(t, []string{"stored"}, result.Deleted)
+	plan, err := store.Get("cached")
+	errNil(t, err)
+	equals(t, StarterTier, plan.PlanType)
+	equals(t, []string{"cached"}, tenantNames(handler.ExportTenants(false).Tenants))
+}
@@ -0,0 +1,1004 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/datastax/burnell/src/policy"
+	"github.com/datastax/burnell/src/util"
+	"github.com/datastax/burnell/src/webhook"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func upsertTestTopicStats(tenant, namespace, topic string, data interface{}) {
+	UpsertTopicStats(TopicStats{
+		ID:        fmt.Sprintf("persistent://%s/%s/%s", tenant, namespace, topic),
+		Tenant:    tenant,
+		Namespace: tenant + "/" + namespace,
+		Topic:     topic,
+		Data:      data,
+		UpdatedAt: time.Now(),
+	})
+}
+
+func TestTopicStatsSession(t *testing.T) {
+	errNil(t, InitTopicStatsDB())
+	for i := 0; i < 5; i++ {
+		upsertTestTopicStats("session-tenant", "ns1", fmt.Sprintf("topic%d", i), map[string]interface{}{"msgRateIn": float64(i)})
+	}
+	upsertTestTopicStats("another-tenant", "ns1", "topic0", nil)
+
+	first, err := PaginateTopicStats("session-tenant", "", TopicStatsQuery{}, 0, 2, nil)
+	errNil(t, err)
+	assert(t, first.SessionID != "", "a session is created")
+	equals(t, 5, first.Total)
+	equals(t, 2, first.Offset)
+	equals(t, 2, len(first.Data))
+
+	// a topic added after the snapshot does not shift the pages
+	upsertTestTopicStats("session-tenant", "ns0", "new-topic", nil)
+	second, err := PaginateTopicStats("session-tenant", first.SessionID, TopicStatsQuery{}, first.Offset, 2, nil)
+	errNil(t, err)
+	equals(t, 5, second.Total)
+	equals(t, 4, second.Offset)
+	for k := range second.Data {
+		_, ok := first.Data[k]
+		assert(t, !ok, "no duplicate topic across pages "+k)
+	}
+
+	_, err = PaginateTopicStats("another-tenant", first.SessionID, TopicStatsQuery{}, 4, 2, nil)
+	equals(t, ErrStatsSessionNotFound, err)
+
+	last, err := PaginateTopicStats("session-tenant", first.SessionID, TopicStatsQuery{}, second.Offset, 2, nil)
+	errNil(t, err)
+	equals(t, 5, last.Offset)
+	equals(t, 1, len(last.Data))
+	_, ok := last.Data["persistent://session-tenant/ns1/topic4"]
+	assert(t, ok, "the last topic in the snapshot")
+
+	// the session is released after the last page
+	_, err = PaginateTopicStats("session-tenant", first.SessionID, TopicStatsQuery{}, 5, 2, nil)
+	equals(t, ErrStatsSessionNotFound, err)
+
+	// a new session sees the new topic
+	page, err := PaginateTopicStats("session-tenant", "", TopicStatsQuery{}, 0, 10, nil)
+	errNil(t, err)
+	equals(t, 6, page.Total)
+
+	_, err = PaginateTopicStats("session-tenant", "", TopicStatsQuery{}, -1, 2, nil)
+	assertErr(t, "offset or limit cannot be negative", err)
+	_, err = PaginateTopicStats("session-tenant", "", TopicStatsQuery{}, 0, 2, []string{"persistent://another-tenant/ns1/topic0"})
+	assertErr(t, "topic persistent://another-tenant/ns1/topic0 does not belong to tenant session-tenant", err)
+	_, err = PaginateTopicStats("session-tenant", "", TopicStatsQuery{}, 0, 2, []string{"persistent://another-tenant/ns1/topic0-partition-1"})
+	assertErr(t, "topic persistent://another-tenant/ns1/topic0-partition-1 does not belong to tenant session-tenant", err)
+
+	// re-polling the first page evicts the tenant's least recently used session
+	oldest, err := PaginateTopicStats("session-tenant", "", TopicStatsQuery{}, 0, 1, nil)
+	errNil(t, err)
+	other, err := PaginateTopicStats("another-tenant", "", TopicStatsQuery{}, 0, 0, nil)
+	errNil(t, err)
+	for i := 0; i < 10; i++ {
+		page, err = PaginateTopicStats("session-tenant", "", TopicStatsQuery{}, 0, 1, nil)
+		errNil(t, err)
+	}
+	_, err = PaginateTopicStats("session-tenant", oldest.SessionID, TopicStatsQuery{}, 1, 1, nil)
+	equals(t, ErrStatsSessionNotFound, err)
+	_, err = PaginateTopicStats("session-tenant", page.SessionID, TopicStatsQuery{}, 1, 1, nil)
+	errNil(t, err)
+	_, err = PaginateTopicStats("another-tenant", other.SessionID, TopicStatsQuery{}, 0, 1, nil)
+	errNil(t, err)
+}
+
+func TestTopicStatsQuery(t *testing.T) {
+	errNil(t, InitTopicStatsDB())
+	for i := 0; i < 4; i++ {
+		consumers := []interface{}{}
+		if i%2 == 0 {
+			consumers = append(consumers, map[string]interface{}{"consumerName": "c"})
+		}
+		upsertTestTopicStats("query-tenant", "ns1", fmt.Sprintf("orders-%d", i), map[string]interface{}{
+			"msgRateIn":  float64(i * 10),
+			"publishers": []interface{}{},
+			"subscriptions": map[string]interface{}{
+				"sub1": map[string]interface{}{"msgBacklog": float64(i * 100), "consumers": consumers},
+				"sub2": map[string]interface{}{"msgBacklog": float64(i), "consumers": []interface{}{}},
+			},
+		})
+	}
+	upsertTestTopicStats("query-tenant", "ns2", "orders-9", map[string]interface{}{"msgRateIn": float64(1000)})
+
+	fields := ParseTopicStatsFields(map[string]interface{}{
+		"msgRateIn":     float64(5),
+		"subscriptions": map[string]interface{}{"a": map[string]interface{}{"msgBacklog": float64(3)}},
+	})
+	equals(t, float64(5), fields.MsgRateIn)
+	equals(t, float64(3), fields.MsgBacklog)
+	equals(t, float64(1), fields.SubscriptionCount)
+
+	// top 2 topics by backlog in the namespace
+	top, err := PaginateTopicStats("query-tenant", "", TopicStatsQuery{Namespace: "ns1", SortBy: "msgBacklog", Descending: true}, 0, 2, nil)
+	errNil(t, err)
+	equals(t, 4, top.Total)
+	equals(t, []string{"persistent://query-tenant/ns1/orders-3", "persistent://query-tenant/ns1/orders-2"}, top.Topics)
+	rest, err := PaginateTopicStats("query-tenant", top.SessionID, TopicStatsQuery{}, top.Offset, 2, nil)
+	errNil(t, err)
+	equals(t, []string{"persistent://query-tenant/ns1/orders-1", "persistent://query-tenant/ns1/orders-0"}, rest.Topics)
+
+	// topics without consumers projected to the selected fields
+	idle, err := PaginateTopicStats("query-tenant", "", TopicStatsQuery{
+		NameGlob: "orders-*",
+		Max:      map[string]float64{"consumerCount": 0},
+		Min:      map[string]float64{"msgRateIn": 1},
+		Fields:   []string{"msgRateIn", "consumerCount"},
+	}, 0, 10, nil)
+	errNil(t, err)
+	equals(t, []string{"persistent://query-tenant/ns1/orders-1", "persistent://query-tenant/ns1/orders-3", "persistent://query-tenant/ns2/orders-9"}, idle.Topics)
+	equals(t, map[string]interface{}{"msgRateIn": float64(30), "consumerCount": float64(0)}, idle.Data["persistent://query-tenant/ns1/orders-3"])
+
+	_, err = PaginateTopicStats("query-tenant", "", TopicStatsQuery{SortBy: "color"}, 0, 10, nil)
+	assertErr(t, "unsupported sort field color", err)
+	_, err = PaginateTopicStats("query-tenant", "", TopicStatsQuery{Min: map[string]float64{"color": 1}}, 0, 10, nil)
+	assertErr(t, "unsupported threshold field color", err)
+	_, err = PaginateTopicStats("query-tenant", "", TopicStatsQuery{NameGlob: "["}, 0, 10, nil)
+	assertErr(t, "invalid topic name pattern [", err)
+}
+
+func TestStatsRollup(t *testing.T) {
+	errNil(t, InitTopicStatsDB())
+	upsertTestTopicStats("rollup-a", "ns1", "orders", map[string]interface{}{"msgRateIn": float64(10), "msgThroughputIn": float64(1000), "storageSize": float64(5)})
+	upsertTestTopicStats("rollup-a", "ns1", "payments", map[string]interface{}{"msgRateIn": float64(30), "msgThroughputIn": float64(1000), "storageSize": float64(5)})
+	upsertTestTopicStats("rollup-a", "ns2", "audit", map[string]interface{}{"msgRateIn": float64(1), "storageSize": float64(100)})
+	upsertTestTopicStats("rollup-b", "ns1", "orders", map[string]interface{}{"msgRateIn": float64(500)})
+
+	namespaces, err := RollupNamespaces("rollup-a", TopicStatsQuery{SortBy: "storageSize", Descending: true}, 0, 10)
+	errNil(t, err)
+	equals(t, 2, namespaces.Total)
+	equals(t, StatsRollup{Name: "rollup-a/ns2", Tenant: "rollup-a", Topics: 1, TopicStatsFields: TopicStatsFields{MsgRateIn: 1, StorageSize: 100}}, namespaces.Data[0])
+	ns1 := namespaces.Data[1].(StatsRollup)
+	equals(t, 2, ns1.Topics)
+	equals(t, float64(40), ns1.MsgRateIn)
+	equals(t, float64(50), ns1.AverageMsgSize)
+
+	// filtered, projected and paginated like the topic stats
+	namespaces, err = RollupNamespaces("rollup-a", TopicStatsQuery{Min: map[string]float64{"msgRateIn": 10}, Fields: []string{"msgRateIn"}}, 0, 1)
+	errNil(t, err)
+	equals(t, 1, namespaces.Offset)
+	equals(t, []interface{}{map[string]interface{}{"name": "rollup-a/ns1", "tenant": "rollup-a", "topics": 2, "msgRateIn": float64(40)}}, namespaces.Data)
+
+	tenants, err := RollupTenants(TopicStatsQuery{NameGlob: "rollup-*", SortBy: "msgRateIn", Descending: true}, 1, 10)
+	errNil(t, err)
+	equals(t, 2, tenants.Total)
+	equals(t, 1, len(tenants.Data))
+	rollupA := tenants.Data[0].(StatsRollup)
+	equals(t, "rollup-a", rollupA.Name)
+	equals(t, 3, rollupA.Topics)
+	equals(t, float64(41), rollupA.MsgRateIn)
+
+	_, err = RollupTenants(TopicStatsQuery{SortBy: "color"}, 0, 10)
+	assertErr(t, "unsupported sort field color", err)
+}
+
+func TestTopicStatsHistory(t *testing.T) {
+	store := NewStatsHistoryStore(time.Minute, time.Hour, 3)
+	start := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	topic := func(name string, rateIn, backlog float64) *TopicStats {
+		return &TopicStats{
+			ID:        "persistent://history-tenant/ns1/" + name,
+			Tenant:    "history-tenant",
+			Namespace: "history-tenant/ns1",
+			Fields:    TopicStatsFields{MsgRateIn: rateIn, MsgBacklog: backlog},
+		}
+	}
+	for i := 0; i < 10; i++ {
+		// two samples per minute
+		now := start.Add(time.Duration(i*30) * time.Second)
+		store.Record([]*TopicStats{topic("topic1", float64(i), 100), topic("topic2", 1, 0)}, now)
+	}
+
+	history, err := store.Query(StatsHistoryQuery{
+		Tenant: "history-tenant",
+		Series: "persistent://history-tenant/ns1/topic1",
+		From:   start,
+		To:     start.Add(time.Hour),
+	})
+	errNil(t, err)
+	equals(t, 60, history.Step)
+	equals(t, 5, len(history.Points))
+	equals(t, start, history.Points[0].Timestamp)
+	equals(t, 0.5, history.Points[0].MsgRateIn)
+	equals(t, float64(100), history.Points[0].MsgBacklog)
+
+	// the step is rounded up to the resolution
+	history, err = store.Query(StatsHistoryQuery{
+		Tenant: "history-tenant",
+		Series: "history-tenant/ns1",
+		From:   start,
+		To:     start.Add(time.Hour),
+		Step:   90 * time.Second,
+	})
+	errNil(t, err)
+	equals(t, 120, history.Step)
+	equals(t, 3, len(history.Points))
+	equals(t, 2.5, history.Points[0].MsgRateIn)
+	equals(t, float64(100), history.Points[0].MsgBacklog)
+
+	_, err = store.Query(StatsHistoryQuery{Tenant: "another-tenant", Series: "history-tenant/ns1", From: start, To: start.Add(time.Hour)})
+	equals(t, ErrStatsHistoryNotFound, err)
+	_, err = store.Query(StatsHistoryQuery{Tenant: "history-tenant", Series: "history-tenant/ns1", From: start, To: start})
+	assert(t, err != nil, "from must be before to")
+
+	// the least recently updated series is evicted over the maximum number of series
+	store.Record([]*TopicStats{topic("topic2", 1, 0)}, start.Add(5*time.Minute))
+	store.Record([]*TopicStats{topic("topic3", 1, 0)}, start.Add(10*time.Minute))
+	_, err = store.Query(StatsHistoryQuery{Tenant: "history-tenant", Series: "persistent://history-tenant/ns1/topic1", From: start, To: start.Add(time.Hour)})
+	equals(t, ErrStatsHistoryNotFound, err)
+
+	// the samples older than the retention are dropped
+	store.Record([]*TopicStats{topic("topic3", 2, 0)}, start.Add(2*time.Hour))
+	history, err = store.Query(StatsHistoryQuery{Tenant: "history-tenant", Series: "persistent://history-tenant/ns1/topic3", From: start, To: start.Add(3 * time.Hour)})
+	errNil(t, err)
+	equals(t, 1, len(history.Points))
+	_, err = store.Query(StatsHistoryQuery{Tenant: "history-tenant", Series: "persistent://history-tenant/ns1/topic2", From: start, To: start.Add(3 * time.Hour)})
+	equals(t, ErrStatsHistoryNotFound, err)
+}
+
+func TestTopicStatsHistoryMaxSeries(t *testing.T) {
+	store := NewStatsHistoryStore(time.Minute, time.Hour, 3)
+	start := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	topics := []*TopicStats{}
+	for i := 1; i <= 5; i++ {
+		topics = append(topics, &TopicStats{
+			ID:        fmt.Sprintf("persistent://capped-tenant/ns1/topic%d", i),
+			Tenant:    "capped-tenant",
+			Namespace: "capped-tenant/ns1",
+			Fields:    TopicStatsFields{MsgRateIn: float64(i)},
+		})
+	}
+	points := func(series string) int {
+		history, err := store.Query(StatsHistoryQuery{Tenant: "capped-tenant", Series: series, From: start, To: start.Add(time.Hour)})
+		if err != nil {
+			return 0
+		}
+		return len(history.Points)
+	}
+
+	// the namespace and the first topics are kept on every poll over the maximum number of series
+	for i := 0; i < 3; i++ {
+		store.Record(topics, start.Add(time.Duration(i)*time.Minute))
+		equals(t, int64(3*(i+1)), store.DroppedSeries())
+	}
+	equals(t, 3, points("capped-tenant/ns1"))
+	equals(t, 3, points("persistent://capped-tenant/ns1/topic1"))
+	equals(t, 3, points("persistent://capped-tenant/ns1/topic2"))
+	for _, v := range []string{"topic3", "topic4", "topic5"} {
+		equals(t, 0, points("persistent://capped-tenant/ns1/"+v))
+	}
+
+	// a series no longer updated gives way to a new one
+	store.Record(topics[1:3], start.Add(3*time.Minute))
+	equals(t, int64(10), store.DroppedSeries())
+	equals(t, 0, points("persistent://capped-tenant/ns1/topic1"))
+	equals(t, 4, points("persistent://capped-tenant/ns1/topic2"))
+	equals(t, 1, points("persistent://capped-tenant/ns1/topic3"))
+}
+
+func TestPollBrokersTopicStats(t *testing.T) {
+	errNil(t, InitTopicStatsDB())
+	newBroker := func(namespace string, topics int, delay time.Duration) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			equals(t, "/admin/v2/broker-stats/topics", r.URL.Path)
+			time.Sleep(delay)
+			bundle := map[string]interface{}{}
+			for i := 0; i < topics; i++ {
+				name := fmt.Sprintf("persistent://%s/topic%d", namespace, i)
+				bundle[name] = map[string]interface{}{"msgRateIn": float64(i)}
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				namespace: map[string]interface{}{"0x00000000_0x40000000": map[string]interface{}{"persistent": bundle}},
+			})
+		}))
+	}
+	fast1 := newBroker("poll-tenant/ns1", 3, 0)
+	defer fast1.Close()
+	fast2 := newBroker("poll-tenant/ns2", 2, 0)
+	defer fast2.Close()
+	slow := newBroker("poll-tenant/ns3", 1, time.Second)
+	defer slow.Close()
+	failed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failed.Close()
+
+	start := time.Now()
+	result := PollBrokersTopicStats([]string{slow.URL, fast1.URL, failed.URL, fast2.URL}, 2, 200*time.Millisecond)
+	assert(t, time.Since(start) < time.Second, "a slow broker is abandoned after the deadline")
+	equals(t, 5, result.Topics)
+	equals(t, 2, len(result.Errors))
+	_, ok := result.Errors[slow.URL]
+	assert(t, ok, "the slow broker is reported")
+	_, ok = result.Errors[failed.URL]
+	assert(t, ok, "the failed broker is reported")
+	equals(t, map[string]bool{fast1.URL: true, fast2.URL: true}, result.Polled)
+
+	page, err := PaginateTopicStats("poll-tenant", "", TopicStatsQuery{SortBy: "msgRateIn", Descending: true}, 0, 10, nil)
+	errNil(t, err)
+	equals(t, 5, page.Total)
+	equals(t, "persistent://poll-tenant/ns1/topic2", page.Topics[0])
+}
+
+func TestSummarizeBrokers(t *testing.T) {
+	newBroker := func(throughput float64, bundles []string, topics map[string]interface{}) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/admin/v2/broker-stats/load-report":
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"cpu":              map[string]interface{}{"usage": float64(50), "limit": float64(200)},
+					"msgThroughputIn":  throughput,
+					"msgThroughputOut": throughput,
+					"numProducers":     3,
+					"bundles":          bundles,
+				})
+			case "/admin/v2/broker-stats/topics":
+				json.NewEncoder(w).Encode(topics)
+			case "/admin/v2/broker-stats/metrics":
+				json.NewEncoder(w).Encode([]interface{}{
+					map[string]interface{}{"dimensions": map[string]interface{}{"namespace": "summary/ns1"}, "metrics": map[string]interface{}{"brk_in_tp_rate": throughput}},
+				})
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+	}
+	topicsOf := func(ns, bundle string, names ...string) map[string]interface{} {
+		topics := map[string]interface{}{}
+		for _, v := range names {
+			topics["persistent://"+ns+"/"+v] = map[string]interface{}{}
+		}
+		return map[string]interface{}{ns: map[string]interface{}{bundle: map[string]interface{}{"persistent": topics}}}
+	}
+	hot := newBroker(3000, []string{"summary/ns1/0x00000000_0x40000000", "summary/ns2/0x00000000_0x80000000"},
+		topicsOf("summary/ns1", "0x00000000_0x40000000", "a", "b", "c"))
+	defer hot.Close()
+	cold := newBroker(1000, []string{"summary/ns1/0x40000000_0x80000000"}, topicsOf("summary/ns1", "0x40000000_0x80000000", "d"))
+	defer cold.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusInternalServerError) }))
+	defer down.Close()
+
+	summary := SummarizeBrokers([]string{hot.URL, cold.URL, down.URL}, 1, 2, time.Second)
+	equals(t, 3, len(summary.Brokers))
+	equals(t, 1, summary.FailedBrokers)
+	equals(t, 3, summary.Bundles)
+	equals(t, 4, summary.Topics)
+	equals(t, float64(4000), summary.MsgThroughputIn)
+	equals(t, []string{hot.URL}, summary.HotBrokers)
+	equals(t, []NamespaceBundles{{Namespace: "summary/ns1", Bundles: 2, Brokers: 2, MsgThroughputIn: 4000}}, summary.TopNamespaces)
+	equals(t, 0.5, summary.Imbalance.Throughput)
+	equals(t, 0.5, summary.Imbalance.Topics)
+
+	for _, v := range summary.Brokers {
+		switch v.Broker {
+		case hot.URL:
+			equals(t, 2, v.Bundles)
+			equals(t, 3, v.Topics)
+			equals(t, 3, v.Producers)
+			equals(t, float64(25), v.CPU)
+		case down.URL:
+			assert(t, v.Error != "", "the failed broker has the error")
+		}
+	}
+}
+
+func TestTopicOwnership(t *testing.T) {
+	errNil(t, InitTopicStatsDB())
+	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/admin/v2/broker-stats/topics":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"owner-tenant/ns1": map[string]interface{}{"0x00000000_0x40000000": map[string]interface{}{"persistent": map[string]interface{}{
+					"persistent://owner-tenant/ns1/orders": map[string]interface{}{},
+				}}},
+				"owner-tenant/ns2": map[string]interface{}{"0x40000000_0x80000000": map[string]interface{}{"persistent": map[string]interface{}{
+					"persistent://owner-tenant/ns2/audit": map[string]interface{}{},
+				}}},
+			})
+		case "/lookup/v2/topic/persistent/owner-tenant/ns1/payments", "/lookup/v2/topic/persistent/owner-tenant/ns1/cold":
+			json.NewEncoder(w).Encode(map[string]string{"brokerUrl": "pulsar://broker-1:6650", "httpUrl": "http://broker-1:8080"})
+		case "/lookup/v2/topic/persistent/owner-tenant/ns1/payments/bundle", "/lookup/v2/topic/persistent/owner-tenant/ns1/cold/bundle":
+			w.Write([]byte("0x80000000_0xc0000000"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer broker.Close()
+	util.Config.BrokerProxyURL = broker.URL
+	defer func() { util.Config.BrokerProxyURL = "" }()
+
+	PollBrokersTopicStats([]string{broker.URL}, 1, time.Second)
+	// a cached topic without the owner is looked up
+	upsertTestTopicStats("owner-tenant", "ns1", "payments", map[string]interface{}{})
+
+	ownership, err := TenantTopicOwnership("owner-tenant", "ns1", []string{"persistent://owner-tenant/ns1/cold", "persistent://owner-tenant/ns1/missing", "persistent://owner-tenant/ns1/cold"}, time.Now())
+	errNil(t, err)
+	equals(t, 4, len(ownership))
+	equals(t, TopicOwnership{Topic: "persistent://owner-tenant/ns1/cold", Namespace: "owner-tenant/ns1", Broker: "broker-1:8080", Bundle: "0x80000000_0xc0000000", Source: OwnershipFromLookup}, ownership[0])
+	equals(t, OwnershipFromLookup, ownership[1].Source)
+	assert(t, ownership[1].Error != "", "the lookup of a missing topic fails")
+	equals(t, TopicOwnership{Topic: "persistent://owner-tenant/ns1/orders", Namespace: "owner-tenant/ns1", Broker: broker.URL, Bundle: "0x00000000_0x40000000", Source: OwnershipFromStats}, ownership[2])
+	equals(t, "broker-1:8080", ownership[3].Broker)
+
+	ownership, err = TenantTopicOwnership("owner-tenant", "owner-tenant/ns2", nil, time.Now())
+	errNil(t, err)
+	equals(t, []TopicOwnership{{Topic: "persistent://owner-tenant/ns2/audit", Namespace: "owner-tenant/ns2", Broker: broker.URL, Bundle: "0x40000000_0x80000000", Source: OwnershipFromStats}}, ownership)
+
+	_, err = TenantTopicOwnership("owner-tenant", "", []string{"persistent://another-tenant/ns1/orders"}, time.Now())
+	assertErr(t, "topic persistent://another-tenant/ns1/orders does not belong to tenant owner-tenant", err)
+
+	tooMany := []string{}
+	for i := 0; i <= 100; i++ {
+		tooMany = append(tooMany, fmt.Sprintf("persistent://owner-tenant/ns1/topic%d", i))
+	}
+	_, err = TenantTopicOwnership("owner-tenant", "", tooMany, time.Now())
+	assertErr(t, "at most 100 topics can be requested", err)
+}
+
+func TestPartitionedTopicRollup(t *testing.T) {
+	errNil(t, InitTopicStatsDB())
+	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bundle := map[string]interface{}{
+			"persistent://rollup-tenant/ns1/orders-partition-0":   map[string]interface{}{"msgRateIn": float64(10), "msgThroughputIn": float64(1000)},
+			"persistent://rollup-tenant/ns1/orders-partition-1":   map[string]interface{}{"msgRateIn": float64(30), "msgThroughputIn": float64(1000)},
+			"persistent://rollup-tenant/ns1/payments-partition-0": map[string]interface{}{"msgRateIn": float64(1)},
+			"persistent://rollup-tenant/ns1/audit":                map[string]interface{}{"msgRateIn": float64(1)},
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"rollup-tenant/ns1": map[string]interface{}{"0x00000000_0x40000000": map[string]interface{}{"persistent": bundle}},
+			"rollup-tenant/ns2": map[string]interface{}{"0x00000000_0x40000000": map[string]interface{}{"persistent": map[string]interface{}{
+				"persistent://rollup-tenant/ns2/orders-partition-0": map[string]interface{}{"msgRateIn": float64(5)},
+			}}},
+		})
+	}))
+	defer broker.Close()
+
+	result := PollBrokersTopicStats([]string{broker.URL}, 1, time.Second)
+	equals(t, 5, result.Topics)
+	// every partitioned topic of the tenant is tracked
+	equals(t, map[string]bool{
+		"persistent://rollup-tenant/ns1/orders":   true,
+		"persistent://rollup-tenant/ns1/payments": true,
+		"persistent://rollup-tenant/ns2/orders":   true,
+	}, result.PartitionTopics)
+
+	TrackPartitionedTopics(result.PartitionTopics, time.Now().Add(-2*time.Minute))
+	TrackPartitionedTopics(map[string]bool{"persistent://rollup-tenant/ns1/orders": true}, time.Now())
+	equals(t, []string{"persistent://rollup-tenant/ns1/orders"}, PartitionedTopics())
+
+	topics := RollupPartitionedTopics("rollup-tenant")
+	equals(t, 3, len(topics))
+	orders := topics[0]
+	equals(t, "persistent://rollup-tenant/ns1/orders", orders.ID)
+	equals(t, "rollup-tenant/ns1", orders.Namespace)
+	equals(t, "orders", orders.Topic)
+	equals(t, []string{"persistent://rollup-tenant/ns1/orders-partition-0", "persistent://rollup-tenant/ns1/orders-partition-1"}, orders.Partitions)
+	equals(t, float64(40), orders.Fields.MsgRateIn)
+	equals(t, float64(50), orders.Fields.AverageMsgSize)
+	equals(t, "persistent://rollup-tenant/ns2/orders", topics[2].ID)
+	equals(t, float64(5), topics[2].Fields.MsgRateIn)
+}
+
+func TestCountTenantClients(t *testing.T) {
+	errNil(t, InitTopicStatsDB())
+	clients := map[string]interface{}{
+		"publishers":    []interface{}{map[string]interface{}{}},
+		"subscriptions": map[string]interface{}{"billing": map[string]interface{}{"consumers": []interface{}{map[string]interface{}{}}}},
+	}
+	upsertTestTopicStats("clients-tenant", "ns1", "orders-partition-0", clients)
+	upsertTestTopicStats("clients-tenant", "ns1", "orders-partition-1", clients)
+	upsertTestTopicStats("clients-tenant", "ns1", "audit", clients)
+	// the aggregated partitioned-stats carry the clients of both partitions
+	UpsertTopicStats(TopicStats{
+		ID:        util.PartitionPrefix + "persistent://clients-tenant/ns1/orders",
+		Tenant:    "clients-tenant",
+		Namespace: "clients-tenant/ns1",
+		Topic:     "orders",
+		UpdatedAt: time.Now(),
+		Data: map[string]interface{}{
+			"publishers": []interface{}{map[string]interface{}{}, map[string]interface{}{}},
+			"subscriptions": map[string]interface{}{"billing": map[string]interface{}{
+				"consumers": []interface{}{map[string]interface{}{}, map[string]interface{}{}}}},
+		},
+	})
+
+	producers, consumers := CountTenantClients("clients-tenant")
+	equals(t, 3, producers)
+	equals(t, 3, consumers)
+}
+
+func TestSubscriptionStats(t *testing.T) {
+	errNil(t, InitTopicStatsDB())
+	topicStats := func(backlog float64) map[string]interface{} {
+		return map[string]interface{}{
+			"subscriptions": map[string]interface{}{
+				"billing": map[string]interface{}{
+					"type":             "Shared",
+					"msgBacklog":       backlog,
+					"unackedMessages":  float64(3),
+					"msgRateRedeliver": float64(0.5),
+					"consumers": []interface{}{
+						map[string]interface{}{"address": "/10.0.0.2:5000"},
+						map[string]interface{}{"address": "/10.0.0.1:5000"},
+					},
+				},
+				"audit": map[string]interface{}{"type": "Exclusive", "msgBacklog": float64(7), "consumers": []interface{}{}},
+			},
+		}
+	}
+	upsertTestTopicStats("sub-tenant", "ns2", "payments", map[string]interface{}{
+		"subscriptions": map[string]interface{}{"billing": map[string]interface{}{"type": "Failover", "msgBacklog": float64(1)}},
+	})
+
+	// the backlog grows over the successive polls
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		upsertTestTopicStats("sub-tenant", "ns1", "orders", topicStats(float64(100*(i+1))))
+		RecordSubscriptionTrends(start.Add(time.Duration(i*10) * time.Second))
+	}
+
+	list, err := QuerySubscriptions("sub-tenant", SubscriptionQuery{SortBy: "msgBacklog", Descending: true}, start.Add(20*time.Second))
+	errNil(t, err)
+	equals(t, 3, list.Total)
+	billing := list.Data[0]
+	equals(t, "persistent://sub-tenant/ns1/orders", billing.Topic)
+	equals(t, "billing", billing.Subscription)
+	equals(t, "Shared", billing.Type)
+	equals(t, float64(300), billing.MsgBacklog)
+	equals(t, float64(3), billing.UnackedMessages)
+	equals(t, float64(0.5), billing.MsgRateRedeliver)
+	equals(t, 2, billing.ConsumerCount)
+	equals(t, []string{"/10.0.0.1:5000", "/10.0.0.2:5000"}, billing.ClientAddresses)
+	equals(t, SubscriptionTrend{Samples: 3, BacklogChange: 200, BacklogRate: 10, Direction: "growing"}, billing.Trend)
+	equals(t, "steady", list.Data[1].Trend.Direction)
+
+	// subscriptions without consumers in a namespace
+	list, err = QuerySubscriptions("sub-tenant", SubscriptionQuery{Namespace: "ns1", Max: map[string]float64{"consumerCount": 0}}, start.Add(20*time.Second))
+	errNil(t, err)
+	equals(t, 1, list.Total)
+	equals(t, "audit", list.Data[0].Subscription)
+
+	list, err = QuerySubscriptions("sub-tenant", SubscriptionQuery{NameGlob: "bill*", Type: "failover"}, start.Add(20*time.Second))
+	errNil(t, err)
+	equals(t, 1, list.Total)
+	equals(t, "persistent://sub-tenant/ns2/payments", list.Data[0].Topic)
+
+	list, err = QuerySubscriptions("sub-tenant", SubscriptionQuery{Offset: 1, Limit: 1}, start.Add(20*time.Second))
+	errNil(t, err)
+	equals(t, 2, list.Offset)
+	equals(t, "billing", list.Data[0].Subscription)
+
+	_, err = QuerySubscriptions("sub-tenant", SubscriptionQuery{SortBy: "color"}, start)
+	assertErr(t, "unsupported sort field color", err)
+}
+
+func TestIdleTopicsReport(t *testing.T) {
+	errNil(t, InitTopicStatsDB())
+	publisher := []interface{}{map[string]interface{}{"address": "/10.0.0.1:5000"}}
+	poll := func(now time.Time, busyPublishers []interface{}, backlog float64) {
+		upsertTestTopicStats("idle-tenant", "ns1", "abandoned", map[string]interface{}{"storageSize": float64(4096)})
+		upsertTestTopicStats("idle-tenant", "ns1", "busy", map[string]interface{}{"publishers": busyPublishers})
+		upsertTestTopicStats("idle-tenant", "ns1", "orders-partition-0", map[string]interface{}{})
+		upsertTestTopicStats("idle-tenant", "ns1", "orders-partition-1", map[string]interface{}{})
+		upsertTestTopicStats("idle-tenant", "ns1", "mixed-partition-0", map[string]interface{}{})
+		upsertTestTopicStats("idle-tenant", "ns1", "mixed-partition-1", map[string]interface{}{"publishers": publisher})
+		upsertTestTopicStats("idle-tenant", "ns2", "events", map[string]interface{}{
+			"msgRateIn": float64(5),
+			"subscriptions": map[string]interface{}{
+				"orphan": map[string]interface{}{"msgBacklog": backlog, "consumers": []interface{}{}},
+			},
+		})
+		RecordTopicStatsHistory(now)
+		RecordSubscriptionTrends(now)
+	}
+	now := time.Now()
+	poll(now.Add(-3*time.Hour), publisher, 10)
+	poll(now.Add(-90*time.Minute), []interface{}{}, 20)
+	poll(now, []interface{}{}, 30)
+
+	report, err := IdleTopicsReport("idle-tenant", 2*time.Hour, now)
+	errNil(t, err)
+	equals(t, 7200, report.Period)
+	equals(t, 2, len(report.Topics))
+	equals(t, "persistent://idle-tenant/ns1/abandoned", report.Topics[0].Topic)
+	equals(t, float64(4096), report.Topics[0].StorageSize)
+	equals(t, 0, report.Topics[0].Partitions)
+	equals(t, "persistent://idle-tenant/ns1/orders", report.Topics[1].Topic)
+	equals(t, 2, report.Topics[1].Partitions)
+	equals(t, 1, len(report.Subscriptions))
+	equals(t, "orphan", report.Subscriptions[0].Subscription)
+
+	// busy has been idle for 90 minutes
+	report, err = IdleTopicsReport("idle-tenant", time.Hour, now)
+	errNil(t, err)
+	equals(t, 3, len(report.Topics))
+	_, err = IdleTopicsReport("idle-tenant", 48*time.Hour, now)
+	assertErr(t, "period 48h0m0s exceeds the topic stats history retention 24h0m0s", err)
+
+	deleted := []string{}
+	ordersPartitions := 3
+	broker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			// the partitioned metadata
+			fmt.Fprintf(w, `{"partitions":%d}`, ordersPartitions)
+			return
+		}
+		deleted = append(deleted, r.Method+" "+r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer broker.Close()
+	util.Config.BrokerProxyURL = broker.URL
+	defer func() { util.Config.BrokerProxyURL = "" }()
+
+	// the third partition of orders is not in the cache
+	result, err := CleanupIdleTopics("idle-tenant", IdleCleanupRequest{}, 2*time.Hour, true, now)
+	errNil(t, err)
+	equals(t, 3, len(result.Actions))
+	equals(t, "persistent://idle-tenant/ns1/orders", result.Actions[1].Topic)
+	equals(t, "skipped", result.Actions[1].Status)
+	equals(t, "2 of 3 partitions are idle", result.Actions[1].Reason)
+
+	ordersPartitions = 2
+	result, err = CleanupIdleTopics("idle-tenant", IdleCleanupRequest{}, 2*time.Hour, true, now)
+	errNil(t, err)
+	equals(t, 3, len(result.Actions))
+	for _, v := range result.Actions {
+		equals(t, "planned", v.Status)
+	}
+	equals(t, 0, len(deleted))
+
+	result, err = CleanupIdleTopics("idle-tenant", IdleCleanupRequest{
+		Topics:        []string{"persistent://idle-tenant/ns1/orders", "persistent://idle-tenant/ns1/busy"},
+		Subscriptions: []SubscriptionRef{{Topic: "persistent://idle-tenant/ns2/events", Subscription: "orphan"}},
+	}, 2*time.Hour, false, now)
+	errNil(t, err)
+	equals(t, "done", result.Actions[0].Status)
+	equals(t, "skipped", result.Actions[1].Status)
+	equals(t, "done", result.Actions[2].Status)
+	equals(t, []string{
+		"DELETE /admin/v2/persistent/idle-tenant/ns1/orders/partitions",
+		"DELETE /admin/v2/persistent/idle-tenant/ns2/events/subscription/orphan",
+	}, deleted)
+}
+
+func TestTopicEvents(t *testing.T) {
+	errNil(t, InitTopicStatsDB())
+	upsert := func(topic, broker string, data interface{}) {
+		UpsertTopicStats(TopicStats{
+			ID:        "persistent://events-tenant/ns1/" + topic,
+			Tenant:    "events-tenant",
+			Namespace: "events-tenant/ns1",
+			Topic:     topic,
+			Data:      data,
+			UpdatedAt: time.Now(),
+			Broker:    broker,
+		})
+	}
+	polled := map[string]bool{"broker-1": true, "broker-2": true}
+	client := map[string]interface{}{"address": "/10.0.0.1:5000"}
+	upsert("orders", "broker-1", map[string]interface{}{
+		"publishers":    []interface{}{client},
+		"subscriptions": map[string]interface{}{"billing": map[string]interface{}{"consumers": []interface{}{}}},
+	})
+	upsert("legacy", "broker-2", map[string]interface{}{})
+	// the first poll is the baseline, the next poll without changes has no events
+	RecordTopicEvents(time.Now(), polled)
+	equals(t, 0, len(RecordTopicEvents(time.Now(), polled)))
+
+	errNil(t, InitTopicStatsDB())
+	upsert("orders", "broker-1", map[string]interface{}{
+		"publishers": []interface{}{client, client},
+		"subscriptions": map[string]interface{}{
+			"audit": map[string]interface{}{"consumers": []interface{}{client}},
+		},
+	})
+	upsert("payments", "broker-1", map[string]interface{}{
+		"subscriptions": map[string]interface{}{"billing": map[string]interface{}{"consumers": []interface{}{}}},
+	})
+	// the topic of a broker failing the poll is not deleted
+	events := RecordTopicEvents(time.Now(), map[string]bool{"broker-1": true})
+	types := []string{}
+	for _, e := range events {
+		types = append(types, e.Type+" "+e.Topic+" "+e.Subscription)
+	}
+	equals(t, []string{
+		"producers.changed persistent://events-tenant/ns1/orders ",
+		"consumers.changed persistent://events-tenant/ns1/orders ",
+		"subscription.created persistent://events-tenant/ns1/orders audit",
+		"subscription.deleted persistent://events-tenant/ns1/orders billing",
+		"topic.created persistent://events-tenant/ns1/payments ",
+		"subscription.created persistent://events-tenant/ns1/payments billing",
+	}, types)
+	equals(t, 2, events[0].Producers)
+	equals(t, 1, events[0].Delta)
+	assert(t, events[0].Seq > time.Now().Add(-time.Hour).UnixNano()/int64(time.Microsecond), "the sequence is seeded from the boot time")
+
+	// the feed resumes after a sequence and filters by the event types
+	feed := TopicEvents("events-tenant", events[0].Seq-1, nil, 3)
+	equals(t, 3, len(feed.Events))
+	equals(t, events[2].Seq, feed.Next)
+	feed = TopicEvents("events-tenant", feed.Next, []string{TopicCreated, TopicDeleted}, 0)
+	equals(t, 1, len(feed.Events))
+	equals(t, "persistent://events-tenant/ns1/payments", feed.Events[0].Topic)
+	equals(t, events[5].Seq, feed.Next)
+	equals(t, 0, len(TopicEvents("other-tenant", 0, nil, 0).Events))
+
+	// the topic is deleted once its broker is polled without it
+	events = RecordTopicEvents(time.Now(), polled)
+	equals(t, 1, len(events))
+	equals(t, TopicDeleted, events[0].Type)
+	equals(t, "persistent://events-tenant/ns1/legacy", events[0].Topic)
+}
+
+func TestClientConnections(t *testing.T) {
+	errNil(t, InitTopicStatsDB())
+	upsertTestTopicStats("conn-tenant", "ns1", "orders", map[string]interface{}{
+		"publishers": []interface{}{
+			map[string]interface{}{"producerName": "web-1", "address": "/10.0.0.1:5000", "clientVersion": "2.7.1", "connectedSince": "2021-03-01T10:00:00Z", "msgRateIn": float64(12)},
+		},
+		"subscriptions": map[string]interface{}{
+			"billing": map[string]interface{}{"consumers": []interface{}{
+				map[string]interface{}{"consumerName": "b", "address": "/10.0.0.2:5000", "clientVersion": "Pulsar-Java-v2.8.0", "appId": "billing-svc", "msgRateOut": float64(3)},
+				map[string]interface{}{"consumerName": "a", "address": "/10.0.0.3:5000", "clientVersion": "Pulsar-Java-v2.8.0", "appId": "billing-svc"},
+			}},
+		},
+	})
+	upsertTestTopicStats("conn-tenant", "ns2", "audit", map[string]interface{}{
+		"subscriptions": map[string]interface{}{
+			"audit": map[string]interface{}{"consumers": []interface{}{
+				map[string]interface{}{"consumerName": "c", "address": "/10.0.1.1:5000", "clientVersion": "Pulsar-Go-v0.7.0"},
+			}},
+		},
+	})
+
+	all, err := QueryConnections("conn-tenant", ConnectionQuery{}, time.Now())
+	errNil(t, err)
+	equals(t, 4, all.Total)
+	equals(t, ClientConnection{
+		Type: ProducerConnection, Topic: "persistent://conn-tenant/ns1/orders", Namespace: "conn-tenant/ns1", Name: "web-1",
+		Address: "/10.0.0.1:5000", ClientVersion: "2.7.1", ConnectedSince: "2021-03-01T10:00:00Z", MsgRate: 12,
+	}, all.Data[0])
+	equals(t, "a", all.Data[1].Name)
+	equals(t, "billing", all.Data[1].Subscription)
+	equals(t, "billing-svc", all.Data[1].Role)
+	equals(t, "persistent://conn-tenant/ns2/audit", all.Data[3].Topic)
+
+	java, err := QueryConnections("conn-tenant", ConnectionQuery{ClientVersion: "java", Role: "billing", Offset: 1, Limit: 1}, time.Now())
+	errNil(t, err)
+	equals(t, 2, java.Total)
+	equals(t, 2, java.Offset)
+	equals(t, "b", java.Data[0].Name)
+	equals(t, float64(3), java.Data[0].MsgRate)
+
+	subnet, err := QueryConnections("conn-tenant", ConnectionQuery{Address: "10.0.0.", Type: ConsumerConnection, Namespace: "ns1"}, time.Now())
+	errNil(t, err)
+	equals(t, 2, subnet.Total)
+
+	_, err = QueryConnections("conn-tenant", ConnectionQuery{Type: "reader"}, time.Now())
+	assertErr(t, "unsupported connection type reader", err)
+}
+
+func TestAlertRules(t *testing.T) {
+	errNil(t, InitTopicStatsDB())
+	plan, err := ReconcileTenantPlan(TenantPlan{Name: "alert-tenant", PlanType: FreeTier}, TenantPlan{})
+	errNil(t, err)
+
+	_, _, err = AddAlertRule(plan, AlertRule{Metric: "color", Operator: ">"})
+	assertErr(t, "unsupported topic metric color", err)
+	_, _, err = AddAlertRule(plan, AlertRule{Target: AlertTargetSubscription, Metric: "consumerCount", Operator: "=~"})
+	assertErr(t, "unsupported operator =~", err)
+	_, _, err = AddAlertRule(plan, AlertRule{Metric: "msgBacklog", Operator: ">", For: "5 minutes"})
+	assertErr(t, "invalid duration 5 minutes", err)
+
+	plan, backlog, err := AddAlertRule(plan, AlertRule{Name: "backlog", Metric: "msgBacklog", Operator: ">", Threshold: 1000, For: "5m", Namespace: "ns1"})
+	errNil(t, err)
+	assert(t, backlog.ID != "", "the rule id is generated")
+	equals(t, AlertTargetTopic, backlog.Target)
+	plan, noConsumer, err := AddAlertRule(plan, AlertRule{Name: "no consumer", Target: AlertTargetSubscription, Metric: "consumerCount", Operator: "==", Threshold: 0, Subscription: "billing"})
+	errNil(t, err)
+	// the free plan allows two rules
+	equals(t, 2, AlertRuleLimit(plan))
+	_, _, err = AddAlertRule(plan, AlertRule{Metric: "msgRateIn", Operator: "<", Threshold: 1})
+	assertErr(t, "the plan allows 2 alert rules", err)
+	_, _, err = AddAlertRule(plan, AlertRule{ID: "unknown", Metric: "msgRateIn", Operator: "<", Threshold: 1})
+	equals(t, ErrAlertRuleNotFound, err)
+
+	// the rules are kept by a plan update without rules
+	updated, err := ReconcileTenantPlan(TenantPlan{Name: "alert-tenant", PlanType: StarterTier}, plan)
+	errNil(t, err)
+	equals(t, 2, len(updated.AlertRules))
+
+	receiver := &webhookReceiver{secret: "alert-secret"}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	webhook.Manager.SetSubscriptions([]webhook.Subscription{{ID: "alerts", URL: server.URL, Secret: "alert-secret",
+		Events: []string{webhook.AlertFiring, webhook.AlertResolved}}})
+	defer webhook.Manager.SetSubscriptions(nil)
+	config := util.Config
+	defer func() { util.Config = config }()
+	util.Config.NotificationLeader = "true"
+
+	stats := func(backlog float64, consumers []interface{}) map[string]interface{} {
+		return map[string]interface{}{"subscriptions": map[string]interface{}{
+			"billing": map[string]interface{}{"msgBacklog": backlog, "consumers": consumers},
+		}}
+	}
+	// the stats cache is refreshed by every poll
+	poll := func(at time.Time, ns1Consumers []interface{}) {
+		for ns, consumers := range map[string][]interface{}{"ns1": ns1Consumers, "ns2": {map[string]interface{}{}}} {
+			UpsertTopicStats(TopicStats{
+				ID:        "persistent://alert-tenant/" + ns + "/orders",
+				Tenant:    "alert-tenant",
+				Namespace: "alert-tenant/" + ns,
+				Topic:     "orders",
+				Data:      stats(5000, consumers),
+				UpdatedAt: at,
+				Broker:    "broker-1",
+			})
+		}
+		EvaluateAlerts([]TenantPlan{plan}, at, map[string]bool{"broker-1": true})
+	}
+	start := time.Now()
+	poll(start, []interface{}{})
+	alerts := TenantAlerts("alert-tenant")
+	equals(t, 2, len(alerts))
+	byRule := map[string]Alert{}
+	for _, v := range alerts {
+		byRule[v.RuleID] = v
+	}
+	// the backlog is pending until it holds for 5 minutes, while the subscription without consumers fires at once
+	equals(t, AlertPending, byRule[backlog.ID].Status)
+	equals(t, "persistent://alert-tenant/ns1/orders", byRule[backlog.ID].Target)
+	equals(t, AlertFiring, byRule[noConsumer.ID].Status)
+	equals(t, "persistent://alert-tenant/ns1/orders/billing", byRule[noConsumer.ID].Target)
+
+	poll(start.Add(5*time.Minute), []interface{}{})
+	for _, v := range TenantAlerts("alert-tenant") {
+		equals(t, AlertFiring, v.Status)
+	}
+
+	// a consumer connects
+	poll(start.Add(6*time.Minute), []interface{}{map[string]interface{}{}})
+	for _, v := range TenantAlerts("alert-tenant") {
+		if v.RuleID == noConsumer.ID {
+			equals(t, AlertResolved, v.Status)
+			assert(t, v.ResolvedAt != nil, "the resolved time is set")
+		}
+	}
+	status := func(ruleID string) string {
+		for _, v := range TenantAlerts("alert-tenant") {
+			if v.RuleID == ruleID {
+				return v.Status
+			}
+		}
+		return ""
+	}
+
+	// the stats are unknown rather than cleared while the broker of the stale topic fails the poll
+	EvaluateAlerts([]TenantPlan{plan}, start.Add(8*time.Minute), map[string]bool{})
+	equals(t, AlertFiring, status(backlog.ID))
+	// the topic is gone once its broker is polled without it
+	EvaluateAlerts([]TenantPlan{plan}, start.Add(9*time.Minute), map[string]bool{"broker-1": true})
+	equals(t, AlertResolved, status(backlog.ID))
+
+	webhook.Manager.Wait()
+	types := []string{}
+	for _, v := range receiver.events {
+		types = append(types, v.Type)
+	}
+	// the deliveries are asynchronous
+	sort.Strings(types)
+	equals(t, []string{webhook.AlertFiring, webhook.AlertFiring, webhook.AlertResolved, webhook.AlertResolved}, types)
+
+	// a replica other than the notification leader evaluates the alerts without notifying them
+	util.Config.NotificationLeader = "false"
+	poll(start.Add(10*time.Minute), []interface{}{})
+	equals(t, AlertFiring, status(noConsumer.ID))
+	webhook.Manager.Wait()
+	equals(t, 4, len(receiver.events))
+
+	// the alerts are dropped once the tenant has no rules
+	plan, err = RemoveAlertRule(plan, backlog.ID)
+	errNil(t, err)
+	plan, err = RemoveAlertRule(plan, noConsumer.ID)
+	errNil(t, err)
+	_, err = RemoveAlertRule(plan, noConsumer.ID)
+	equals(t, ErrAlertRuleNotFound, err)
+	EvaluateAlerts([]TenantPlan{plan}, start.Add(11*time.Minute), nil)
+	equals(t, 0, len(TenantAlerts("alert-tenant")))
+}
+
+func TestInvalidAlertRules(t *testing.T) {
+	errNil(t, InitTopicStatsDB())
+	store, err := NewZookeeperDriver(newInMemoryZk(), "/burnell/alerts")
+	errNil(t, err)
+	handler := NewTenantPolicyHandler(store)
+
+	_, status, err := handler.UpdateTenant("invalid-alerts", TenantPlan{PlanType: FreeTier,
+		AlertRules: []AlertRule{{Name: "color", Metric: "color", Operator: ">"}}}, "admin", AnyVersion)
+	assertErr(t, "alert rule color: unsupported topic metric color", err)
+	equals(t, http.StatusUnprocessableEntity, status)
+
+	// the rules set with the plan are defaulted the same way as the alerts endpoint
+	plan, _, err := handler.UpdateTenant("invalid-alerts", TenantPlan{PlanType: FreeTier,
+		AlertRules: []AlertRule{{Name: "backlog", Metric: "msgBacklog", Operator: ">", Threshold: 10}}}, "admin", AnyVersion)
+	errNil(t, err)
+	equals(t, AlertTargetTopic, plan.AlertRules[0].Target)
+	assert(t, plan.AlertRules[0].ID != "", "the rule id is generated")
+
+	// a rule stored before the validation is skipped by the evaluation
+	plan.AlertRules = append(plan.AlertRules,
+		AlertRule{ID: "unknown-operator", Metric: "msgBacklog", Operator: "=~"},
+		AlertRule{ID: "unknown-metric", Target: AlertTargetSubscription, Metric: "color", Operator: ">"})
+	errNil(t, store.Update(plan))
+	stored, err := store.Get("invalid-alerts")
+	errNil(t, err)
+	equals(t, 3, len(stored.AlertRules))
+
+	upsertTestTopicStats("invalid-alerts", "ns1", "orders", map[string]interface{}{
+		"subscriptions": map[string]interface{}{
+			"billing": map[string]interface{}{"msgBacklog": float64(42), "consumers": []interface{}{}},
+		},
+	})
+	EvaluateAlerts([]TenantPlan{stored}, time.Now(), nil)
+	alerts := TenantAlerts("invalid-alerts")
+	equals(t, 1, len(alerts))
+	equals(t, plan.AlertRules[0].ID, alerts[0].RuleID)
+}
+
+func TestTopicStatsCollector(t *testing.T) {
+	errNil(t, InitTopicStatsDB())
+	upsertTestTopicStats("metrics-tenant", "ns1", "orders", map[string]interface{}{
+		"msgRateIn": float64(12.5),
+		"subscriptions": map[string]interface{}{
+			"billing": map[string]interface{}{"msgBacklog": float64(42), "consumers": []interface{}{map[string]interface{}{}}},
+		},
+	})
+	upsertTestTopicStats("another-metrics-tenant", "ns1", "orders", map[string]interface{}{"msgRateIn": float64(1)})
+
+	expected := `
+# HELP burnell_subscription_msg_backlog The cached subscription stats msgBacklog
+# TYPE burnell_subscription_msg_backlog gauge
+burnell_subscription_msg_backlog{namespace="metrics-tenant/ns1",subscription="billing",tenant="metrics-tenant",topic="persistent://metrics-tenant/ns1/orders"} 42
+# HELP burnell_topic_msg_rate_in The cached topic stats msgRateIn
+# TYPE burnell_topic_msg_rate_in gauge
+burnell_topic_msg_rate_in{namespace="metrics-tenant/ns1",tenant="metrics-tenant",topic="persistent://metrics-tenant/ns1/orders"} 12.5
+`
+	errNil(t, testutil.CollectAndCompare(TopicStatsCollector{Tenant: "metrics-tenant"}, strings.NewReader(expected),
+		"burnell_topic_msg_rate_in", "burnell_subscription_msg_backlog"))
+	equals(t, 11+6, testutil.CollectAndCount(TopicStatsCollector{Tenant: "metrics-tenant"}))
+	assert(t, testutil.CollectAndCount(TopicStatsCollector{}, "burnell_topic_msg_rate_in") >= 2, "all the tenants are exported")
+}
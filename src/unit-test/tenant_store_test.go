@@ -0,0 +1,612 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	. "github.com/datastax/burnell/src/policy"
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// tenantWatcher records the tenant changes delivered by a store's Watch
+type tenantWatcher struct {
+	lock    sync.Mutex
+	tenants map[string]TenantPlan
+	ready   bool
+}
+
+func (w *tenantWatcher) onChange(t TenantPlan) {
+	w.lock.Lock()
+	w.tenants[t.Name] = t
+	w.lock.Unlock()
+}
+
+func (w *tenantWatcher) onReady() {
+	w.lock.Lock()
+	w.ready = true
+	w.lock.Unlock()
+}
+
+func (w *tenantWatcher) get(tenantName string) (TenantPlan, bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	t, ok := w.tenants[tenantName]
+	return t, ok
+}
+
+func (w *tenantWatcher) isReady() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.ready
+}
+
+// waitFor polls the condition until it is true or fails the test after the timeout
+func waitFor(t *testing.T, condition func() bool, msg string) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", msg)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func tenantNames(plans []TenantPlan) []string {
+	names := []string{}
+	for _, v := range plans {
+		names = append(names, v.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// testTenantStoreConformance verifies the behaviour every tenant store must provide
+func testTenantStoreConformance(t *testing.T, store TenantStore) {
+	// a tenant that exists before watching must be delivered before ready
+	errNil(t, store.Update(TenantPlan{Name: "existing", PlanType: FreeTier, TenantStatus: Activated, Version: 1}))
+
+	watcher := &tenantWatcher{tenants: make(map[string]TenantPlan)}
+	errNil(t, store.Watch(watcher.onChange, watcher.onReady))
+	waitFor(t, watcher.isReady, "watch ready")
+	_, ok := watcher.get("existing")
+	assert(t, ok, "existing tenant is delivered before ready")
+
+	_, err := store.Get("tenant1")
+	assert(t, errors.Is(err, ErrTenantNotFound), "tenant1 does not exist yet")
+
+	errNil(t, store.Update(TenantPlan{Name: "tenant1", PlanType: FreeTier, TenantStatus: Activated, Version: 1}))
+	plan, err := store.Get("tenant1")
+	errNil(t, err)
+	equals(t, FreeTier, plan.PlanType)
+	equals(t, int64(1), plan.Version)
+	waitFor(t, func() bool {
+		v, ok := watcher.get("tenant1")
+		return ok && v.Version == 1
+	}, "tenant1 creation")
+
+	errNil(t, store.Update(TenantPlan{Name: "tenant1", PlanType: StarterTier, TenantStatus: Activated, Version: 2, Policy: PlanPolicy{Name: StarterTier, NumOfTopics: 20}}))
+	plan, err = store.Get("tenant1")
+	errNil(t, err)
+	equals(t, StarterTier, plan.PlanType)
+	waitFor(t, func() bool {
+		v, ok := watcher.get("tenant1")
+		return ok && v.Version == 2 && v.PlanType == StarterTier
+	}, "tenant1 update")
+	equals(t, 20, store.(TenantPolicyEvaluator).GetPlanPolicy("tenant1").NumOfTopics)
+	errNil(t, store.(TenantPolicyEvaluator).Evaluate("tenant1"))
+
+	errNil(t, store.Update(TenantPlan{Name: "tenant2", PlanType: ProductionTier, TenantStatus: Suspended, Version: 1}))
+	assert(t, store.(TenantPolicyEvaluator).Evaluate("tenant2") != nil, "suspended tenant fails evaluation")
+	plans, err := store.List()
+	errNil(t, err)
+	equals(t, []string{"existing", "tenant1", "tenant2"}, tenantNames(plans))
+
+	errNil(t, store.Delete(TenantPlan{Name: "tenant1", PlanType: StarterTier, TenantStatus: Deleted, Version: 3}))
+	_, err = store.Get("tenant1")
+	assert(t, errors.Is(err, ErrTenantNotFound), "tenant1 has been deleted")
+	plans, err = store.List()
+	errNil(t, err)
+	equals(t, []string{"existing", "tenant2"}, tenantNames(plans))
+	waitFor(t, func() bool {
+		v, ok := watcher.get("tenant1")
+		return ok && v.TenantStatus == Deleted
+	}, "tenant1 deletion")
+
+	errNil(t, store.Close())
+}
+
+func TestZookeeperTenantStore(t *testing.T) {
+	store, err := NewZookeeperDriver(newInMemoryZk(), "/burnell/tenants")
+	errNil(t, err)
+	testTenantStoreConformance(t, store)
+}
+
+func TestRestTenantStore(t *testing.T) {
+	server := httptest.NewServer(newTenantService("secret"))
+	defer server.Close()
+
+	store := &RestClient{Token: "secret", PollInterval: 50 * time.Millisecond}
+	errNil(t, store.Conn(server.URL+"/v1"))
+	testTenantStoreConformance(t, store)
+
+	unauthorized := &RestClient{}
+	errNil(t, unauthorized.Conn(server.URL+"/v1"))
+	_, err := unauthorized.List()
+	assert(t, err != nil, "the token is required")
+}
+
+// testConcurrentTenantUpdates verifies two instances sharing a conditional store do not overwrite each other's updates
+func testConcurrentTenantUpdates(t *testing.T, store1, store2 TenantStore) {
+	instance1 := NewTenantPolicyHandler(store1)
+	instance2 := NewTenantPolicyHandler(store2)
+
+	plan, status, err := instance1.UpdateTenant("tenant3", TenantPlan{PlanType: StarterTier}, "admin1", 0)
+	errNil(t, err)
+	equals(t, http.StatusOK, status)
+	equals(t, int64(1), plan.Version)
+
+	// the second instance has not seen the tenant yet
+	_, status, err = instance2.UpdateTenant("tenant3", TenantPlan{PlanType: ProductionTier}, "admin2", 0)
+	assert(t, errors.Is(err, ErrVersionConflict), "the tenant has been created by the other instance")
+	equals(t, http.StatusConflict, status)
+
+	plan, status, err = instance2.UpdateTenant("tenant3", TenantPlan{PlanType: ProductionTier}, "admin2", AnyVersion)
+	errNil(t, err)
+	equals(t, http.StatusOK, status)
+	equals(t, int64(2), plan.Version)
+	equals(t, ProductionTier, plan.PlanType)
+
+	// the first instance still has version 1 in its tenant map
+	_, status, err = instance1.UpdateTenant("tenant3", TenantPlan{PlanType: FreeTier}, "admin1", 1)
+	assert(t, errors.Is(err, ErrVersionConflict), "version 1 has been updated by the other instance")
+	equals(t, http.StatusConflict, status)
+
+	stored, err := store1.Get("tenant3")
+	errNil(t, err)
+	equals(t, ProductionTier, stored.PlanType)
+	equals(t, int64(2), stored.Version)
+
+	// every successful concurrent update has its own version so that none is silently overwritten
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	versions := make(map[int64]bool)
+	for _, instance := range []*TenantPolicyHandler{instance1, instance2} {
+		wg.Add(1)
+		go func(instance *TenantPolicyHandler) {
+			defer wg.Done()
+			for i := 0; i < 5; i++ {
+				plan, _, err := instance.UpdateTenant("tenant3", TenantPlan{PlanType: StarterTier}, "admin", AnyVersion)
+				if err == nil {
+					lock.Lock()
+					assert(t, !versions[plan.Version], fmt.Sprintf("version %d is written once", plan.Version))
+					versions[plan.Version] = true
+					lock.Unlock()
+				}
+			}
+		}(instance)
+	}
+	wg.Wait()
+	stored, err = store2.Get("tenant3")
+	errNil(t, err)
+	equals(t, int64(2+len(versions)), stored.Version)
+}
+
+func TestZookeeperConcurrentTenantUpdates(t *testing.T) {
+	conn := newInMemoryZk()
+	store1, err := NewZookeeperDriver(conn, "/burnell/tenants")
+	errNil(t, err)
+	store2, err := NewZookeeperDriver(conn, "/burnell/tenants")
+	errNil(t, err)
+	testConcurrentTenantUpdates(t, store1, store2)
+}
+
+func TestRestConcurrentTenantUpdates(t *testing.T) {
+	server := httptest.NewServer(newTenantService("secret"))
+	defer server.Close()
+
+	store1 := &RestClient{Token: "secret"}
+	errNil(t, store1.Conn(server.URL+"/v1"))
+	store2 := &RestClient{Token: "secret"}
+	errNil(t, store2.Conn(server.URL+"/v1"))
+	testConcurrentTenantUpdates(t, store1, store2)
+}
+
+func TestPulsarConcurrentTenantUpdates(t *testing.T) {
+	client := newInMemoryPulsar()
+	store1 := NewPulsarTopicDriverWithClient(client, "persistent://public/default/tenants-management")
+	store2 := NewPulsarTopicDriverWithClient(client, "persistent://public/default/tenants-management")
+	testConcurrentTenantUpdates(t, store1, store2)
+
+	// a conditional update waits for the writer held by another instance and then sees its write
+	writer, err := client.CreateProducer(pulsar.ProducerOptions{Name: "burnell-tenant-writer"})
+	errNil(t, err)
+	result := make(chan error)
+	go func() {
+		result <- store1.UpdateIfVersion(TenantPlan{Name: "tenant4", PlanType: FreeTier, Version: 1}, 0)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	data, _ := json.Marshal(TenantPlan{Name: "tenant4", PlanType: StarterTier, Version: 1})
+	_, err = writer.Send(context.Background(), &pulsar.ProducerMessage{Payload: data, Key: "tenant4"})
+	errNil(t, err)
+	writer.Close()
+	err = <-result
+	assert(t, errors.Is(err, ErrVersionConflict), "version 1 has been written by the other instance")
+	stored, err := store2.Get("tenant4")
+	errNil(t, err)
+	equals(t, StarterTier, stored.PlanType)
+}
+
+func TestPulsarTenantStore(t *testing.T) {
+	store := NewPulsarTopicDriverWithClient(newInMemoryPulsar(), "persistent://public/default/tenants-management")
+	testTenantStoreConformance(t, store)
+}
+
+// TestPulsarClusterTenantStore requires a running Pulsar cluster specified by PULSAR_TEST_URL
+func TestPulsarClusterTenantStore(t *testing.T) {
+	pulsarURL := os.Getenv("PULSAR_TEST_URL")
+	if pulsarURL == "" {
+		t.Skip("PULSAR_TEST_URL is not set")
+	}
+	topic := "persistent://public/default/tenant-store-test-" + time.Now().Format("20060102150405")
+	store := NewPulsarTopicDriver(topic, os.Getenv("PULSAR_TEST_TOKEN"), "")
+	errNil(t, store.Conn(pulsarURL))
+	testTenantStoreConformance(t, store)
+}
+
+// newTenantService is an in-memory tenant service implementing the REST API consumed by RestClient
+func newTenantService(token string) http.Handler {
+	var lock sync.Mutex
+	tenants := make(map[string]TenantPlan)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+
+		name := strings.TrimPrefix(r.URL.Path, "/v1/tenants")
+		name = strings.TrimPrefix(name, "/")
+		switch {
+		case name == "" && r.Method == http.MethodGet:
+			plans := []TenantPlan{}
+			for _, v := range tenants {
+				plans = append(plans, v)
+			}
+			json.NewEncoder(w).Encode(plans)
+		case r.Method == http.MethodGet:
+			if v, ok := tenants[name]; ok {
+				json.NewEncoder(w).Encode(v)
+				return
+			}
+			w.WriteHeader(http.StatusNotFound)
+		case r.Method == http.MethodPut:
+			plan := TenantPlan{}
+			if err := json.NewDecoder(r.Body).Decode(&plan); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && ifMatch != strconv.Quote(strconv.FormatInt(tenants[name].Version, 10)) {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				return
+			}
+			tenants[name] = plan
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodDelete:
+			if _, ok := tenants[name]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			delete(tenants, name)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// inMemoryZk is an in-memory zookeeper with one-time watches standing in for a zookeeper server
+type inMemoryZk struct {
+	lock         sync.Mutex
+	nodes        map[string][]byte
+	versions     map[string]int32
+	dataWatches  map[string][]chan zk.Event
+	childWatches map[string][]chan zk.Event
+}
+
+func newInMemoryZk() *inMemoryZk {
+	return &inMemoryZk{
+		nodes:        map[string][]byte{"/": nil},
+		versions:     make(map[string]int32),
+		dataWatches:  make(map[string][]chan zk.Event),
+		childWatches: make(map[string][]chan zk.Event),
+	}
+}
+
+func (z *inMemoryZk) fire(watches map[string][]chan zk.Event, nodePath string, eventType zk.EventType) {
+	for _, ch := range watches[nodePath] {
+		ch <- zk.Event{Type: eventType, Path: nodePath}
+		close(ch)
+	}
+	delete(watches, nodePath)
+}
+
+func (z *inMemoryZk) watch(watches map[string][]chan zk.Event, nodePath string) <-chan zk.Event {
+	ch := make(chan zk.Event, 1)
+	watches[nodePath] = append(watches[nodePath], ch)
+	return ch
+}
+
+func (z *inMemoryZk) Get(nodePath string) ([]byte, *zk.Stat, error) {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+	data, ok := z.nodes[nodePath]
+	if !ok {
+		return nil, nil, zk.ErrNoNode
+	}
+	return data, &zk.Stat{Version: z.versions[nodePath]}, nil
+}
+
+func (z *inMemoryZk) GetW(nodePath string) ([]byte, *zk.Stat, <-chan zk.Event, error) {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+	data, ok := z.nodes[nodePath]
+	if !ok {
+		return nil, nil, nil, zk.ErrNoNode
+	}
+	return data, &zk.Stat{Version: z.versions[nodePath]}, z.watch(z.dataWatches, nodePath), nil
+}
+
+func (z *inMemoryZk) Set(nodePath string, data []byte, version int32) (*zk.Stat, error) {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+	if _, ok := z.nodes[nodePath]; !ok {
+		return nil, zk.ErrNoNode
+	}
+	if version != -1 && version != z.versions[nodePath] {
+		return nil, zk.ErrBadVersion
+	}
+	z.nodes[nodePath] = data
+	z.versions[nodePath]++
+	z.fire(z.dataWatches, nodePath, zk.EventNodeDataChanged)
+	return &zk.Stat{Version: z.versions[nodePath]}, nil
+}
+
+func (z *inMemoryZk) Create(nodePath string, data []byte, flags int32, acl []zk.ACL) (string, error) {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+	if _, ok := z.nodes[nodePath]; ok {
+		return "", zk.ErrNodeExists
+	}
+	if _, ok := z.nodes[path.Dir(nodePath)]; !ok {
+		return "", zk.ErrNoNode
+	}
+	z.nodes[nodePath] = data
+	z.fire(z.childWatches, path.Dir(nodePath), zk.EventNodeChildrenChanged)
+	return nodePath, nil
+}
+
+func (z *inMemoryZk) Delete(nodePath string, version int32) error {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+	if _, ok := z.nodes[nodePath]; !ok {
+		return zk.ErrNoNode
+	}
+	delete(z.nodes, nodePath)
+	delete(z.versions, nodePath)
+	z.fire(z.dataWatches, nodePath, zk.EventNodeDeleted)
+	z.fire(z.childWatches, path.Dir(nodePath), zk.EventNodeChildrenChanged)
+	return nil
+}
+
+func (z *inMemoryZk) Exists(nodePath string) (bool, *zk.Stat, error) {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+	_, ok := z.nodes[nodePath]
+	return ok, &zk.Stat{}, nil
+}
+
+func (z *inMemoryZk) children(nodePath string) []string {
+	children := []string{}
+	for k := range z.nodes {
+		if k != "/" && path.Dir(k) == nodePath {
+			children = append(children, path.Base(k))
+		}
+	}
+	sort.Strings(children)
+	return children
+}
+
+func (z *inMemoryZk) Children(nodePath string) ([]string, *zk.Stat, error) {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+	if _, ok := z.nodes[nodePath]; !ok {
+		return nil, nil, zk.ErrNoNode
+	}
+	return z.children(nodePath), &zk.Stat{}, nil
+}
+
+func (z *inMemoryZk) ChildrenW(nodePath string) ([]string, *zk.Stat, <-chan zk.Event, error) {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+	if _, ok := z.nodes[nodePath]; !ok {
+		return nil, nil, nil, zk.ErrNoNode
+	}
+	return z.children(nodePath), &zk.Stat{}, z.watch(z.childWatches, nodePath), nil
+}
+
+func (z *inMemoryZk) Close() {}
+
+// inMemoryPulsar is an in-memory Pulsar client of a single topic standing in for a Pulsar cluster.
+// Only the operations used by the tenant store are implemented.
+type inMemoryPulsar struct {
+	pulsar.Client
+	lock     sync.Mutex
+	messages []*inMemoryMessage
+	// the connected producer names, a name is admitted once at a time
+	producers map[string]bool
+	// closed and replaced whenever a message is sent
+	sent   chan struct{}
+	closed chan struct{}
+}
+
+type inMemoryMessageID struct {
+	pulsar.MessageID
+	index int
+}
+
+type inMemoryMessage struct {
+	pulsar.Message
+	id      inMemoryMessageID
+	payload []byte
+}
+
+func (m *inMemoryMessage) ID() pulsar.MessageID { return m.id }
+
+func (m *inMemoryMessage) Payload() []byte { return m.payload }
+
+func newInMemoryPulsar() *inMemoryPulsar {
+	return &inMemoryPulsar{
+		producers: make(map[string]bool),
+		sent:      make(chan struct{}),
+		closed:    make(chan struct{}),
+	}
+}
+
+func (c *inMemoryPulsar) send(payload []byte) pulsar.MessageID {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	id := inMemoryMessageID{index: len(c.messages)}
+	c.messages = append(c.messages, &inMemoryMessage{id: id, payload: payload})
+	close(c.sent)
+	c.sent = make(chan struct{})
+	return id
+}
+
+func (c *inMemoryPulsar) CreateProducer(options pulsar.ProducerOptions) (pulsar.Producer, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if options.Name != "" {
+		if c.producers[options.Name] {
+			return nil, fmt.Errorf("producer with name %s is already connected", options.Name)
+		}
+		c.producers[options.Name] = true
+	}
+	return &inMemoryProducer{client: c, name: options.Name}, nil
+}
+
+func (c *inMemoryPulsar) CreateReader(options pulsar.ReaderOptions) (pulsar.Reader, error) {
+	select {
+	case <-c.closed:
+		return nil, errors.New("client is closed")
+	default:
+	}
+	next := 0
+	if id, ok := options.StartMessageID.(inMemoryMessageID); ok {
+		next = id.index + 1
+	}
+	return &inMemoryReader{client: c, next: next, done: make(chan struct{})}, nil
+}
+
+func (c *inMemoryPulsar) Close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	select {
+	case <-c.closed:
+	default:
+		close(c.closed)
+	}
+}
+
+type inMemoryProducer struct {
+	pulsar.Producer
+	client *inMemoryPulsar
+	name   string
+}
+
+func (p *inMemoryProducer) Send(ctx context.Context, msg *pulsar.ProducerMessage) (pulsar.MessageID, error) {
+	return p.client.send(msg.Payload), nil
+}
+
+func (p *inMemoryProducer) Flush() error { return nil }
+
+func (p *inMemoryProducer) Close() {
+	p.client.lock.Lock()
+	defer p.client.lock.Unlock()
+	delete(p.client.producers, p.name)
+}
+
+type inMemoryReader struct {
+	pulsar.Reader
+	client *inMemoryPulsar
+	next   int
+	done   chan struct{}
+}
+
+func (r *inMemoryReader) HasNext() bool {
+	r.client.lock.Lock()
+	defer r.client.lock.Unlock()
+	return r.next < len(r.client.messages)
+}
+
+func (r *inMemoryReader) Next(ctx context.Context) (pulsar.Message, error) {
+	for {
+		r.client.lock.Lock()
+		if r.next < len(r.client.messages) {
+			msg := r.client.messages[r.next]
+			r.next++
+			r.client.lock.Unlock()
+			return msg, nil
+		}
+		sent := r.client.sent
+		r.client.lock.Unlock()
+
+		select {
+		case <-sent:
+		case <-r.done:
+			return nil, errors.New("reader is closed")
+		case <-r.client.closed:
+			return nil, errors.New("client is closed")
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (r *inMemoryReader) Close() {
+	close(r.done)
+}
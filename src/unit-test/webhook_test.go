@@ -0,0 +1,177 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package tests
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/datastax/burnell/src/policy"
+	"github.com/datastax/burnell/src/webhook"
+)
+
+// webhookReceiver records the events verified by the signature and replies with the status codes in order
+type webhookReceiver struct {
+	secret   string
+	statuses []int
+	events   []webhook.Event
+	requests int
+	lock     sync.Mutex
+}
+
+func (wr *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	wr.lock.Lock()
+	defer wr.lock.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	timestamp, _ := strconv.ParseInt(r.Header.Get(webhook.TimestampHeader), 10, 64)
+	if r.Header.Get(webhook.SignatureHeader) != webhook.Sign(wr.secret, timestamp, body) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	status := http.StatusOK
+	if wr.requests < len(wr.statuses) {
+		status = wr.statuses[wr.requests]
+	}
+	wr.requests++
+	if status == http.StatusOK {
+		var e webhook.Event
+		json.Unmarshal(body, &e)
+		wr.events = append(wr.events, e)
+	}
+	w.WriteHeader(status)
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	receiver := &webhookReceiver{secret: "billing-secret", statuses: []int{http.StatusInternalServerError, http.StatusTooManyRequests}}
+	billing := httptest.NewServer(receiver)
+	defer billing.Close()
+	crm := httptest.NewServer(&webhookReceiver{secret: "crm-secret", statuses: []int{http.StatusBadRequest}})
+	defer crm.Close()
+	wrongSecret := httptest.NewServer(&webhookReceiver{secret: "another-secret"})
+	defer wrongSecret.Close()
+
+	d := webhook.NewDispatcher([]webhook.Subscription{
+		{ID: "billing", URL: billing.URL, Secret: "billing-secret", Events: []string{webhook.TenantCreated, webhook.TenantPlanChanged}},
+		{ID: "crm", URL: crm.URL, Secret: "crm-secret", Tenants: []string{"tenant1"}},
+		{ID: "wrong-secret", URL: wrongSecret.URL, Secret: "crm-secret", Events: []string{webhook.TenantDeleted}},
+	})
+	d.Backoff = 10 * time.Millisecond
+	d.MaxBackoff = 20 * time.Millisecond
+	d.MaxAttempts = 3
+
+	d.Publish(webhook.NewEvent(webhook.TenantCreated, "tenant1", policy.TenantEventData{PlanType: policy.FreeTier}))
+	d.Publish(webhook.NewEvent(webhook.TenantDeleted, "tenant2", nil))
+	d.Wait()
+
+	// billing succeeds on the third attempt
+	equals(t, 3, receiver.requests)
+	equals(t, 1, len(receiver.events))
+	equals(t, webhook.TenantCreated, receiver.events[0].Type)
+	equals(t, "tenant1", receiver.events[0].Tenant)
+
+	deliveries := d.Deliveries(webhook.DeliveryQuery{SubscriptionID: "billing"})
+	equals(t, 1, len(deliveries))
+	equals(t, webhook.Delivered, deliveries[0].Status)
+	equals(t, 3, deliveries[0].Attempts)
+
+	// a client error is not retried
+	deliveries = d.Deliveries(webhook.DeliveryQuery{SubscriptionID: "crm"})
+	equals(t, 1, len(deliveries))
+	equals(t, webhook.Failed, deliveries[0].Status)
+	equals(t, 1, deliveries[0].Attempts)
+	equals(t, http.StatusBadRequest, deliveries[0].StatusCode)
+
+	// the receiver rejects the signature with another secret
+	deliveries = d.Deliveries(webhook.DeliveryQuery{Tenant: "tenant2"})
+	equals(t, 1, len(deliveries))
+	equals(t, webhook.Failed, deliveries[0].Status)
+	equals(t, http.StatusUnauthorized, deliveries[0].StatusCode)
+
+	equals(t, 2, len(d.Deliveries(webhook.DeliveryQuery{Status: webhook.Failed})))
+	equals(t, 1, len(d.Deliveries(webhook.DeliveryQuery{Limit: 1})))
+	equals(t, 0, len(d.Deliveries(webhook.DeliveryQuery{EventType: webhook.QuotaLimitReached})))
+}
+
+func TestWebhookSubscriptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webhook")
+	errNil(t, err)
+	defer os.RemoveAll(dir)
+
+	filePath := filepath.Join(dir, "webhooks.yml")
+	errNil(t, ioutil.WriteFile(filePath, []byte("- id: billing\n  url: https://billing.example.com/hook\n  secret: s1\n  events: [tenant.created]\n"), 0644))
+	subs, err := webhook.LoadSubscriptions(filePath)
+	errNil(t, err)
+	equals(t, 1, len(subs))
+	assert(t, subs[0].Matches(webhook.Event{Type: webhook.TenantCreated, Tenant: "any"}), "match the subscribed event")
+	assert(t, !subs[0].Matches(webhook.Event{Type: webhook.TenantDeleted, Tenant: "any"}), "not match another event")
+
+	errNil(t, ioutil.WriteFile(filePath, []byte("- id: billing\n  url: billing.example.com/hook\n"), 0644))
+	_, err = webhook.LoadSubscriptions(filePath)
+	assertErr(t, "invalid webhook subscription billing url billing.example.com/hook", err)
+	assertErr(t, "duplicate webhook subscription id a", webhook.ValidateSubscriptions([]webhook.Subscription{
+		{ID: "a", URL: "http://a.com"}, {ID: "a", URL: "http://b.com"}}))
+
+	equals(t, webhook.Sign("secret", 1600000000, []byte("{}")), webhook.Sign("secret", 1600000000, []byte("{}")))
+	assert(t, webhook.Sign("secret", 1600000000, []byte("{}")) != webhook.Sign("secret", 1600000001, []byte("{}")), "the timestamp is signed")
+}
+
+func TestTenantWebhookEvents(t *testing.T) {
+	free := policy.TenantPlan{Name: "tenant1", PlanType: policy.FreeTier, TenantStatus: policy.Activated, Policy: policy.TenantPlanPolicies.FreePlan}
+	equals(t, []string{webhook.TenantCreated}, policy.TenantChangeEvents(policy.TenantPlan{}, free))
+
+	suspended := free
+	suspended.PlanType = policy.StarterTier
+	suspended.TenantStatus = policy.Suspended
+	equals(t, []string{webhook.TenantPlanChanged, webhook.TenantSuspended}, policy.TenantChangeEvents(free, suspended))
+	equals(t, []string{}, policy.TenantChangeEvents(suspended, suspended))
+
+	deleted := free
+	deleted.TenantStatus = policy.Deleted
+	equals(t, []string{webhook.TenantDeleted}, policy.TenantChangeEvents(free, deleted))
+
+	quota := policy.BuildTenantQuota(free, policy.TenantResourceUsage{Topics: 4, Namespaces: 1})
+	crossings := policy.QuotaThresholdCrossings(quota, 80)
+	equals(t, 2, len(crossings))
+	equals(t, policy.QuotaTopics, crossings[0].Dimension)
+	equals(t, 0, len(policy.QuotaThresholdCrossings(quota, 80)))
+
+	quota = policy.BuildTenantQuota(free, policy.TenantResourceUsage{Topics: 1, Namespaces: 1})
+	equals(t, 0, len(policy.QuotaThresholdCrossings(quota, 80)))
+	quota = policy.BuildTenantQuota(free, policy.TenantResourceUsage{Topics: 5, Namespaces: 1})
+	crossings = policy.QuotaThresholdCrossings(quota, 80)
+	equals(t, 1, len(crossings))
+	equals(t, policy.QuotaTopics, crossings[0].Dimension)
+
+	now := time.Now()
+	assert(t, policy.IsQuotaLimitReportDue("tenant1", policy.QuotaNamespaces, now), "the first denial is reported")
+	assert(t, !policy.IsQuotaLimitReportDue("tenant1", policy.QuotaNamespaces, now.Add(time.Minute)), "the denial is reported once per interval")
+	assert(t, policy.IsQuotaLimitReportDue("tenant1", policy.QuotaNamespaces, now.Add(2*time.Hour)), "the denial is reported after the interval")
+}
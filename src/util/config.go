@@ -72,7 +72,19 @@ type Configuration struct {
 	FederatedPromInterval string `json:"FederatedPromInterval"`
 
 	TenantManagmentTopic string `json:"TenantManagmentTopic"`
+	TenantSnapshotPath   string `json:"TenantSnapshotPath"`
+	TenantStoreType      string `json:"TenantStoreType"`
+	TenantStoreURL       string `json:"TenantStoreURL"`
+	TenantStorePath      string `json:"TenantStorePath"`
+	TenantStoreToken     string `json:"TenantStoreToken"`
+	OrgManagementTopic   string `json:"OrgManagementTopic"`
+	FeatureCodesFile     string `json:"FeatureCodesFile"`
+	EnforceFeatureCodes  string `json:"EnforceFeatureCodes"`
+	TenantRetention      string `json:"TenantRetention"`
+	WebhookConfigFile    string `json:"WebhookConfigFile"`
 	PulsarBeamTopic      string `json:"PulsarBeamTopic"`
+	TopicEventsTopic     string `json:"TopicEventsTopic"`
+	NotificationLeader   string `json:"NotificationLeader"`
 
 	LogServerPort string `json:"LogServerPort"`
 }
@@ -221,3 +233,21 @@ func IsStatsMode() bool {
 	c := GetConfig()
 	return c.FederatedPromInterval != ""
 }
+
+// IsFeatureCodeEnforced evaluates if the routes requiring a feature code reject the tenants without the feature,
+// otherwise the feature usage is only recorded
+func IsFeatureCodeEnforced() bool {
+	return strings.EqualFold(GetConfig().EnforceFeatureCodes, "true")
+}
+
+// IsTenantRetentionAllowed evaluates if tenants can set their namespace retention within their plans,
+// otherwise the namespace retention can only be set by super roles
+func IsTenantRetentionAllowed() bool {
+	return strings.EqualFold(GetConfig().TenantRetention, "true")
+}
+
+// IsNotificationLeader evaluates if this replica runs the scheduled evaluations that notify the webhook
+// subscriptions and the topic events, which must be enabled on only one replica to notify once
+func IsNotificationLeader() bool {
+	return strings.EqualFold(GetConfig().NotificationLeader, "true")
+}
@@ -32,6 +32,12 @@ const Initializer = "init"
 // Healer repairs any misconfiguration in an already deployed cluster
 const Healer = "healer"
 
+// TenantExporter exports the tenant database to a bundle file and exits
+const TenantExporter = "export"
+
+// TenantImporter imports a bundle file to the tenant database and exits
+const TenantImporter = "import"
+
 // IsInitializer check if the broker is required
 func IsInitializer(mode *string) bool {
 	return *mode == Initializer
@@ -41,3 +47,8 @@ func IsInitializer(mode *string) bool {
 func IsHealer(mode *string) bool {
 	return *mode == Healer
 }
+
+// IsTenantBundleMode is either the tenant export or import process mode
+func IsTenantBundleMode(mode *string) bool {
+	return *mode == TenantExporter || *mode == TenantImporter
+}
@@ -0,0 +1,370 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/datastax/burnell/src/util"
+	"github.com/ghodss/yaml"
+)
+
+// event types published to the webhook subscriptions
+const (
+	TenantCreated         = "tenant.created"
+	TenantPlanChanged     = "tenant.planChanged"
+	TenantSuspended       = "tenant.suspended"
+	TenantDeleted         = "tenant.deleted"
+	QuotaThresholdCrossed = "quota.thresholdCrossed"
+	QuotaLimitReached     = "quota.limitReached"
+	AlertFiring           = "alert.firing"
+	AlertResolved         = "alert.resolved"
+)
+
+// delivery status
+const (
+	Pending   = "pending"
+	Delivered = "delivered"
+	Failed    = "failed"
+)
+
+// http headers of a webhook delivery
+const (
+	SignatureHeader = "X-Burnell-Signature"
+	TimestampHeader = "X-Burnell-Timestamp"
+	EventHeader     = "X-Burnell-Event"
+	DeliveryHeader  = "X-Burnell-Delivery"
+)
+
+// Event is a tenant or quota event notified to the webhook subscriptions
+type Event struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	Tenant    string      `json:"tenant"`
+	Timestamp time.Time   `json:"timestamp"`
+	Data      interface{} `json:"data"`
+}
+
+// Subscription is a webhook endpoint subscribed to the events
+type Subscription struct {
+	ID     string `json:"id"`
+	URL    string `json:"url"`
+	Secret string `json:"secret,omitempty"`
+	// all the events and all the tenants are subscribed if not specified
+	Events  []string `json:"events,omitempty"`
+	Tenants []string `json:"tenants,omitempty"`
+}
+
+// Delivery is the delivery record of an event to a subscription
+type Delivery struct {
+	ID             string    `json:"id"`
+	SubscriptionID string    `json:"subscriptionId"`
+	URL            string    `json:"url"`
+	EventID        string    `json:"eventId"`
+	EventType      string    `json:"eventType"`
+	Tenant         string    `json:"tenant"`
+	Status         string    `json:"status"`
+	Attempts       int       `json:"attempts"`
+	StatusCode     int       `json:"statusCode"`
+	Error          string    `json:"error,omitempty"`
+	CreatedAt      time.Time `json:"createdAt"`
+	UpdatedAt      time.Time `json:"updatedAt"`
+}
+
+// DeliveryQuery is the filter of the delivery history, an empty attribute matches any
+type DeliveryQuery struct {
+	SubscriptionID string
+	Tenant         string
+	EventType      string
+	Status         string
+	Limit          int // 0 returns all the matched deliveries
+}
+
+// NewEvent creates an event with a unique id
+func NewEvent(eventType, tenant string, data interface{}) Event {
+	id, _ := util.NewUUID()
+	return Event{
+		ID:        id,
+		Type:      eventType,
+		Tenant:    tenant,
+		Timestamp: time.Now(),
+		Data:      data,
+	}
+}
+
+// Matches evaluates if the subscription subscribes to the event
+func (s Subscription) Matches(e Event) bool {
+	return (len(s.Events) == 0 || util.StrContains(s.Events, e.Type)) &&
+		(len(s.Tenants) == 0 || util.StrContains(s.Tenants, e.Tenant))
+}
+
+// ValidateSubscriptions validates the subscriptions require a unique id and an absolute http url
+func ValidateSubscriptions(subs []Subscription) error {
+	ids := make(map[string]bool)
+	for _, v := range subs {
+		if v.ID == "" {
+			return fmt.Errorf("webhook subscription id is required")
+		}
+		if ids[v.ID] {
+			return fmt.Errorf("duplicate webhook subscription id %s", v.ID)
+		}
+		ids[v.ID] = true
+		u, err := url.Parse(v.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid webhook subscription %s url %s", v.ID, v.URL)
+		}
+	}
+	return nil
+}
+
+// LoadSubscriptions loads a list of subscriptions in YAML or JSON from the file
+func LoadSubscriptions(filePath string) ([]Subscription, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	subs := []Subscription{}
+	if err = yaml.Unmarshal(data, &subs); err != nil {
+		return nil, err
+	}
+	return subs, ValidateSubscriptions(subs)
+}
+
+// Sign computes the hex encoded HMAC SHA256 signature over the timestamp and the body joined by a dot.
+// The receiver verifies the signature with the shared secret and rejects any stale timestamp to prevent replay.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Dispatcher delivers events to the subscriptions and keeps the delivery history
+type Dispatcher struct {
+	MaxAttempts int
+	Backoff     time.Duration // the delay before the first retry, doubled on every retry
+	MaxBackoff  time.Duration
+	HistorySize int
+
+	client        *http.Client
+	subscriptions []Subscription
+	deliveries    []Delivery
+	lock          sync.RWMutex
+	wg            sync.WaitGroup
+	logger        *log.Entry
+}
+
+// NewDispatcher creates a dispatcher with the retry and history settings from the environment variables
+func NewDispatcher(subs []Subscription) *Dispatcher {
+	return &Dispatcher{
+		MaxAttempts:   util.GetEnvInt("WebhookMaxAttempts", 5),
+		Backoff:       time.Duration(util.GetEnvInt("WebhookBackoffSecond", 2)) * time.Second,
+		MaxBackoff:    time.Duration(util.GetEnvInt("WebhookMaxBackoffSecond", 300)) * time.Second,
+		HistorySize:   util.GetEnvInt("WebhookHistorySize", 1000),
+		client:        &http.Client{Timeout: 10 * time.Second},
+		subscriptions: subs,
+		logger:        log.WithFields(log.Fields{"app": "webhook"}),
+	}
+}
+
+// Manager is the global webhook dispatcher
+var Manager = NewDispatcher(nil)
+
+// Init loads the webhook subscriptions from the configuration
+func Init() {
+	filePath := util.GetConfig().WebhookConfigFile
+	if filePath == "" {
+		return
+	}
+	subs, err := LoadSubscriptions(filePath)
+	if err != nil {
+		log.Fatalf("failed to load webhook subscriptions %v", err)
+	}
+	Manager.SetSubscriptions(subs)
+	log.Infof("loaded %d webhook subscriptions", len(subs))
+}
+
+// SetSubscriptions replaces all the subscriptions
+func (d *Dispatcher) SetSubscriptions(subs []Subscription) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.subscriptions = subs
+}
+
+// Subscriptions returns all the subscriptions
+func (d *Dispatcher) Subscriptions() []Subscription {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	subs := make([]Subscription, len(d.subscriptions))
+	copy(subs, d.subscriptions)
+	return subs
+}
+
+// Publish delivers the event asynchronously to every matched subscription
+func (d *Dispatcher) Publish(e Event) {
+	for _, sub := range d.Subscriptions() {
+		if !sub.Matches(e) {
+			continue
+		}
+		id, _ := util.NewUUID()
+		delivery := Delivery{
+			ID:             id,
+			SubscriptionID: sub.ID,
+			URL:            sub.URL,
+			EventID:        e.ID,
+			EventType:      e.Type,
+			Tenant:         e.Tenant,
+			Status:         Pending,
+			CreatedAt:      time.Now(),
+			UpdatedAt:      time.Now(),
+		}
+		d.record(delivery)
+		d.wg.Add(1)
+		go func(sub Subscription) {
+			defer d.wg.Done()
+			d.deliver(sub, e, delivery)
+		}(sub)
+	}
+}
+
+// Wait blocks until all the pending deliveries have completed
+func (d *Dispatcher) Wait() {
+	d.wg.Wait()
+}
+
+// deliver posts the event to the subscription and retries with exponential backoff
+// on connection errors, server errors, request timeout and too many requests
+func (d *Dispatcher) deliver(sub Subscription, e Event, delivery Delivery) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		delivery.Status = Failed
+		delivery.Error = err.Error()
+		d.record(delivery)
+		return
+	}
+
+	backoff := d.Backoff
+	for delivery.Attempts < d.MaxAttempts {
+		if delivery.Attempts > 0 {
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > d.MaxBackoff {
+				backoff = d.MaxBackoff
+			}
+		}
+		delivery.Attempts++
+		retriable := true
+		delivery.StatusCode, err = d.post(sub, e, delivery.ID, body)
+		if err == nil && delivery.StatusCode >= 200 && delivery.StatusCode < 300 {
+			delivery.Status = Delivered
+			delivery.Error = ""
+			d.record(delivery)
+			return
+		} else if err != nil {
+			delivery.Error = err.Error()
+		} else {
+			delivery.Error = http.StatusText(delivery.StatusCode)
+			retriable = delivery.StatusCode >= 500 || delivery.StatusCode == http.StatusRequestTimeout ||
+				delivery.StatusCode == http.StatusTooManyRequests
+		}
+		d.logger.Warnf("webhook %s delivery %s of event %s attempt %d failed %s", sub.ID, delivery.ID, e.Type, delivery.Attempts, delivery.Error)
+		if !retriable {
+			break
+		}
+		d.record(delivery)
+	}
+	delivery.Status = Failed
+	d.record(delivery)
+}
+
+func (d *Dispatcher) post(sub Subscription, e Event, deliveryID string, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, sub.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(EventHeader, e.Type)
+	req.Header.Set(DeliveryHeader, deliveryID)
+	if sub.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(sub.Secret, timestamp, body))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, nil
+}
+
+// record adds or updates the delivery in the history, only the most recent deliveries are kept
+func (d *Dispatcher) record(delivery Delivery) {
+	delivery.UpdatedAt = time.Now()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for i := len(d.deliveries) - 1; i >= 0; i-- {
+		if d.deliveries[i].ID == delivery.ID {
+			d.deliveries[i] = delivery
+			return
+		}
+	}
+	d.deliveries = append(d.deliveries, delivery)
+	if d.HistorySize > 0 && len(d.deliveries) > d.HistorySize {
+		d.deliveries = d.deliveries[len(d.deliveries)-d.HistorySize:]
+	}
+}
+
+// Deliveries returns the matched deliveries in the history, the most recent first
+func (d *Dispatcher) Deliveries(q DeliveryQuery) []Delivery {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	matched := []Delivery{}
+	for i := len(d.deliveries) - 1; i >= 0; i-- {
+		v := d.deliveries[i]
+		if (q.SubscriptionID != "" && q.SubscriptionID != v.SubscriptionID) ||
+			(q.Tenant != "" && q.Tenant != v.Tenant) ||
+			(q.EventType != "" && q.EventType != v.EventType) ||
+			(q.Status != "" && q.Status != v.Status) {
+			continue
+		}
+		matched = append(matched, v)
+		if q.Limit > 0 && len(matched) >= q.Limit {
+			break
+		}
+	}
+	return matched
+}
@@ -0,0 +1,103 @@
+//
+//  Copyright (c) 2021 Datastax, Inc.
+//
+//  Licensed to the Apache Software Foundation (ASF) under one
+//  or more contributor license agreements.  See the NOTICE file
+//  distributed with this work for additional information
+//  regarding copyright ownership.  The ASF licenses this file
+//  to you under the Apache License, Version 2.0 (the
+//  "License"); you may not use this file except in compliance
+//  with the License.  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an
+//  "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+//  KIND, either express or implied.  See the License for the
+//  specific language governing permissions and limitations
+//  under the License.
+//
+
+package workflow
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/datastax/burnell/src/policy"
+	"github.com/datastax/burnell/src/util"
+	"github.com/datastax/burnell/src/webhook"
+)
+
+// the actor recorded in the tenant plan history for the changes imported from the command line
+const tenantBundleActor = "burnell-cli"
+
+// RunTenantBundle exports the tenant database to a bundle file or imports a bundle file to the tenant database.
+// The bundle is written to stdout or read from stdin if the file is not specified.
+// The tenant database is connected without the background workers of the proxy since it runs once.
+func RunTenantBundle(mode, filePath, format, importMode string, dryRun, includeSecrets bool) error {
+	if err := policy.TenantManager.Connect(); err != nil {
+		return err
+	}
+	defer policy.TenantManager.Close()
+	if err := waitTenantDBReady(time.Duration(util.GetEnvInt("TenantDBReadyTimeoutSecond", 300)) * time.Second); err != nil {
+		return err
+	}
+
+	if mode == util.TenantExporter {
+		// the webhook subscriptions are exported from the configuration
+		webhook.Init()
+		data, err := policy.MarshalTenantBundle(policy.TenantManager.ExportTenants(includeSecrets), format)
+		if err != nil {
+			return err
+		}
+		if filePath == "" {
+			_, err = os.Stdout.Write(data)
+			return err
+		}
+		return ioutil.WriteFile(filePath, data, 0600)
+	}
+
+	var data []byte
+	var err error
+	if filePath == "" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(filePath)
+	}
+	if err != nil {
+		return err
+	}
+	bundle, err := policy.UnmarshalTenantBundle(data)
+	if err != nil {
+		return err
+	}
+	result, err := policy.TenantManager.ImportTenants(bundle, importMode, tenantBundleActor, dryRun)
+	for _, v := range result.Errors {
+		log.Errorf("tenant %s import error %s", v.Tenant, v.Error)
+	}
+	if err != nil {
+		return err
+	}
+	log.Infof("tenant bundle %s import (dry run %v) created %v updated %v deleted %v", importMode, dryRun, result.Created, result.Updated, result.Deleted)
+	if len(result.SkippedWebhooks) > 0 {
+		log.Warnf("webhook subscriptions %v are not imported, add them to WebhookConfigFile instead", result.SkippedWebhooks)
+	}
+	return nil
+}
+
+// waitTenantDBReady waits until the tenant database has caught up with the store
+func waitTenantDBReady(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for !policy.TenantManager.IsReady() {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("tenant database is not ready after %v", timeout)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return nil
+}